@@ -0,0 +1,13 @@
+// The i-Tree factor data, species map and prices shipped with
+// the service, embedded in the binary so it can run without a
+// data directory
+package data
+
+import (
+	"embed"
+)
+
+// The output__*.csv factor files, species.json and prices.json
+//
+//go:embed output__*.csv species.json prices.json
+var Files embed.FS
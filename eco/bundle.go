@@ -0,0 +1,797 @@
+package eco
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// Factor data bundles
+//
+// A bundle has every table from the output__*.csv files of a
+// data directory: the factors of each region, their building
+// type variants and the growth tables. Each table has its breaks,
+// its values by i-Tree code, the units of both and the file it
+// came from.
+//
+// Bundles can be written as JSON (optionally gzipped):
+//
+//   {
+//     "format": "otm-ecoservice-bundle",
+//     "version": 1,
+//     "source": "...",
+//     "regions": {
+//       "NoEastXXX": {
+//         "factors": {
+//           "electricity": {
+//             "breaks": [3.81, 11.43, ...],
+//             "breaks_unit": "cm",
+//             "unit": "kWh",
+//             "source": "output__NoEastXXX__electricity.csv",
+//             "values": {"ACPL": [1.0, 2.4, ...], ...}
+//           }, ...
+//         },
+//         "building_types": {"sfr": {"electricity": {...}}, ...},
+//         "growth": {...}
+//       }, ...
+//     }
+//   }
+//
+// or in a binary form that loads much faster, since most of the
+// time spent reading JSON goes to parsing the numbers in the
+// values. The binary form is:
+//
+//   the 8 bytes of binaryBundleMagic
+//   the bundle version, as a little endian uint32
+//   the length of the header, as a little endian uint32
+//   the header, which is the JSON bundle with each table's
+//     values replaced by a list of its i-Tree codes
+//   the values of every table, as little endian float64s
+//
+// The values are in the order of the tables (see Bundle.tables),
+// then of the codes of each table, then of the breaks.
+
+// Identifies bundles, and the newest version this
+// package can read
+const (
+	BundleFormat  = "otm-ecoservice-bundle"
+	BundleVersion = 1
+)
+
+// The names of the bundle files in a data directory, in
+// the order they are looked for
+var BundleFiles = []string{"bundle.bin", "bundle.json.gz", "bundle.json"}
+
+// The start of a binary bundle
+var binaryBundleMagic = []byte("OTMECOBN")
+
+// The provenance of bundles built from the shipped data
+const bundleSource = "i-Tree Streets resource unit tables, " +
+	"extracted with scripts/extractor.py"
+
+type Bundle struct {
+	Format  string                   `json:"format"`
+	Version int                      `json:"version"`
+	Source  string                   `json:"source"`
+	Regions map[string]*BundleRegion `json:"regions"`
+}
+
+type BundleRegion struct {
+	Factors       map[string]*BundleTable            `json:"factors"`
+	BuildingTypes map[string]map[string]*BundleTable `json:"building_types,omitempty"`
+	Growth        *BundleTable                       `json:"growth,omitempty"`
+}
+
+type BundleTable struct {
+	Breaks     []float64            `json:"breaks"`
+	BreaksUnit string               `json:"breaks_unit"`
+	Unit       string               `json:"unit"`
+	Source     string               `json:"source"`
+	Values     map[string][]float64 `json:"values,omitempty"`
+
+	// Only used in the header of binary bundles
+	Codes []string `json:"codes,omitempty"`
+}
+
+// All of the factor data for the service, as returned
+// by ReadDataFiles, ReadBuildingTypeFiles and ReadGrowthFiles
+//
+// The datafiles of Regions and BuildingTypes are
+// indexed by the factor data of Factors
+type FactorData struct {
+	Factors       *FactorSet
+	Regions       map[string][]*Datafile
+	BuildingTypes map[string]map[string][]*Datafile
+	Growth        map[string]*Datafile
+}
+
+func newBundleTable(datafile *Datafile, breaksUnit string, unit string, source string) *BundleTable {
+	return &BundleTable{datafile.Breaks, breaksUnit, unit, source, datafile.Values, nil}
+}
+
+// Build a bundle from the output__*.csv files in a directory,
+// with the factors of the directory (see ReadFactorSet)
+//
+// Errors are returned like ReadDataFiles
+func BuildBundle(basePath string) (*Bundle, error) {
+	names, err := listDataFiles(os.DirFS(basePath), basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	factors, err := dataFactorSet(names)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{BundleFormat, BundleVersion, bundleSource,
+		make(map[string]*BundleRegion)}
+	errs := DataErrors{}
+
+	for _, name := range names {
+		factor, buildingtype := factors.splitBuildingTypeFactor(name.factor)
+
+		if factors.Index(name.factor) < 0 && factor == "" &&
+			name.factor != growthFactor {
+
+			continue
+		}
+
+		datafile, err := name.read()
+
+		if err != nil {
+			errs = appendDataErrors(errs, err)
+			continue
+		}
+
+		region := bundle.Regions[name.region]
+
+		if region == nil {
+			region = &BundleRegion{Factors: make(map[string]*BundleTable)}
+			bundle.Regions[name.region] = region
+		}
+
+		source := filepath.Base(name.path)
+
+		switch {
+		case name.factor == growthFactor:
+			region.Growth = newBundleTable(datafile, "years", DiameterUnit, source)
+
+		case factor != "":
+			if region.BuildingTypes == nil {
+				region.BuildingTypes = make(map[string]map[string]*BundleTable)
+			}
+
+			if region.BuildingTypes[buildingtype] == nil {
+				region.BuildingTypes[buildingtype] = make(map[string]*BundleTable)
+			}
+
+			region.BuildingTypes[buildingtype][factor] = newBundleTable(
+				datafile, DiameterUnit, factors.Unit(factor), source)
+
+		default:
+			region.Factors[name.factor] = newBundleTable(
+				datafile, DiameterUnit, factors.Unit(name.factor), source)
+		}
+	}
+
+	return bundle, errs.err()
+}
+
+// Get every table of a bundle, in order of region, then
+// the factors, the building types and their factors and
+// finally the growth table
+func (b *Bundle) tables() []*BundleTable {
+	tables := make([]*BundleTable, 0)
+
+	for _, code := range sortedKeys(b.Regions) {
+		region := b.Regions[code]
+
+		for _, factor := range sortedKeys(region.Factors) {
+			tables = append(tables, region.Factors[factor])
+		}
+
+		for _, buildingtype := range sortedKeys(region.BuildingTypes) {
+			factors := region.BuildingTypes[buildingtype]
+
+			for _, factor := range sortedKeys(factors) {
+				tables = append(tables, factors[factor])
+			}
+		}
+
+		if region.Growth != nil {
+			tables = append(tables, region.Growth)
+		}
+	}
+
+	return tables
+}
+
+// Get the keys of a map with string keys, sorted
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	sorted := make([]string, len(keys))
+
+	for i, key := range keys {
+		sorted[i] = key.String()
+	}
+
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// Write a bundle as JSON, gzipped if compress is true
+func WriteBundle(w io.Writer, bundle *Bundle, compress bool) error {
+	if !compress {
+		return json.NewEncoder(w).Encode(bundle)
+	}
+
+	gz := gzip.NewWriter(w)
+
+	if err := json.NewEncoder(gz).Encode(bundle); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Write a bundle in the binary form
+func WriteBinaryBundle(w io.Writer, bundle *Bundle) error {
+	// The header is a copy of the bundle with codes
+	// instead of values
+	header := *bundle
+	header.Regions = make(map[string]*BundleRegion, len(bundle.Regions))
+
+	headerTable := func(t *BundleTable) *BundleTable {
+		copied := *t
+		copied.Values = nil
+		copied.Codes = sortedKeys(t.Values)
+
+		return &copied
+	}
+
+	for code, region := range bundle.Regions {
+		copied := &BundleRegion{Factors: make(map[string]*BundleTable)}
+
+		for factor, t := range region.Factors {
+			copied.Factors[factor] = headerTable(t)
+		}
+
+		if region.BuildingTypes != nil {
+			copied.BuildingTypes = make(map[string]map[string]*BundleTable)
+		}
+
+		for buildingtype, factors := range region.BuildingTypes {
+			copied.BuildingTypes[buildingtype] = make(map[string]*BundleTable)
+
+			for factor, t := range factors {
+				copied.BuildingTypes[buildingtype][factor] = headerTable(t)
+			}
+		}
+
+		if region.Growth != nil {
+			copied.Growth = headerTable(region.Growth)
+		}
+
+		header.Regions[code] = copied
+	}
+
+	headerJSON, err := json.Marshal(&header)
+
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(w)
+	buf.Write(binaryBundleMagic)
+	binary.Write(buf, binary.LittleEndian, uint32(bundle.Version))
+	binary.Write(buf, binary.LittleEndian, uint32(len(headerJSON)))
+	buf.Write(headerJSON)
+
+	// The header tables are in the same order as the
+	// bundle's, and have the codes in order
+	tables := bundle.tables()
+
+	for i, t := range header.tables() {
+		for _, code := range t.Codes {
+			values := tables[i].Values[code]
+
+			if len(values) != len(t.Breaks) {
+				return errors.New(fmt.Sprintf(
+					"%v in %v has %v values, expected %v",
+					code, t.Source, len(values), len(t.Breaks)))
+			}
+
+			binary.Write(buf, binary.LittleEndian, values)
+		}
+	}
+
+	return buf.Flush()
+}
+
+// Read a bundle written by WriteBundle or WriteBinaryBundle.
+// The form of the bundle is detected from its contents
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	reader := bufio.NewReader(r)
+	magic, _ := reader.Peek(len(binaryBundleMagic))
+
+	var bundle *Bundle
+	var err error
+
+	switch {
+	case bytes.Equal(magic, binaryBundleMagic):
+		bundle, err = readBinaryBundle(reader)
+
+	case bytes.Equal(magic[:2], []byte{0x1f, 0x8b}):
+		var gz *gzip.Reader
+
+		if gz, err = gzip.NewReader(reader); err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+
+		bundle = &Bundle{}
+		err = json.NewDecoder(gz).Decode(bundle)
+
+	default:
+		bundle = &Bundle{}
+		err = json.NewDecoder(reader).Decode(bundle)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bundle.Format != BundleFormat {
+		return nil, errors.New("Not a factor data bundle")
+	}
+
+	if bundle.Version < 1 || bundle.Version > BundleVersion {
+		return nil, errors.New(fmt.Sprintf(
+			"Unsupported bundle version %v, expected %v or earlier",
+			bundle.Version, BundleVersion))
+	}
+
+	return bundle, nil
+}
+
+func readBinaryBundle(reader io.Reader) (*Bundle, error) {
+	var preamble struct {
+		Magic        [8]byte
+		Version      uint32
+		HeaderLength uint32
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &preamble); err != nil {
+		return nil, err
+	}
+
+	if preamble.Version < 1 || preamble.Version > BundleVersion {
+		return nil, errors.New(fmt.Sprintf(
+			"Unsupported bundle version %v, expected %v or earlier",
+			preamble.Version, BundleVersion))
+	}
+
+	header := make([]byte, preamble.HeaderLength)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{}
+
+	if err := json.Unmarshal(header, bundle); err != nil {
+		return nil, err
+	}
+
+	tables := bundle.tables()
+	count := 0
+
+	for _, t := range tables {
+		count += len(t.Codes) * len(t.Breaks)
+	}
+
+	values := make([]byte, count*8)
+
+	if _, err := io.ReadFull(reader, values); err != nil {
+		return nil, errors.New("Bundle is truncated")
+	}
+
+	if n, _ := reader.Read(make([]byte, 1)); n > 0 {
+		return nil, errors.New("Bundle has extra values")
+	}
+
+	for _, t := range tables {
+		// One array for the whole table saves an
+		// allocation for each species
+		floats := make([]float64, len(t.Codes)*len(t.Breaks))
+
+		for i := range floats {
+			floats[i] = math.Float64frombits(
+				binary.LittleEndian.Uint64(values[i*8:]))
+		}
+
+		values = values[len(floats)*8:]
+		t.Values = make(map[string][]float64, len(t.Codes))
+
+		for i, code := range t.Codes {
+			start, end := i*len(t.Breaks), (i+1)*len(t.Breaks)
+			t.Values[code] = floats[start:end:end]
+		}
+
+		t.Codes = nil
+	}
+
+	return bundle, nil
+}
+
+// Check a table and convert it to a datafile
+func (t *BundleTable) datafile(path string, breaksUnit string) (*Datafile, DataErrors) {
+	errs := DataErrors{}
+	addError := func(format string, args ...interface{}) {
+		errs = append(errs, &DataError{path, 0, fmt.Sprintf(format, args...)})
+	}
+
+	if t.BreaksUnit != breaksUnit {
+		addError("Expected breaks in %v, got %v", breaksUnit, t.BreaksUnit)
+	}
+
+	if len(t.Breaks) < 2 {
+		addError("Expected at least 2 breaks, got %v", len(t.Breaks))
+	}
+
+	for i := 1; i < len(t.Breaks); i++ {
+		if t.Breaks[i] <= t.Breaks[i-1] {
+			addError("Break %v doesn't increase", t.Breaks[i])
+		}
+	}
+
+	ragged := make([]string, 0)
+
+	for code, values := range t.Values {
+		if len(values) != len(t.Breaks) {
+			ragged = append(ragged, code)
+		}
+	}
+
+	sort.Strings(ragged)
+
+	for _, code := range ragged {
+		addError("%v has %v values, expected %v",
+			code, len(t.Values[code]), len(t.Breaks))
+	}
+
+	return &Datafile{t.Breaks, t.Values}, errs
+}
+
+// Get the factors of a bundle: every factor that a region
+// has a table for, in the order of the global `Factors`
+// followed by any other factors in alphabetical order
+//
+// Returns a DataErrors if the tables of a factor have
+// different units
+func (b *Bundle) FactorSet() (*FactorSet, error) {
+	units := make(map[string]string)
+	errs := DataErrors{}
+
+	addFactor := func(path string, factor string, t *BundleTable) {
+		unit, found := units[factor]
+
+		if !found {
+			units[factor] = t.Unit
+		} else if t.Unit != unit {
+			errs = append(errs, &DataError{path, 0,
+				fmt.Sprintf("Expected values in %v, got %v", unit, t.Unit)})
+		}
+	}
+
+	for _, code := range sortedKeys(b.Regions) {
+		region := b.Regions[code]
+		path := "regions/" + code
+
+		for _, factor := range sortedKeys(region.Factors) {
+			addFactor(path+"/factors/"+factor, factor, region.Factors[factor])
+		}
+
+		for _, buildingtype := range sortedKeys(region.BuildingTypes) {
+			factors := region.BuildingTypes[buildingtype]
+
+			for _, factor := range sortedKeys(factors) {
+				addFactor(path+"/building_types/"+buildingtype+"/"+factor,
+					factor, factors[factor])
+			}
+		}
+	}
+
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+
+	return orderedFactorSet(units)
+}
+
+// Convert a bundle to the data used by the service, with the
+// factors of the bundle (see Bundle.FactorSet)
+//
+// Returns a DataErrors with a problem for each table that
+// doesn't match its breaks or has the wrong units
+func (b *Bundle) FactorData() (*FactorData, error) {
+	factorset, err := b.FactorSet()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := &FactorData{
+		factorset,
+		make(map[string][]*Datafile),
+		make(map[string]map[string][]*Datafile),
+		make(map[string]*Datafile)}
+
+	errs := DataErrors{}
+
+	table := func(path string, t *BundleTable, factor string, breaksUnit string) *Datafile {
+		if unit, found := FactorUnits[factor]; found && t.Unit != unit {
+			errs = append(errs, &DataError{path, 0,
+				fmt.Sprintf("Expected values in %v, got %v", unit, t.Unit)})
+		}
+
+		datafile, tableErrs := t.datafile(path, breaksUnit)
+		errs = append(errs, tableErrs...)
+
+		return datafile
+	}
+
+	for code, region := range b.Regions {
+		path := "regions/" + code
+		datafiles := make([]*Datafile, factorset.Len())
+
+		for factor, t := range region.Factors {
+			datafiles[factorset.Index(factor)] =
+				table(path+"/factors/"+factor, t, factor, DiameterUnit)
+		}
+
+		data.Regions[code] = datafiles
+
+		for buildingtype, factors := range region.BuildingTypes {
+			variants := make([]*Datafile, factorset.Len())
+			copy(variants, datafiles)
+
+			for factor, t := range factors {
+				variants[factorset.Index(factor)] = table(
+					path+"/building_types/"+buildingtype+"/"+factor,
+					t, factor, DiameterUnit)
+			}
+
+			if data.BuildingTypes[code] == nil {
+				data.BuildingTypes[code] = make(map[string][]*Datafile)
+			}
+
+			data.BuildingTypes[code][buildingtype] = variants
+		}
+
+		if region.Growth != nil {
+			data.Growth[code] = table(path+"/growth", region.Growth, growthFactor, "years")
+		}
+	}
+
+	return data, errs.err()
+}
+
+// Load the factor data in a directory, from the first of
+// BundleFiles that exists or, if there isn't a bundle, from
+// the output__*.csv files
+//
+// The factors are the ones in the bundle, or the ones in the
+// names of the CSV files (see ReadFactorSet)
+//
+// Returns the path of the bundle, or an empty string if the
+// CSV files were used
+func ReadFactorData(basePath string) (*FactorData, string, error) {
+	return ReadFactorDataFS(os.DirFS(basePath), basePath)
+}
+
+// Like ReadFactorData, for the files in fsys. basePath is
+// only used in errors
+func ReadFactorDataFS(fsys fs.FS, basePath string) (*FactorData, string, error) {
+	for _, name := range BundleFiles {
+		path := filepath.Join(basePath, name)
+		file, err := fsys.Open(name)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		defer file.Close()
+
+		bundle, err := ReadBundle(file)
+
+		if err != nil {
+			return nil, "", errors.New(fmt.Sprintf("%v: %v", path, err))
+		}
+
+		data, err := bundle.FactorData()
+
+		return data, path, err
+	}
+
+	names, err := listDataFiles(fsys, basePath)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	factors, err := dataFactorSet(names)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	regiondata, err := readDataFiles(fsys, basePath, factors)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	buildingdata, err := readBuildingTypeFiles(fsys, basePath, factors, regiondata)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	growthdata, err := readGrowthFiles(fsys, basePath)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &FactorData{factors,
+		regiondata, buildingdata, growthdata}, "", nil
+}
+
+// Replace the data of each region in other, factor by factor
+//
+// A region in other only replaces the factors it has data for,
+// and keeps d's data for the rest. A region's building type data
+// for the replaced factors is dropped, since it falls back to
+// them, unless other has building type data for them too. Growth
+// data is replaced separately, so a region can keep its growth
+// data when only its factors are replaced
+//
+// If other has factors that d doesn't, d's factors become the
+// union of both (see FactorSet.Union) and the regions without
+// data for a factor have nil datafiles for it
+func (d *FactorData) Override(other *FactorData) error {
+	factors := d.Factors
+
+	if !factors.Equal(other.Factors) {
+		var err error
+		factors, err = d.Factors.Union(other.Factors)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	reindex := func(from *FactorSet, datafiles []*Datafile) []*Datafile {
+		if from.Equal(factors) {
+			return datafiles
+		}
+
+		return from.reindex(datafiles, factors)
+	}
+
+	for _, data := range []*FactorData{d, other} {
+		for region, datafiles := range data.Regions {
+			data.Regions[region] = reindex(data.Factors, datafiles)
+		}
+
+		for _, buildingtypes := range data.BuildingTypes {
+			for buildingtype, datafiles := range buildingtypes {
+				buildingtypes[buildingtype] = reindex(data.Factors, datafiles)
+			}
+		}
+	}
+
+	d.Factors = factors
+	other.Factors = factors
+
+	for region, datafiles := range other.Regions {
+		for buildingtype, btdatafiles := range d.BuildingTypes[region] {
+			if !dropDatafiles(btdatafiles, datafiles) {
+				delete(d.BuildingTypes[region], buildingtype)
+			}
+		}
+
+		if len(d.BuildingTypes[region]) == 0 {
+			delete(d.BuildingTypes, region)
+		}
+
+		d.Regions[region] = mergeDatafiles(d.Regions[region], datafiles)
+	}
+
+	for region, buildingtypes := range other.BuildingTypes {
+		if d.BuildingTypes[region] == nil {
+			d.BuildingTypes[region] = make(map[string][]*Datafile)
+		}
+
+		for buildingtype, datafiles := range buildingtypes {
+			d.BuildingTypes[region][buildingtype] = mergeDatafiles(
+				d.BuildingTypes[region][buildingtype], datafiles)
+		}
+	}
+
+	for region, growth := range other.Growth {
+		d.Growth[region] = growth
+	}
+
+	return nil
+}
+
+// Check if a region has data for a factor. A nil
+// FactorData doesn't have any data
+func (d *FactorData) hasFactor(region string, factor string) bool {
+	if d == nil {
+		return false
+	}
+
+	fidx := d.Factors.Index(factor)
+
+	return fidx >= 0 && d.Regions[region] != nil &&
+		d.Regions[region][fidx] != nil
+}
+
+// Merge the datafiles of a region, indexed by the same
+// factors, taking each factor from override if it has it
+func mergeDatafiles(datafiles []*Datafile, override []*Datafile) []*Datafile {
+	if datafiles == nil {
+		return override
+	}
+
+	merged := make([]*Datafile, len(datafiles))
+
+	for i, datafile := range datafiles {
+		merged[i] = datafile
+
+		if override[i] != nil {
+			merged[i] = override[i]
+		}
+	}
+
+	return merged
+}
+
+// Clear the datafiles of the factors that override has.
+// Returns false if none are left
+func dropDatafiles(datafiles []*Datafile, override []*Datafile) bool {
+	left := false
+
+	for i := range datafiles {
+		if override[i] != nil {
+			datafiles[i] = nil
+		}
+
+		if datafiles[i] != nil {
+			left = true
+		}
+	}
+
+	return left
+}
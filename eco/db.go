@@ -13,7 +13,44 @@ type DBInfo struct {
 	Database string
 }
 
-type DBRow sql.Rows
+// A database rowset
+//
+// The first columns of the rowset are positional (see the
+// Fetchable interface). Any additional columns are optional
+// and can be read by name with GetColumn
+type DBRow struct {
+	rows *sql.Rows
+
+	// Names and values of the optional columns
+	extraNames  []string
+	extraValues []sql.NullString
+}
+
+// Scan the positional columns of the current record
+// into dest and the remaining columns into extraValues
+func (dbr *DBRow) scan(dest ...interface{}) error {
+	if dbr.extraNames == nil {
+		columns, err := dbr.rows.Columns()
+
+		if err != nil {
+			return err
+		}
+
+		if len(columns) < len(dest) {
+			return fmt.Errorf("Expected at least %v columns, got %v",
+				len(dest), len(columns))
+		}
+
+		dbr.extraNames = columns[len(dest):]
+		dbr.extraValues = make([]sql.NullString, len(dbr.extraNames))
+	}
+
+	for i := range dbr.extraValues {
+		dest = append(dest, &dbr.extraValues[i])
+	}
+
+	return dbr.rows.Scan(dest...)
+}
 
 func (dbr *DBRow) GetDataWithRegion(
 	diameter *float64,
@@ -22,11 +59,11 @@ func (dbr *DBRow) GetDataWithRegion(
 	x *float64,
 	y *float64) error {
 
-	err := (*sql.Rows)(dbr).Scan(diameter, speciesid, otmcode, x, y)
+	var dbh sql.NullFloat64
+	err := dbr.scan(&dbh, speciesid, otmcode, x, y)
 
-	if err == nil {
-		*diameter *= CentimetersPerInch
-	}
+	// Trees without a diameter have a diameter of zero
+	*diameter = dbh.Float64 * CentimetersPerInch
 
 	return err
 }
@@ -34,21 +71,35 @@ func (dbr *DBRow) GetDataWithRegion(
 func (dbr *DBRow) GetDataWithoutRegion(
 	diameter *float64, otmcode *string, speciesid *int) error {
 
-	err := (*sql.Rows)(dbr).Scan(diameter, speciesid, otmcode)
+	var dbh sql.NullFloat64
+	err := dbr.scan(&dbh, speciesid, otmcode)
 
-	if err == nil {
-		*diameter *= CentimetersPerInch
-	}
+	*diameter = dbh.Float64 * CentimetersPerInch
 
 	return err
 }
 
+func (dbr *DBRow) GetColumn(name string) (string, bool) {
+	for i, extraName := range dbr.extraNames {
+		if extraName == name {
+			value := dbr.extraValues[i]
+			return value.String, value.Valid
+		}
+	}
+
+	return "", false
+}
+
+func (dbr *DBRow) HasColumn(name string) bool {
+	return indexOf(name, dbr.extraNames) >= 0
+}
+
 func (dbr *DBRow) Close() error {
-	return (*sql.Rows)(dbr).Close()
+	return dbr.rows.Close()
 }
 
 func (dbr *DBRow) Next() bool {
-	return (*sql.Rows)(dbr).Next()
+	return dbr.rows.Next()
 }
 
 type DBContext sql.DB
@@ -60,11 +111,13 @@ func OpenDatabaseConnection(info *DBInfo) (*sql.DB, error) {
 	return sql.Open("postgres", cxnString)
 }
 
+// Get the region geometries, in RegionSRID
 func (dbc *DBContext) GetRegionGeoms() (map[int]Region, error) {
 	db := (*sql.DB)(dbc)
 
-	rows, err :=
-		db.Query("select id, code, ST_AsText(geometry) from treemap_itreeregion")
+	rows, err := db.Query(`select id, code,
+		  ST_AsText(ST_Transform(geometry, $1))
+		  from treemap_itreeregion`, RegionSRID)
 
 	if err != nil {
 		return nil, err
@@ -126,14 +179,44 @@ func (dbc *DBContext) GetRegionsForInstance(
 	return intersectingRegions, nil
 }
 
-func (dbc *DBContext) ExecSql(query string) (Fetchable, error) {
+// Get the bounds of an instance, in RegionSRID
+//
+// The caller is responsible for destroying the returned
+// geometry with "GeosDestroy"
+func (dbc *DBContext) GetInstanceBounds(instance int) (Geom, error) {
+	db := (*sql.DB)(dbc)
+
+	wkt := ""
+
+	err := db.QueryRow(`select ST_AsText(ST_Transform(
+		    treemap_instancebounds.geom, $1))
+		  from treemap_instance
+		    inner join treemap_instancebounds
+		      on treemap_instancebounds.id = treemap_instance.bounds_id
+		  where treemap_instance.id = $2`, RegionSRID, instance).Scan(&wkt)
+
+	if err != nil {
+		return Geom{}, err
+	}
+
+	return ParseGeosGeom(wkt)
+}
+
+// Run a query for trees. Args are the values of the
+// query's parameters, if it has any (see TreeFilter). Only
+// the query is printed, since the args come from the request
+func (dbc *DBContext) ExecSql(query string, args ...interface{}) (Fetchable, error) {
 	db := (*sql.DB)(dbc)
 
 	fmt.Println(query)
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
 
-	return (*DBRow)(rows), err
+	return &DBRow{rows: rows}, nil
 }
 
 func (dbc *DBContext) GetOverrideMap() (map[int]map[string]map[int]string, error) {
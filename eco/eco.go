@@ -13,8 +13,9 @@ type DataBackend interface {
 	GetRegionsForInstance(
 		regions map[int]Region, instance int) ([]Region, error)
 
-	// Get a fetchable with the given sql string
-	ExecSql(string) (Fetchable, error)
+	// Get a fetchable with the given sql string and
+	// parameter values
+	ExecSql(string, ...interface{}) (Fetchable, error)
 
 	// Get a map for all of the overrides on the database
 	// The map should end up looking something like:
@@ -48,13 +49,131 @@ type Fetchable interface {
 	// Closes this fetchable
 	Close() error
 
+	// Get the value of an optional named column (such as
+	// BuildingTypeColumn) on the current record. The second
+	// return value is false if the column wasn't selected
+	// or is null
+	GetColumn(name string) (string, bool)
+
+	// Determine if an optional named column was selected.
+	// This is only known once a record has been read
+	HasColumn(name string) bool
+
 	// Move to the next item in the internal iterator
 	// returns false if there are no more records
 	Next() bool
 }
 
+// Optional column that sets the building type for
+// a single tree. It overrides the building type passed
+// to CalcBenefitsWithData
+const BuildingTypeColumn = "building_type"
+
+// Optional column that identifies a tree in the
+// results passed to a TreeFunc
+const IdColumn = "id"
+
+// The result of calculating the benefits of a single
+// row in CalcBenefitsWithData
+type TreeResult struct {
+	Otmcode   string
+	SpeciesId int
+
+	// The diameter will be in centimeters
+	Diameter float64
+
+	// The region the tree was calculated in. This will be
+	// empty if no region contains the tree
+	Region string
+
+	// The resolved i-Tree code. This will be empty if
+	// the tree's species isn't available in its region
+	ITreeCode string
+
+	// The benefits of the tree, indexed by the factors of
+	// the calculation (see CalcBenefitsWithData).
+	// This is nil for trees that were skipped (because
+	// they don't have an i-Tree code, a diameter or a
+	// known building type) and is
+	// only valid for the duration of the call
+	Factors []float64
+}
+
+// The number of otmcodes kept in Diagnostics.UnknownOtmcodes
+const MaxDiagnosticOtmcodes = 20
+
+// Counts of the trees that CalcBenefitsWithData skipped, or
+// calculated with data that doesn't cover them. Each skipped
+// tree is counted once, for the first reason it was skipped
+type Diagnostics struct {
+	// Trees that aren't in any of the regions
+	OutsideRegions int
+
+	// Trees whose species doesn't have an i-Tree code,
+	// by region
+	UnknownSpecies map[string]int
+
+	// Trees without a diameter (or with a diameter of
+	// zero or less). These are calculated with their
+	// diameter as it is, like any other tree
+	MissingDiameter int
+
+	// Trees with a diameter at or above the largest break in
+	// their factor data. These are calculated but their values
+	// come from the last segment of the data
+	AboveMaxDiameter int
+
+	// A sample of the distinct otmcodes of the trees with
+	// unknown species (up to MaxDiagnosticOtmcodes)
+	UnknownOtmcodes []string
+
+	// Trees with a BuildingTypeColumn that isn't one of
+	// the BuildingTypes
+	UnknownBuildingType int
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{
+		UnknownSpecies:  make(map[string]int),
+		UnknownOtmcodes: make([]string, 0)}
+}
+
+func (d *Diagnostics) addUnknownSpecies(region string, otmcode string) {
+	d.UnknownSpecies[region] += 1
+
+	if len(d.UnknownOtmcodes) < MaxDiagnosticOtmcodes &&
+		indexOf(otmcode, d.UnknownOtmcodes) < 0 {
+
+		d.UnknownOtmcodes = append(d.UnknownOtmcodes, otmcode)
+	}
+}
+
+// Get the largest diameter in the factor data for a
+// species. Returns zero if there isn't any data
+func maxDiameter(factorData []*Datafile, itreecode string) float64 {
+	for _, data := range factorData {
+		if data != nil && len(data.Values[itreecode]) > 0 {
+			return data.Breaks[len(data.Breaks)-1]
+		}
+	}
+
+	return 0.0
+}
+
+// Called by CalcBenefitsWithData for every row, after the row's
+// benefits have been added to the totals. Rows is positioned
+// at the current tree, so optional columns (such as IdColumn)
+// can be read with GetColumn
+//
+// Returning an error stops the calculation
+type TreeFunc func(rows Fetchable, tree *TreeResult) error
+
 // Calculate ecobenefits over an instance in the given backend
 //
+// Factors are the factors to calculate. They must be the set
+// the factor data and prices were loaded with or a subset of it
+// (see FactorSet.Subset). The results only have these factors
+//
 // Regions are a list of intersecting regions the check. This can
 // be nil or empty only if the "region" parameter is specified
 //
@@ -62,8 +181,19 @@ type Fetchable interface {
 // if this parameter is passed in the regions array will be
 // ignored
 //
+// Buildingtype selects the building type specific energy and
+// avoided emission factors for every tree. This can be empty
+// to use the blended factors. Trees can also set their own
+// building type with the BuildingTypeColumn column. Trees with
+// a building type that isn't one of the BuildingTypes are
+// skipped, like trees without an i-Tree code
+//
 // Rows is the fetchable set to use
 //
+// Srid is the SRID of the points in rows. Points are checked
+// and reprojected to RegionSRID (see ToRegionSRID) when they
+// are used to find their region
+//
 // speciesdata is a map to itreecode:
 // region --> otmcode --> itreecode
 //
@@ -78,29 +208,82 @@ type Fetchable interface {
 // That allows itree overrides on a per-species/instance level
 //
 // Note that the ith element of the datafiles slice is
-// the ith factor from eco.Factors
+// the ith factor of the set the data was loaded with
+//
+// buildingdata maps regions to building types to factor lists
+// (see LoadBuildingTypeFiles)
+//
+// Prices maps regions to the price of each factor, indexed
+// the same way as the datafiles (see LoadPrices). Regions
+// without prices will have a dollar value of zero
+//
+// onTree is optional. If it isn't nil it is called with the
+// result of each row (see TreeFunc)
 //
+// Diagnostics is optional. If it isn't nil the trees that
+// were skipped are counted in it, as are trees without a
+// diameter, which are calculated with a diameter of zero
+//
+// Returns the factor totals and the dollar value of those
+// totals
 func CalcBenefitsWithData(
+	factors *FactorSet,
 	regions []Region,
 	rows Fetchable,
+	srid int,
 	region string,
+	buildingtype string,
 	speciesdata map[string]map[string]string,
 	regiondata map[string][]*Datafile,
-	overrides map[string]map[int]string) (map[string]float64, error) {
+	buildingdata map[string]map[string][]*Datafile,
+	overrides map[string]map[int]string,
+	prices map[string][]float64,
+	onTree TreeFunc,
+	diagnostics *Diagnostics) (map[string]float64, map[string]float64, error) {
 
 	useFixedRegion := len(region) > 0
-	factorsum := make([]float64, len(Factors))
 	ntrees := 0
 
+	// Benefits of the current tree, only used when
+	// results are passed to onTree
+	var tree *TreeResult
+	var treeFactors []float64
+
+	if onTree != nil {
+		tree = &TreeResult{}
+		treeFactors = make([]float64, factors.Len())
+	}
+
+	// Factors are summed per region since each region
+	// values its factors with its own prices
+	regionsums := make(map[string][]float64)
+	var factorsum []float64
+
 	diameter := 0.0
 	otmcode := ""
 	speciesid := 0
 	x := 0.0
 	y := 0.0
 
-	// Last index of found polygon
-	lastidx := 0
-	regionlen := len(regions)
+	// Index of the last region found
+	lastidx := -1
+
+	var index *RegionIndex
+
+	// Every point is created and tested with one context
+	var geomctx *GeomContext
+
+	if !useFixedRegion {
+		var err error
+		index, err = NewRegionIndex(regions)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		geomctx = NewGeomContext()
+		defer geomctx.Close()
+	}
 
 	var speciesDataForRegion map[string]string
 	var factorDataForRegion []*Datafile
@@ -113,6 +296,9 @@ func CalcBenefitsWithData(
 		if overrides != nil {
 			overridesForRegion = overrides[region]
 		}
+
+		factorsum = make([]float64, factors.Len())
+		regionsums[region] = factorsum
 	}
 
 	itreecode := ""
@@ -128,28 +314,25 @@ func CalcBenefitsWithData(
 
 			region = ""
 
-			pt := CreateGeosPtWithXY(x, y)
-			defer DestroyPt(pt)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			x, y, err = ToRegionSRID(x, y, srid)
 
-			for i := 0; i < regionlen; i += 1 {
-				// consecutive trees have a high spatial
-				// correlation so try the last successful
-				// polygon first
-				calcidx := (i + lastidx) % regionlen
-				regiongeom := regions[calcidx]
+			if err != nil {
+				return nil, nil, err
+			}
 
-				intersects, err := Intersects(
-					regiongeom.geom, pt)
+			regionidx, err := index.regionForPoint(geomctx, x, y, lastidx)
 
-				if err != nil {
-					return nil, err
-				}
+			if err != nil {
+				return nil, nil, err
+			}
 
-				if intersects {
-					lastidx = calcidx
-					region = regiongeom.Code
-					break
-				}
+			if regionidx >= 0 {
+				lastidx = regionidx
+				region = regions[regionidx].Code
 			}
 
 			speciesDataForRegion = speciesdata[region]
@@ -161,7 +344,7 @@ func CalcBenefitsWithData(
 		}
 
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		itreecode = speciesDataForRegion[otmcode]
@@ -174,48 +357,204 @@ func CalcBenefitsWithData(
 			}
 		}
 
-		if itreecode != "" {
-			CalcOneTree(
-				factorDataForRegion,
-				itreecode,
-				diameter,
-				factorsum)
+		treeBuildingType := buildingtype
+
+		if column, found := rows.GetColumn(BuildingTypeColumn); found {
+			treeBuildingType = column
+		}
+
+		knownBuildingType := treeBuildingType == "" ||
+			IsBuildingType(treeBuildingType)
+
+		calculate := itreecode != "" && knownBuildingType
+
+		if diagnostics != nil {
+			if !useFixedRegion && region == "" {
+				diagnostics.OutsideRegions += 1
+			} else if itreecode == "" {
+				diagnostics.addUnknownSpecies(region, otmcode)
+			} else if !knownBuildingType {
+				diagnostics.UnknownBuildingType += 1
+			}
+		}
+
+		if calculate {
+			if !useFixedRegion {
+				factorsum = regionsums[region]
+
+				if factorsum == nil {
+					factorsum = make([]float64, factors.Len())
+					regionsums[region] = factorsum
+				}
+			}
+
+			factorDataForTree := factorDataForRegion
+
+			if treeBuildingType != "" {
+				factorDataForTree = FactorDataForBuildingType(
+					regiondata, buildingdata, region, treeBuildingType)
+			}
+
+			if diagnostics != nil {
+				if diameter <= 0 {
+					diagnostics.MissingDiameter += 1
+				}
+
+				maxdiameter := maxDiameter(factorDataForTree, itreecode)
+
+				if maxdiameter > 0 && diameter >= maxdiameter {
+					diagnostics.AboveMaxDiameter += 1
+				}
+			}
+
+			if onTree == nil {
+				CalcOneTree(
+					factors,
+					factorDataForTree,
+					itreecode,
+					diameter,
+					factorsum)
+			} else {
+				for i := range treeFactors {
+					treeFactors[i] = 0
+				}
+
+				CalcOneTree(
+					factors,
+					factorDataForTree,
+					itreecode,
+					diameter,
+					treeFactors)
+
+				for i, value := range treeFactors {
+					factorsum[i] += value
+				}
+			}
 
 			ntrees += 1
 		}
+
+		if onTree != nil {
+			*tree = TreeResult{otmcode, speciesid, diameter,
+				region, itreecode, nil}
+
+			if calculate {
+				tree.Factors = treeFactors
+			}
+
+			if err = onTree(rows, tree); err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 
-	factormap := FactorArrayToMap(factorsum)
+	factortotals := make([]float64, factors.Len())
+	dollartotals := make([]float64, factors.Len())
+
+	for region, factorsum := range regionsums {
+		for i, value := range factorsum {
+			factortotals[i] += value
+		}
+
+		factors.CalcDollars(prices[region], factorsum, dollartotals)
+	}
+
+	factormap := factors.ArrayToMap(factortotals)
 	factormap["n_trees"] = float64(ntrees)
 
-	return factormap, nil
+	return factormap, factors.DollarArrayToMap(dollartotals), nil
 }
 
-// Convert an array of factors into a map by
-// matching up their indicies
-func FactorArrayToMap(factors []float64) map[string]float64 {
-	factormap := make(map[string]float64)
-	for i, factor := range Factors {
-		factormap[factor] = factors[i]
+// Determine if the given string is one of
+// the known BuildingTypes
+func IsBuildingType(buildingtype string) bool {
+	return indexOf(buildingtype, BuildingTypes) >= 0
+}
+
+// Get the factor data for a region and building type
+//
+// Falls back to the blended factor data (from regiondata)
+// when the building type is empty or unknown or when the
+// region doesn't have building type specific data
+func FactorDataForBuildingType(
+	regiondata map[string][]*Datafile,
+	buildingdata map[string]map[string][]*Datafile,
+	region string,
+	buildingtype string) []*Datafile {
+
+	if datafiles, found := buildingdata[region][buildingtype]; found {
+		return datafiles
 	}
 
-	return factormap
+	return regiondata[region]
+}
+
+// Get the regions that intersect the given geometry
+func RegionsIntersecting(regions []Region, geom Geom) ([]Region, error) {
+	intersecting := make([]Region, 0)
+
+	for _, region := range regions {
+		intersects, err := IntersectsGeom(region.geom, geom)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if intersects {
+			intersecting = append(intersecting, region)
+		}
+	}
+
+	return intersecting, nil
+}
+
+// Convert an array of DefaultFactors into a map by
+// matching up their indicies (see FactorSet.ArrayToMap)
+func FactorArrayToMap(factors []float64) map[string]float64 {
+	return DefaultFactors.ArrayToMap(factors)
+}
+
+// Convert an array of DefaultFactors dollar values into a
+// map with a "total" (see FactorSet.DollarArrayToMap)
+func DollarArrayToMap(dollars []float64) map[string]float64 {
+	return DefaultFactors.DollarArrayToMap(dollars)
+}
+
+// Calculate the dollar value of a set of DefaultFactors
+// (see FactorSet.CalcDollars)
+func CalcDollars(
+	prices []float64,
+	factors []float64,
+	dollarsum []float64) {
+
+	DefaultFactors.CalcDollars(prices, factors, dollarsum)
 }
 
 // Calculate benefits for a single tree
 //
 // The diameter must be in centimeters
 //
-// The benefits will be added to the factorsum slice
+// Factors are the factors to calculate. factorDataForRegion
+// must have been loaded with the same set, or the set factors
+// is a subset of. Factors without data for the region are
+// skipped
+//
+// The benefits will be added to the factorsum slice, which
+// is indexed by factors
 func CalcOneTree(
+	factors *FactorSet,
 	factorDataForRegion []*Datafile,
 	itreecode string,
 	diameter float64,
 	factorsum []float64) {
-	nfactors := len(factorsum)
+	nfactors := factors.Len()
 
 	for fidx := 0; fidx < nfactors; fidx++ {
-		data := factorDataForRegion[fidx]
+		data := factors.datafile(factorDataForRegion, fidx)
+
+		if data == nil {
+			continue
+		}
 
 		// This is the slowest part of this function (the
 		// has lookup in the map). If we could make this
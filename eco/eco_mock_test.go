@@ -10,6 +10,7 @@ type TestRecord struct {
 	x         float64
 	y         float64
 	speciesid int
+	columns   map[string]string
 }
 
 type regioninfo struct {
@@ -77,6 +78,18 @@ func (t *TestingContext) GetDataWithoutRegion(
 	return nil
 }
 
+func (t *TestingContext) GetColumn(name string) (string, bool) {
+	value, found := t.data[t.activeIndex].columns[name]
+
+	return value, found
+}
+
+func (t *TestingContext) HasColumn(name string) bool {
+	_, found := t.data[t.activeIndex].columns[name]
+
+	return found
+}
+
 func (t *TestingContext) Close() error {
 	return nil
 }
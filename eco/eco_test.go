@@ -1,9 +1,20 @@
 package eco
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 )
 
 // Data sanity checks
@@ -90,12 +101,29 @@ func TestGetITreeCodesByRegion(t *testing.T) {
 		t.Fatalf("Missing region %v", region)
 	}
 
+	found = false
 	for _, code := range codes {
 		if code == myCode {
-			return
+			found = true
 		}
 	}
-	t.Fatalf("Missing code %v", myCode)
+
+	if !found {
+		t.Fatalf("Missing code %v", myCode)
+	}
+
+	// Regions without data for the first factor use the next
+	// one, and regions without any data are left out
+	datafile := &Datafile{[]float64{1, 2},
+		map[string][]float64{"ACRU": []float64{1, 2}}}
+
+	codesByRegion = GetITreeCodesByRegion(map[string][]*Datafile{
+		"Partial": []*Datafile{nil, datafile},
+		"Empty":   []*Datafile{nil, nil}})
+
+	if len(codesByRegion) != 1 || len(codesByRegion["Partial"]) != 1 {
+		t.Fatalf("Unexpected codes %v", codesByRegion)
+	}
 }
 
 func TestSimpleInter(t *testing.T) {
@@ -106,10 +134,12 @@ func TestSimpleInter(t *testing.T) {
 
 	datafile := &Datafile{breaks, map[string][]float64{itreecode: values}}
 	datafiles := []*Datafile{datafile}
+	factors, _ := NewFactorSet([]string{"test"}, nil)
 
 	result := []float64{0.0}
 
 	CalcOneTree(
+		factors,
 		datafiles,
 		itreecode,
 		2.0,
@@ -120,117 +150,2063 @@ func TestSimpleInter(t *testing.T) {
 	}
 }
 
-// Since there isn't really a canonical benefits
-// library to test against, we're just going to
-// use a couple of exsiting OTM instances
-//
-// These test are pretty data dependent but the
-// whole purpose of the library is to provide access to
-// that data
-func TestSpecificTreeData(t *testing.T) {
-	region := "LoMidWXXX"
-	otmcode := "ULAM"
-	dbh := 11.0
+func TestPricesArePresent(t *testing.T) {
+	m, _ := LoadSpeciesMap("../data/species.json")
+	prices, err := LoadPrices("../data/prices.json")
 
-	targets := map[string]float64{
-		"aq_nox_avoided":     0.01548490,
-		"aq_nox_dep":         0.00771784,
-		"aq_pm10_avoided":    0.00546863,
-		"aq_pm10_dep":        0.016322,
-		"aq_sox_avoided":     0.06590,
-		"aq_sox_dep":         0.0057742,
-		"aq_voc_avoided":     0.0054686,
-		"bvoc":               0,
-		"co2_avoided":        12.0864829,
-		"co2_sequestered":    51.42926,
-		"co2_storage":        110.79107,
-		"electricity":        12.180839,
-		"hydro_interception": 2.5919028,
-		"natural_gas":        -18.345013}
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	l := LoadFiles("../data/")
-	m, _ := LoadSpeciesMap("../data/species.json")
+	for region := range m {
+		regionprices, found := prices[region]
 
-	itreecode := m[region][otmcode]
-	factorDataForRegion := l[region]
+		if !found {
+			t.Fatalf("Missing prices for region %v", region)
+		}
 
-	factorsum := make([]float64, len(Factors))
+		if len(regionprices) != len(Factors) {
+			t.Fatalf("Expected %v prices for region %v, got %v",
+				len(Factors), region, len(regionprices))
+		}
+	}
+}
 
-	CalcOneTree(
-		factorDataForRegion,
-		itreecode,
-		dbh,
-		factorsum)
+func TestDollars(t *testing.T) {
+	prices := []float64{2.0, 0.0, 0.5}
+	factors := []float64{3.0, 10.0, -4.0}
 
-	factormap := FactorArrayToMap(factorsum)
+	dollars := []float64{1.0, 0.0, 0.0}
 
-	for factor, target := range targets {
-		calcd := factormap[factor]
+	CalcDollars(prices, factors, dollars)
 
-		if int(calcd*100000) != int(target*100000) {
+	expected := []float64{7.0, 0.0, -2.0}
+
+	for i, target := range expected {
+		if dollars[i] != target {
 			t.Fatalf("Expected %v, got %v for factor %v",
-				target, calcd, factor)
+				target, dollars[i], i)
 		}
 	}
+
+	// Missing prices are worth nothing
+	CalcDollars(nil, factors, dollars)
+
+	if dollars[0] != 7.0 {
+		t.Fatalf("Expected %v, got %v", 7.0, dollars[0])
+	}
+
+	dollarmap := DollarArrayToMap(make([]float64, len(Factors)))
+
+	if _, found := dollarmap["total"]; !found {
+		t.Fatal("Missing total in dollar map")
+	}
+
+	// Stored CO2 isn't a yearly benefit, so it's
+	// left out of the total
+	dollars = make([]float64, len(Factors))
+	dollars[FactorIndex("electricity")] = 2
+	dollars[FactorIndex("co2_storage")] = 5
+
+	dollarmap = DollarArrayToMap(dollars)
+
+	if dollarmap["total"] != 2 || dollarmap["co2_storage"] != 5 {
+		t.Fatalf("Expected a total of 2 and co2_storage of 5, got %v",
+			dollarmap)
+	}
 }
 
-func generateSpeciesListFromRegion(
-	speciesdata map[string]map[string]string,
-	targetLength int, region Region) []*TestRecord {
+func TestUnits(t *testing.T) {
+	for _, factor := range Factors {
+		if _, found := Units[FactorUnits[factor]]; !found {
+			t.Fatalf("Missing the unit of %v", factor)
+		}
+	}
 
-	speciesmap := speciesdata[region.Code]
+	system, err := ParseUnitSystem("")
 
-	possibleSpecies := make([]string, len(speciesmap))
-	i := 0
-	for k, _ := range speciesmap {
-		possibleSpecies[i] = k
-		i++
+	if err != nil || system != DataUnits {
+		t.Fatalf("Expected the data units by default, got %v %v", system, err)
 	}
 
-	idx := rand.Perm(targetLength)
+	if _, err = ParseUnitSystem("furlongs"); err == nil {
+		t.Fatal("Expected an error for an unknown unit system")
+	}
 
-	data := make([]*TestRecord, targetLength)
+	factors := make([]float64, len(Factors))
+	factors[FactorIndex("co2_storage")] = 10
+	factors[FactorIndex("hydro_interception")] = 2
+	factors[FactorIndex("electricity")] = 3
 
-	i = 0
-	for sidx := range idx {
-		x, y := GetXYOnSurface(region.geom)
-		otmcode := possibleSpecies[sidx%len(possibleSpecies)]
-		diameter := rand.Float64() * 100.0
-		data[i] = &TestRecord{otmcode, diameter, x, y, sidx}
-		i++
+	factormap := FactorArrayToMap(factors)
+	factormap["total"] = 1
+	ImperialUnits.ConvertFactorMap(DefaultFactors, factormap)
+
+	units := ImperialUnits.FactorUnits(DefaultFactors)
+
+	for factor, expected := range map[string]float64{
+		"co2_storage": 22.0462262, "hydro_interception": 528.344104,
+		"electricity": 3, "total": 1} {
+
+		if math.Abs(factormap[factor]-expected) > 1e-6 {
+			t.Fatalf("Expected %v %v of %v, got %v",
+				expected, units[factor], factor, factormap[factor])
+		}
 	}
 
-	return data
+	if units["co2_storage"] != "lbs" || units["electricity"] != "kWh" ||
+		MetricUnits.FactorUnits(DefaultFactors)["co2_storage"] != "kg" {
+
+		t.Fatalf("Unexpected units %v", units)
+	}
+
+	// Natural gas is in kBtu, which is neither system's unit
+	for system, expected := range map[UnitSystem]struct {
+		unit  string
+		value float64
+	}{DataUnits: {"kBtu", 1000}, MetricUnits: {"kWh", 293.07107},
+		ImperialUnits: {"therms", 10}} {
+
+		factors := make([]float64, len(Factors))
+		factors[FactorIndex("natural_gas")] = 1000
+		factors[FactorIndex("co2_storage")] = 10
+
+		factormap := FactorArrayToMap(factors)
+		system.ConvertFactorMap(DefaultFactors, factormap)
+
+		unit := system.FactorUnits(DefaultFactors)["natural_gas"]
+
+		if unit != expected.unit ||
+			math.Abs(factormap["natural_gas"]-expected.value) > 1e-6 {
+
+			t.Fatalf("Expected %v %v of natural_gas, got %v %v",
+				expected.value, expected.unit, factormap["natural_gas"], unit)
+		}
+	}
+
+	// Metric units of the data files are unchanged
+	factormap = FactorArrayToMap(factors)
+	MetricUnits.ConvertFactorMap(DefaultFactors, factormap)
+
+	if factormap["co2_storage"] != 10 || factormap["hydro_interception"] != 2 {
+		t.Fatalf("Expected metric benefits to be unchanged, got %v", factormap)
+	}
+
+	for unit, expected := range map[string]float64{"cm": 1, "in": 2.54} {
+		scale, err := DiameterScale(unit)
+
+		if err != nil || scale != expected {
+			t.Fatalf("Expected %v cm in 1 %v, got %v %v",
+				expected, unit, scale, err)
+		}
+	}
+
+	if _, err = DiameterScale("ft"); err == nil {
+		t.Fatal("Expected an error for an unknown diameter unit")
+	}
 }
 
-func benchmarkTreesSingleRegion(targetLength int, b *testing.B) {
-	info := regionInfos[0]
+func TestFactorSet(t *testing.T) {
+	if _, err := NewFactorSet([]string{"cpa", "cpa"}, nil); err == nil {
+		t.Fatal("Expected an error for a duplicate factor")
+	}
 
-	benchmarkTreesMultiRegion([]regioninfo{info},
-		targetLength, b)
+	subset, err := DefaultFactors.Subset([]string{"lsa", "electricity"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subsets keep the order of the set
+	if !reflect.DeepEqual(subset.Names(), []string{"electricity", "lsa"}) ||
+		subset.Unit("electricity") != "kWh" {
+
+		t.Fatalf("Unexpected subset %v", subset.Names())
+	}
+
+	for _, names := range [][]string{{"bogus"}, {"cpa", "cpa"}} {
+		if _, err = DefaultFactors.Subset(names); err == nil {
+			t.Fatalf("Expected an error for the subset %v", names)
+		}
+	}
+
+	l := LoadFiles("../data/")
+	prices, _ := LoadPrices("../data/prices.json")
+	region := "NoEastXXX"
+	itreecode := "ACRU"
+
+	all := make([]float64, DefaultFactors.Len())
+	CalcOneTree(DefaultFactors, l[region], itreecode, 30, all)
+
+	some := make([]float64, subset.Len())
+	CalcOneTree(subset, l[region], itreecode, 30, some)
+
+	for i, factor := range subset.Names() {
+		if some[i] == 0 || some[i] != all[FactorIndex(factor)] {
+			t.Fatalf("Expected %v for %v, got %v",
+				all[FactorIndex(factor)], factor, some[i])
+		}
+	}
+
+	dollars := make([]float64, subset.Len())
+	subset.CalcDollars(prices[region], some, dollars)
+	dollarmap := subset.DollarArrayToMap(dollars)
+
+	expected := some[0] * prices[region][FactorIndex("electricity")]
+
+	if len(dollarmap) != 3 || dollarmap["electricity"] != expected {
+		t.Fatalf("Expected %v for electricity, got %v", expected, dollarmap)
+	}
+
+	// Data for a different set of factors can't be used
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a panic for mismatched factor data")
+		}
+	}()
+
+	CalcOneTree(subset, l[region][:5], itreecode, 30, some)
 }
 
-func benchmarkTreesMultiRegion(
-	regions []regioninfo, targetLength int, b *testing.B) {
+func TestBuildingTypeFiles(t *testing.T) {
+	l := LoadFiles("../data/")
+	b := LoadBuildingTypeFiles("../data/", l)
 
-	benchmarkTreesMultiRegionWithOverrides(nil, regions, targetLength, b)
+	electricity := indexOf("electricity", Factors)
+	noxAvoided := indexOf("aq_nox_avoided", Factors)
+	hydro := indexOf("hydro_interception", Factors)
+
+	for _, buildingtype := range BuildingTypes {
+		datafiles := FactorDataForBuildingType(l, b, "NoEastXXX", buildingtype)
+
+		if datafiles[electricity] == l["NoEastXXX"][electricity] {
+			t.Fatalf("Expected %v electricity data for NoEastXXX",
+				buildingtype)
+		}
+
+		if datafiles[noxAvoided] == l["NoEastXXX"][noxAvoided] {
+			t.Fatalf("Expected %v nox avoided data for NoEastXXX",
+				buildingtype)
+		}
+
+		if datafiles[hydro] != l["NoEastXXX"][hydro] {
+			t.Fatalf("Expected blended hydro data for NoEastXXX %v",
+				buildingtype)
+		}
+	}
+
+	// Regions without building type data fall back to the
+	// blended data
+	if _, found := b["CaNCCoJBK"]; found {
+		t.Fatal("Unexpected building type data for CaNCCoJBK")
+	}
+
+	datafiles := FactorDataForBuildingType(l, b, "CaNCCoJBK", "ci")
+
+	if datafiles[electricity] != l["CaNCCoJBK"][electricity] {
+		t.Fatal("Expected blended electricity data for CaNCCoJBK")
+	}
 }
 
-func makeSurface(x float64) Geom {
-	x1, y1 := x, 0.0
-	x2, y2 := x1+1.0, 3.0
+func TestBuildingTypeColumn(t *testing.T) {
+	breaks := []float64{1.0, 3.0}
+	itreecode := "blah"
 
-	shapewkt := fmt.Sprintf(
-		"POLYGON((%f %f, %f %f, %f %f, %f %f, %f %f))",
-		x1, y1,
-		x1, y2,
-		x2, y2,
-		x2, y1,
-		x1, y1)
+	blended := &Datafile{breaks,
+		map[string][]float64{itreecode: []float64{1.0, 1.0}}}
+	commercial := &Datafile{breaks,
+		map[string][]float64{itreecode: []float64{2.0, 2.0}}}
 
-	return MakeGeosGeom(shapewkt)
+	region := "NoEastXXX"
+	regiondata := map[string][]*Datafile{
+		region: make([]*Datafile, len(Factors))}
+	buildingdata := map[string]map[string][]*Datafile{
+		region: map[string][]*Datafile{
+			"ci": make([]*Datafile, len(Factors))}}
+
+	for i := range Factors {
+		regiondata[region][i] = blended
+		buildingdata[region]["ci"][i] = commercial
+	}
+
+	speciesdata := map[string]map[string]string{
+		region: map[string]string{"ACRU": itreecode}}
+
+	testingContext := &TestingContext{false, regioninfo{}, -1,
+		[]*TestRecord{
+			&TestRecord{"ACRU", 2.0, 0, 0, 1, nil},
+			&TestRecord{"ACRU", 2.0, 0, 0, 1,
+				map[string]string{BuildingTypeColumn: "ci"}},
+			&TestRecord{"ACRU", 2.0, 0, 0, 1,
+				map[string]string{BuildingTypeColumn: "sfr"}}}}
+
+	factors, _, err := CalcBenefitsWithData(
+		DefaultFactors, nil, testingContext, RegionSRID, region, "", speciesdata,
+		regiondata, buildingdata, nil, nil, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blended + commercial + blended (no sfr data)
+	if factors["electricity"] != 4.0 {
+		t.Fatalf("Expected %v, got %v", 4.0, factors["electricity"])
+	}
+
+	testingContext.Reset()
+
+	factors, _, err = CalcBenefitsWithData(
+		DefaultFactors, nil, testingContext, RegionSRID, region, "ci", speciesdata,
+		regiondata, buildingdata, nil, nil, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// commercial + commercial + blended (no sfr data)
+	if factors["electricity"] != 5.0 {
+		t.Fatalf("Expected %v, got %v", 5.0, factors["electricity"])
+	}
+
+	// Unknown building types are skipped rather than
+	// falling back to the blended factors
+	testingContext = &TestingContext{false, regioninfo{}, -1,
+		[]*TestRecord{
+			&TestRecord{"ACRU", 2.0, 0, 0, 1,
+				map[string]string{BuildingTypeColumn: "ci"}},
+			&TestRecord{"ACRU", 2.0, 0, 0, 1,
+				map[string]string{BuildingTypeColumn: "office"}}}}
+
+	diagnostics := NewDiagnostics()
+
+	factors, _, err = CalcBenefitsWithData(
+		DefaultFactors, nil, testingContext, RegionSRID, region, "", speciesdata,
+		regiondata, buildingdata, nil, nil, nil, diagnostics)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if factors["electricity"] != 2.0 || factors["n_trees"] != 1 ||
+		diagnostics.UnknownBuildingType != 1 {
+
+		t.Fatalf("Expected only the ci tree, got %v and %v unknown",
+			factors, diagnostics.UnknownBuildingType)
+	}
+}
+
+func TestTreeFunc(t *testing.T) {
+	breaks := []float64{1.0, 3.0}
+	itreecode := "blah"
+
+	region := "NoEastXXX"
+	regiondata := map[string][]*Datafile{
+		region: make([]*Datafile, len(Factors))}
+
+	for i := range Factors {
+		regiondata[region][i] = &Datafile{breaks,
+			map[string][]float64{itreecode: []float64{1.0, 3.0}}}
+	}
+
+	speciesdata := map[string]map[string]string{
+		region: map[string]string{"ACRU": itreecode}}
+
+	testingContext := &TestingContext{false, regioninfo{}, -1,
+		[]*TestRecord{
+			&TestRecord{"ACRU", 1.0, 0, 0, 1,
+				map[string]string{IdColumn: "a"}},
+			&TestRecord{"UNKN", 2.0, 0, 0, 2,
+				map[string]string{IdColumn: "b"}},
+			&TestRecord{"ACRU", 2.0, 0, 0, 1,
+				map[string]string{IdColumn: "c"}}}}
+
+	ids := []string{}
+	electricity := FactorIndex("electricity")
+	total := 0.0
+
+	onTree := func(rows Fetchable, tree *TreeResult) error {
+		id, _ := rows.GetColumn(IdColumn)
+		ids = append(ids, id)
+
+		if tree.Otmcode == "UNKN" {
+			if tree.Factors != nil || tree.ITreeCode != "" {
+				t.Fatalf("Expected no results for %v, got %v",
+					id, tree)
+			}
+			return nil
+		}
+
+		if tree.Region != region || tree.ITreeCode != itreecode {
+			t.Fatalf("Expected %v in %v, got %v in %v",
+				itreecode, region, tree.ITreeCode, tree.Region)
+		}
+
+		total += tree.Factors[electricity]
+		return nil
+	}
+
+	factors, _, err := CalcBenefitsWithData(
+		DefaultFactors, nil, testingContext, RegionSRID, region, "", speciesdata,
+		regiondata, nil, nil, nil, onTree, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(ids, ",") != "a,b,c" {
+		t.Fatalf("Expected every tree to be passed to onTree, got %v", ids)
+	}
+
+	if total != factors["electricity"] {
+		t.Fatalf("Expected trees to sum to %v, got %v",
+			factors["electricity"], total)
+	}
+
+	testingContext.Reset()
+
+	stop := errors.New("stop")
+	_, _, err = CalcBenefitsWithData(
+		DefaultFactors, nil, testingContext, RegionSRID, region, "", speciesdata,
+		regiondata, nil, nil, nil,
+		func(rows Fetchable, tree *TreeResult) error { return stop }, nil)
+
+	if err != stop {
+		t.Fatalf("Expected the error from onTree, got %v", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	breaks := []float64{1.0, 3.0}
+	itreecode := "blah"
+
+	region := "NoEastXXX"
+	regiondata := map[string][]*Datafile{
+		region: make([]*Datafile, len(Factors))}
+
+	for i := range Factors {
+		regiondata[region][i] = &Datafile{breaks,
+			map[string][]float64{itreecode: []float64{1.0, 3.0}}}
+	}
+
+	speciesdata := map[string]map[string]string{
+		region: map[string]string{"ACRU": itreecode}}
+
+	testingContext := &TestingContext{false, regioninfo{}, -1,
+		[]*TestRecord{
+			&TestRecord{"ACRU", 2.0, 0, 0, 1, nil},
+			&TestRecord{"UNKN", 2.0, 0, 0, 2, nil},
+			&TestRecord{"UNKN", 2.0, 0, 0, 2, nil},
+			&TestRecord{"OTHR", 0.0, 0, 0, 3, nil},
+			&TestRecord{"ACRU", 0.0, 0, 0, 1, nil},
+			&TestRecord{"ACRU", 3.0, 0, 0, 1, nil}}}
+
+	diagnostics := NewDiagnostics()
+
+	factors, _, err := CalcBenefitsWithData(
+		DefaultFactors, nil, testingContext, RegionSRID, region, "", speciesdata,
+		regiondata, nil, nil, nil, nil, diagnostics)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tree without a diameter is still calculated
+	if factors["n_trees"] != 3 {
+		t.Fatalf("Expected %v trees, got %v", 3, factors["n_trees"])
+	}
+
+	if diagnostics.UnknownSpecies[region] != 3 {
+		t.Fatalf("Expected %v unknown species, got %v",
+			3, diagnostics.UnknownSpecies[region])
+	}
+
+	if strings.Join(diagnostics.UnknownOtmcodes, ",") != "UNKN,OTHR" {
+		t.Fatalf("Expected %v, got %v",
+			"UNKN,OTHR", diagnostics.UnknownOtmcodes)
+	}
+
+	if diagnostics.MissingDiameter != 1 {
+		t.Fatalf("Expected %v missing diameter, got %v",
+			1, diagnostics.MissingDiameter)
+	}
+
+	if diagnostics.AboveMaxDiameter != 1 {
+		t.Fatalf("Expected %v above the max diameter, got %v",
+			1, diagnostics.AboveMaxDiameter)
+	}
+
+	if diagnostics.OutsideRegions != 0 {
+		t.Fatalf("Expected %v outside regions, got %v",
+			0, diagnostics.OutsideRegions)
+	}
+}
+
+func TestTreeFilterQuery(t *testing.T) {
+	maxdiameter := 20.0
+
+	filter := &TreeFilter{
+		InstanceId:  4,
+		Bbox:        []float64{1.0, 2.0, 3.0, 4.0},
+		Otmcodes:    []string{"ACRU", "FICA"},
+		SpeciesIds:  []int{7},
+		MaxDiameter: &maxdiameter,
+		Polygon:     "POLYGON((0 0, 1 0, 1 1, 0 0))"}
+
+	query, args, err := filter.Query(true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedArgs := []interface{}{4, 1.0, 2.0, 3.0, 4.0,
+		"ACRU", "FICA", 7, 20.0, "POLYGON((0 0, 1 0, 1 1, 0 0))"}
+
+	if fmt.Sprint(args) != fmt.Sprint(expectedArgs) {
+		t.Fatalf("Expected %v, got %v", expectedArgs, args)
+	}
+
+	for _, fragment := range []string{
+		"treemap_tree.instance_id = $1",
+		"ST_MakeEnvelope($2, $3, $4, $5, 3857)",
+		"(treemap_species.otm_code = $6 or " +
+			"treemap_species.otm_code = $7 or treemap_species.id = $8)",
+		"treemap_tree.diameter <= $9",
+		"ST_GeomFromText($10, 3857)",
+		"ST_X(",
+		"treemap_tree.id as id"} {
+
+		if !strings.Contains(query, fragment) {
+			t.Fatalf("Expected %v in %v", fragment, query)
+		}
+	}
+
+	query, _, _ = (&TreeFilter{InstanceId: 4}).Query(false)
+
+	if strings.Contains(query, "ST_X(") {
+		t.Fatalf("Expected no coordinates in %v", query)
+	}
+
+	filter.GroupColumn = "date_planted"
+	query, _, err = filter.Query(true)
+
+	if err != nil || !strings.Contains(query,
+		"treemap_tree.id as id, treemap_tree.date_planted::text as date_planted") {
+
+		t.Fatalf("Expected the group column after the id in %v (%v)", query, err)
+	}
+
+	filter.GroupColumn = "1; drop table treemap_tree"
+	if _, _, err = filter.Query(true); err == nil {
+		t.Fatal("Expected an error for an unknown group column")
+	}
+
+	filter.GroupColumn = ""
+	filter.Bbox = []float64{1.0}
+	if _, _, err = filter.Query(true); err == nil {
+		t.Fatal("Expected an error for an invalid bounding box")
+	}
+}
+
+// Write files to a directory, by name
+func writeDataFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		err := ioutil.WriteFile(dir+"/"+name, []byte(contents), 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
+func TestReadDatafile(t *testing.T) {
+	dir := t.TempDir()
+
+	writeDataFiles(t, dir, map[string]string{
+		"output__TestXXX__cpa.csv": "#VALUE!,1,2,3,,\n" +
+			"A,1,2\n" +
+			"B,1,x,3\n" +
+			"C,1,NaN,3\n" +
+			"D,1,2,3,,extra\n" +
+			",,,\n" +
+			"0,Junk after the table,,\n",
+		"output__TestXXX__lsa.csv": "#VALUE!,1,3,2\nD,1,2,3\n",
+		"output__TestXXX__net_vocs.csv": ",1,2,3\nD,1,2,3\nE,1,2,3\n",
+		"output__bad.csv":               ",1\n"})
+
+	_, err := ReadDatafile(dir + "/output__TestXXX__cpa.csv")
+	errs, ok := err.(DataErrors)
+
+	if !ok || len(errs) != 3 {
+		t.Fatalf("Expected 3 data errors, got %v", err)
+	}
+
+	for i, line := range []int{2, 3, 4} {
+		if errs[i].Line != line {
+			t.Fatalf("Expected an error on line %v, got %v", line, errs[i])
+		}
+	}
+
+	datafile, err := ReadDatafile(dir + "/output__TestXXX__net_vocs.csv")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(datafile.Values) != 2 || datafile.Values["E"][2] != 3 {
+		t.Fatalf("Expected D and E, got %v", datafile.Values)
+	}
+
+	if _, err = ReadDatafile(dir + "/missing.csv"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+
+	if _, err = ReadDataFiles(dir); err == nil {
+		t.Fatal("Expected an error loading the directory")
+	}
+
+	if _, err = ReadDataFiles(dir + "/missing"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+
+	problems, err := ValidateData(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bad name, 3 bad rows, the lsa breaks, the species
+	// missing from cpa and lsa, which is one of the factors
+	// of the directory but didn't load
+	expected := 1 + 3 + 1 + 1 + 1
+
+	if len(problems) != expected {
+		t.Fatalf("Expected %v problems, got %v:\n%v",
+			expected, len(problems), problems)
+	}
+
+	for _, message := range []string{
+		"output__bad.csv: Expected a name",
+		"output__TestXXX__lsa.csv:1: DBH break 2 doesn't increase",
+		"output__TestXXX__cpa.csv: Missing 1 species that other TestXXX files have: E",
+		"output__TestXXX__lsa.csv: Region TestXXX has no lsa data",
+	} {
+		if !strings.Contains(problems.Error(), message) {
+			t.Fatalf("Expected %q in the problems:\n%v", message, problems)
+		}
+	}
+
+	problems, err = ValidateData("../data/")
+
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("Expected the data to be valid, got %v %v", err, problems)
+	}
+
+	// A single break can't be extrapolated from
+	single := t.TempDir()
+
+	writeDataFiles(t, single, map[string]string{
+		"output__TestXXX__cpa.csv": ",1\nD,1\n"})
+
+	_, err = ReadDatafile(single + "/output__TestXXX__cpa.csv")
+
+	if err == nil || !strings.Contains(err.Error(), "at least 2 DBH breaks") {
+		t.Fatalf("Expected an error for a single break, got %v", err)
+	}
+
+	table := &BundleTable{Breaks: []float64{1}, BreaksUnit: DiameterUnit,
+		Values: map[string][]float64{"D": []float64{1}}}
+
+	if _, errs := table.datafile("single", DiameterUnit); len(errs) == 0 {
+		t.Fatal("Expected an error for a bundle table with a single break")
+	}
+}
+
+func TestBundle(t *testing.T) {
+	bundle, err := BuildBundle("../data/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regiondata := LoadFiles("../data/")
+	buildingdata := LoadBuildingTypeFiles("../data/", regiondata)
+	growthdata := LoadGrowthFiles("../data/")
+
+	table := bundle.Regions["NoEastXXX"].Factors["electricity"]
+
+	if table.Unit != "kWh" || table.BreaksUnit != DiameterUnit ||
+		table.Source != "output__NoEastXXX__electricity.csv" {
+
+		t.Fatalf("Unexpected electricity table %v %v %v",
+			table.Unit, table.BreaksUnit, table.Source)
+	}
+
+	for _, form := range []string{"json", "gzip", "binary"} {
+		buf := &bytes.Buffer{}
+
+		if form == "binary" {
+			err = WriteBinaryBundle(buf, bundle)
+		} else {
+			err = WriteBundle(buf, bundle, form == "gzip")
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := ReadBundle(buf)
+
+		if err != nil {
+			t.Fatalf("Failed to read %v bundle: %v", form, err)
+		}
+
+		data, err := read.FactorData()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(data.Regions, regiondata) ||
+			!reflect.DeepEqual(data.BuildingTypes, buildingdata) ||
+			!reflect.DeepEqual(data.Growth, growthdata) {
+
+			t.Fatalf("Expected the %v bundle to match the CSV files", form)
+		}
+	}
+
+	future := *bundle
+	future.Version = BundleVersion + 1
+	buf := &bytes.Buffer{}
+	WriteBinaryBundle(buf, &future)
+
+	if _, err = ReadBundle(buf); err == nil {
+		t.Fatal("Expected an error for a newer bundle version")
+	}
+
+	// Bundles take the place of the CSV files
+	dir := t.TempDir()
+	file, _ := os.Create(dir + "/bundle.bin")
+	WriteBinaryBundle(file, bundle)
+	file.Close()
+
+	data, path, err := ReadFactorData(dir)
+
+	if err != nil || path != dir+"/bundle.bin" {
+		t.Fatalf("Expected the bundle to be read, got %v %v", path, err)
+	}
+
+	if !reflect.DeepEqual(data.Regions, regiondata) {
+		t.Fatal("Expected the bundle to match the CSV files")
+	}
+}
+
+func TestFactorDataOverride(t *testing.T) {
+	data, _, err := ReadFactorDataFS(os.DirFS("../data/"), "../data/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lomidw := data.Regions["LoMidWXXX"]
+	noeastgrowth := data.Growth["NoEastXXX"]
+
+	// Replace the factors (but not the building types or
+	// growth) of NoEastXXX with the ones from LoMidWXXX
+	fsys := fstest.MapFS{}
+
+	for _, factor := range Factors {
+		content, err := ioutil.ReadFile(
+			"../data/output__LoMidWXXX__" + factor + ".csv")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fsys["output__NoEastXXX__"+factor+".csv"] =
+			&fstest.MapFile{Data: content}
+	}
+
+	override, _, err := ReadFactorDataFS(fsys, "override")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = data.Override(override); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(data.Regions["NoEastXXX"], lomidw) {
+		t.Fatal("Expected the NoEastXXX factors to be replaced")
+	}
+
+	if _, found := data.BuildingTypes["NoEastXXX"]; found {
+		t.Fatal("Expected the NoEastXXX building types to be removed")
+	}
+
+	if data.Growth["NoEastXXX"] != noeastgrowth {
+		t.Fatal("Expected the NoEastXXX growth data to be kept")
+	}
+
+	if !reflect.DeepEqual(data.Regions["LoMidWXXX"], lomidw) ||
+		data.BuildingTypes["LoMidWXXX"] == nil {
+
+		t.Fatal("Expected LoMidWXXX to be unchanged")
+	}
+}
+
+func TestFactorDataPartialOverride(t *testing.T) {
+	data, _, err := ReadFactorDataFS(os.DirFS("../data/"), "../data/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noeast := append([]*Datafile(nil), data.Regions["NoEastXXX"]...)
+	lomidw := data.Regions["LoMidWXXX"]
+	electricity := FactorIndex("electricity")
+
+	// Replace only the electricity of NoEastXXX
+	content, err := ioutil.ReadFile(
+		"../data/output__LoMidWXXX__electricity.csv")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{"output__NoEastXXX__electricity.csv": &fstest.MapFile{Data: content}}
+
+	override, _, err := ReadFactorDataFS(fsys, "override")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = data.Override(override); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, datafile := range data.Regions["NoEastXXX"] {
+		expected := noeast[i]
+		if i == electricity {
+			expected = lomidw[i]
+		}
+
+		if !reflect.DeepEqual(datafile, expected) {
+			t.Fatalf("Unexpected %v data for NoEastXXX", Factors[i])
+		}
+	}
+
+	// The building type data for electricity falls back
+	// to the new blended data, the rest is kept
+	buildingtypes := data.BuildingTypes["NoEastXXX"]
+
+	if len(buildingtypes) == 0 {
+		t.Fatal("Expected the NoEastXXX building types to be kept")
+	}
+
+	for buildingtype, datafiles := range buildingtypes {
+		if datafiles[electricity] != nil {
+			t.Fatalf("Expected no %v electricity data", buildingtype)
+		}
+	}
+}
+
+func TestValidateOverrideData(t *testing.T) {
+	base, _, err := ReadFactorDataFS(os.DirFS("../data/"), "../data/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "override")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, region := range []string{"NoEastXXX", "NewRegion"} {
+		content, err := ioutil.ReadFile(
+			"../data/output__LoMidWXXX__electricity.csv")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(dir,
+			"output__"+region+"__electricity.csv"), content, 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := ValidateOverrideData(dir, base)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the new region is missing factors
+	if len(problems) != len(Factors)-1 {
+		t.Fatalf("Expected %v problems, got %v", len(Factors)-1, problems)
+	}
+
+	for _, problem := range problems {
+		if !strings.Contains(problem.Message, "NewRegion") {
+			t.Fatalf("Unexpected problem %v", problem)
+		}
+	}
+}
+
+func TestBundleFactors(t *testing.T) {
+	bundle, err := BuildBundle("../data/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := bundle.FactorData()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !base.Factors.Equal(DefaultFactors) {
+		t.Fatalf("Expected the default factors, got %v", base.Factors.Names())
+	}
+
+	// A bundle with a new factor for one region and
+	// without "bvoc"
+	region := bundle.Regions["NoEastXXX"]
+	shade := *region.Factors["cpa"]
+	shade.Unit = "h"
+	region.Factors["shade"] = &shade
+	delete(region.Factors, "bvoc")
+
+	extra := &Bundle{Regions: map[string]*BundleRegion{"NoEastXXX": region}}
+	override, err := extra.FactorData()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := override.Factors.Names()
+
+	if names[len(names)-1] != "shade" || override.Factors.Index("bvoc") >= 0 ||
+		override.Factors.Unit("shade") != "h" {
+
+		t.Fatalf("Unexpected factors %v", names)
+	}
+
+	if err = base.Override(override); err != nil {
+		t.Fatal(err)
+	}
+
+	factors := base.Factors
+
+	if factors.Len() != len(Factors)+1 || factors.Index("bvoc") < 0 {
+		t.Fatalf("Expected every factor and shade, got %v", factors.Names())
+	}
+
+	shadeIdx := factors.Index("shade")
+	bvocIdx := factors.Index("bvoc")
+
+	// NoEastXXX keeps its own bvoc data
+	if base.Regions["NoEastXXX"][shadeIdx] == nil ||
+		base.Regions["NoEastXXX"][bvocIdx] == nil ||
+		base.Regions["LoMidWXXX"][shadeIdx] != nil ||
+		base.Regions["LoMidWXXX"][bvocIdx] == nil {
+
+		t.Fatal("Expected the factor data to follow the union of the factors")
+	}
+
+	// Regions without data for a factor don't have a value for it
+	benefits := make([]float64, factors.Len())
+	CalcOneTree(factors, base.Regions["LoMidWXXX"], "ACRU", 30, benefits)
+
+	if benefits[shadeIdx] != 0 || benefits[bvocIdx] == 0 {
+		t.Fatalf("Unexpected benefits %v", factors.ArrayToMap(benefits))
+	}
+
+	// Units have to agree
+	shade.Unit = "kg"
+	region.Factors["cpa"] = &shade
+	region.Factors["shade"] = region.Factors["lsa"]
+
+	if _, err = extra.FactorData(); err == nil {
+		t.Fatal("Expected an error for a factor in the wrong units")
+	}
+}
+
+// The factors of CSV files come from their names, so a new
+// factor only needs its files
+func TestCSVFactorSet(t *testing.T) {
+	factors, err := ReadFactorSet("../data/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !factors.Equal(DefaultFactors) {
+		t.Fatalf("Expected the default factors, got %v", factors.Names())
+	}
+
+	dir := t.TempDir()
+
+	writeDataFiles(t, dir, map[string]string{
+		"output__TestXXX__cpa.csv":              ",1,2\nA,1,2\n",
+		"output__TestXXX__shade.csv":            ",1,2\nA,3,4\n",
+		"output__TestXXX__shade-ci.csv":         ",1,2\nA,5,6\n",
+		"output__TestXXX__numbers.csv":          ",1,2\nA,7,8\n",
+		"output__TestXXX__dbh_by_age_class.csv": ",1,2\nA,1,2\n"})
+
+	factors, err = ReadFactorSet(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(factors.Names(), ",") != "cpa,shade" ||
+		factors.Unit("cpa") != "m^2" || factors.Unit("shade") != "" {
+
+		t.Fatalf("Expected cpa and shade, got %v", factors.Names())
+	}
+
+	data, _, err := ReadFactorData(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !data.Factors.Equal(factors) {
+		t.Fatalf("Expected the factors of the files, got %v", data.Factors.Names())
+	}
+
+	benefits := make([]float64, factors.Len())
+	CalcOneTree(factors, data.Regions["TestXXX"], "A", 1, benefits)
+
+	if benefits[1] != 3 {
+		t.Fatalf("Expected 3 for shade, got %v", benefits)
+	}
+
+	benefits = make([]float64, factors.Len())
+	CalcOneTree(factors, data.BuildingTypes["TestXXX"]["ci"], "A", 1, benefits)
+
+	if benefits[0] != 1 || benefits[1] != 5 {
+		t.Fatalf("Expected the ci variant of shade, got %v", benefits)
+	}
+
+	bundle, err := BuildBundle(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := bundle.Regions["TestXXX"].Factors["shade"]; !found {
+		t.Fatalf("Expected shade in the bundle, got %v", bundle.Regions["TestXXX"])
+	}
+
+	problems, err := ValidateData(dir)
+
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("Expected the files to be valid, got %v %v", err, problems)
+	}
+}
+
+func BenchmarkReadBinaryBundle(b *testing.B) {
+	bundle, _ := BuildBundle("../data/")
+	buf := &bytes.Buffer{}
+	WriteBinaryBundle(buf, bundle)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		read, err := ReadBundle(bytes.NewReader(buf.Bytes()))
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		benchdump, _ = read.FactorData()
+	}
+}
+
+func TestGrowthFiles(t *testing.T) {
+	g := LoadGrowthFiles("../data/")
+
+	growth, found := g["NoEastXXX"]
+
+	if !found {
+		t.Fatal("Missing growth data for NoEastXXX")
+	}
+
+	diameter, err := DiameterAtAge(growth, "ACRU", 20.0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diameter != 24.1 {
+		t.Fatalf("Expected %v, got %v", 24.1, diameter)
+	}
+
+	_, err = DiameterAtAge(growth, "NOT A CODE", 20.0)
+
+	if err == nil {
+		t.Fatal("Expected an error for a missing species")
+	}
+}
+
+func TestGrowth(t *testing.T) {
+	itreecode := "blah"
+	growth := &Datafile{[]float64{5.0, 10.0, 20.0},
+		map[string][]float64{itreecode: []float64{2.0, 6.0, 6.0}}}
+
+	diameterTargets := map[float64]float64{
+		2.5:  1.0,
+		7.5:  4.0,
+		15.0: 6.0,
+		25.0: 6.0}
+
+	for age, target := range diameterTargets {
+		diameter, _ := DiameterAtAge(growth, itreecode, age)
+
+		if diameter != target {
+			t.Fatalf("Expected %v, got %v at age %v",
+				target, diameter, age)
+		}
+	}
+
+	ageTargets := map[float64]float64{
+		1.0: 2.5,
+		4.0: 7.5,
+		6.0: 10.0,
+		// Past the end of the curve, so extrapolated
+		// from the last growing age class
+		8.0: 12.5}
+
+	for diameter, target := range ageTargets {
+		age, _ := AgeForDiameter(growth, itreecode, diameter)
+
+		if age != target {
+			t.Fatalf("Expected %v, got %v for diameter %v",
+				target, age, diameter)
+		}
+	}
+
+	projected, _ := ProjectDiameters(growth, itreecode, 5.0, 3)
+
+	for i, target := range []float64{2.0, 2.8, 3.6} {
+		if math.Abs(projected[i]-target) > 1e-9 {
+			t.Fatalf("Expected %v, got %v for year %v",
+				target, projected[i], i)
+		}
+	}
+}
+
+func TestSurvival(t *testing.T) {
+	half := func(diameter float64) float64 { return 0.5 }
+	none := func(diameter float64) float64 { return 0.0 }
+
+	// Not planted until the second year and
+	// removed after the fourth
+	survival := CalcSurvival(
+		[]float64{0, 1, 1, 1}, half, nil, nil, 5)
+
+	for i, target := range []float64{0, 1, 0.5, 0.25, 0} {
+		if survival.Trees[i] != target {
+			t.Fatalf("Expected %v, got %v for year %v",
+				target, survival.Trees[i], i)
+		}
+	}
+
+	// Trees die each year and the survivors are
+	// removed at the end of the fourth year
+	for i, target := range []float64{0, 0.5, 0.25, 0.25, 0} {
+		if survival.Removed[i] != target {
+			t.Fatalf("Expected %v removed, got %v for year %v",
+				target, survival.Removed[i], i)
+		}
+	}
+
+	if survival.Replacements != nil {
+		t.Fatal("Unexpected replacements")
+	}
+
+	// Replacement trees keep the site fully stocked
+	survival = CalcSurvival(
+		[]float64{1, 1, 1}, half, []float64{1, 1, 1}, none, 3)
+
+	replacementTargets := [][]float64{{}, {0.5}, {0.25, 0.5}}
+
+	for i, targets := range replacementTargets {
+		if len(survival.Replacements[i]) != len(targets) {
+			t.Fatalf("Expected %v replacement age classes, got %v "+
+				"for year %v", len(targets),
+				len(survival.Replacements[i]), i)
+		}
+
+		for k, target := range targets {
+			if survival.Replacements[i][k] != target {
+				t.Fatalf("Expected %v, got %v for year %v age %v",
+					target, survival.Replacements[i][k], i, k)
+			}
+		}
+
+		if survival.Living(i) != 1.0 {
+			t.Fatalf("Expected 1 living tree, got %v for year %v",
+				survival.Living(i), i)
+		}
+	}
+}
+
+// Since there isn't really a canonical benefits
+// library to test against, we're just going to
+// use a couple of exsiting OTM instances
+//
+// These test are pretty data dependent but the
+// whole purpose of the library is to provide access to
+// that data
+func TestSpecificTreeData(t *testing.T) {
+	region := "LoMidWXXX"
+	otmcode := "ULAM"
+	dbh := 11.0
+
+	targets := map[string]float64{
+		"aq_nox_avoided":      0.01548490,
+		"aq_nox_dep":          0.00771784,
+		"aq_pm10_avoided":     0.00546863,
+		"aq_pm10_dep":         0.016322,
+		"aq_sox_avoided":      0.06590,
+		"aq_sox_dep":          0.0057742,
+		"aq_voc_avoided":      0.0054686,
+		"bvoc":                0,
+		"cpa":                 12.980839,
+		"lsa":                 81.485564,
+		"co2_avoided":         12.0864829,
+		"co2_decomp":          1.7984252,
+		"co2_maint":           0.9604986,
+		"co2_sequestered":     51.42926,
+		"co2_storage":         110.79107,
+		"electricity":         12.180839,
+		"hydro_interception":  2.5919028,
+		"natural_gas":         -18.345013,
+		"net_co2_sequestered": 48.764698,
+		"net_vocs":            0.0057742,
+		"property_value":      24.487139}
+
+	l := LoadFiles("../data/")
+	m, _ := LoadSpeciesMap("../data/species.json")
+
+	itreecode := m[region][otmcode]
+	factorDataForRegion := l[region]
+
+	factorsum := make([]float64, len(Factors))
+
+	CalcOneTree(
+		DefaultFactors,
+		factorDataForRegion,
+		itreecode,
+		dbh,
+		factorsum)
+
+	factormap := FactorArrayToMap(factorsum)
+
+	for factor, target := range targets {
+		calcd := factormap[factor]
+
+		if int(calcd*100000) != int(target*100000) {
+			t.Fatalf("Expected %v, got %v for factor %v",
+				target, calcd, factor)
+		}
+	}
+}
+
+func generateSpeciesListFromRegion(
+	speciesdata map[string]map[string]string,
+	targetLength int, region Region) []*TestRecord {
+
+	speciesmap := speciesdata[region.Code]
+
+	possibleSpecies := make([]string, len(speciesmap))
+	i := 0
+	for k, _ := range speciesmap {
+		possibleSpecies[i] = k
+		i++
+	}
+
+	idx := rand.Perm(targetLength)
+
+	data := make([]*TestRecord, targetLength)
+
+	i = 0
+	for sidx := range idx {
+		x, y := GetXYOnSurface(region.geom)
+		otmcode := possibleSpecies[sidx%len(possibleSpecies)]
+		diameter := rand.Float64() * 100.0
+		data[i] = &TestRecord{otmcode, diameter, x, y, sidx, nil}
+		i++
+	}
+
+	return data
+}
+
+func benchmarkTreesSingleRegion(targetLength int, b *testing.B) {
+	info := regionInfos[0]
+
+	benchmarkTreesMultiRegion([]regioninfo{info},
+		targetLength, b)
+}
+
+func benchmarkTreesMultiRegion(
+	regions []regioninfo, targetLength int, b *testing.B) {
+
+	benchmarkTreesMultiRegionWithOverrides(nil, regions, targetLength, b)
+}
+
+// Test surfaces are in web mercator, with each unit
+// of x being 100km
+const surfaceScale = 100000.0
+
+func makeSurface(x float64) Geom {
+	x1, y1 := x*surfaceScale, 0.0
+	x2, y2 := x1+surfaceScale, 3.0*surfaceScale
+
+	shapewkt := fmt.Sprintf(
+		"POLYGON((%f %f, %f %f, %f %f, %f %f, %f %f))",
+		x1, y1,
+		x1, y2,
+		x2, y2,
+		x2, y1,
+		x1, y1)
+
+	return MakeGeosGeom(shapewkt)
+}
+
+func TestRegionCodeForPoint(t *testing.T) {
+	InitGeos()
+
+	regions := []Region{
+		Region{"NoEastXXX", makeSurface(2.0)},
+		Region{"CaNCCoJBK", makeSurface(4.0)}}
+
+	targets := map[float64]string{
+		2.5: "NoEastXXX",
+		4.5: "CaNCCoJBK",
+		3.5: ""}
+
+	index, err := NewRegionIndex(regions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x, target := range targets {
+		region, err := index.RegionCodeForPoint(x*surfaceScale, surfaceScale)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if region != target {
+			t.Fatalf("Expected %v, got %v for x %v", target, region, x)
+		}
+	}
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+}
+
+func TestRegionsIntersecting(t *testing.T) {
+	InitGeos()
+
+	regions := []Region{
+		Region{"NoEastXXX", makeSurface(2.0)},
+		Region{"CaNCCoJBK", makeSurface(4.0)}}
+
+	bbox, err := BboxWKT([]float64{2.2 * surfaceScale, 0.2 * surfaceScale,
+		2.8 * surfaceScale, 0.8 * surfaceScale})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	area, err := ParseGeosGeom(bbox)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intersecting, err := RegionsIntersecting(regions, area)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(intersecting) != 1 || intersecting[0].Code != "NoEastXXX" {
+		t.Fatalf("Expected only NoEastXXX, got %v", intersecting)
+	}
+
+	if _, err = ParseGeosGeom("not wkt"); err == nil {
+		t.Fatal("Expected an error for invalid WKT")
+	}
+
+	GeosDestroy(area)
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+}
+
+func TestGeoJSONWKT(t *testing.T) {
+	targets := map[string]string{
+		`{"type": "Point", "coordinates": [1.5, 2]}`: "POINT (1.5 2)",
+		`{"type": "Feature", "properties": {}, "geometry": ` +
+			`{"type": "Polygon", "coordinates": ` +
+			`[[[0, 0], [1, 0], [1, 1], [0, 0]]]}}`: "POLYGON ((0 0, 1 0, 1 1, 0 0))",
+		`{"type": "MultiPolygon", "coordinates": ` +
+			`[[[[0, 0], [1, 0], [1, 1], [0, 0]]], ` +
+			`[[[2, 2], [3, 2], [3, 3], [2, 2]]]]}`: "MULTIPOLYGON (((0 0, 1 0, 1 1, 0 0)), " +
+			"((2 2, 3 2, 3 3, 2 2)))"}
+
+	for geojson, target := range targets {
+		geometry, err := ParseGeoJSONGeometry([]byte(geojson))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wkt, err := geometry.WKT()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if wkt != target {
+			t.Fatalf("Expected %v, got %v", target, wkt)
+		}
+	}
+
+	invalid := []string{
+		`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [0, 0]]]}`,
+		`{"type": "LineString", "coordinates": [[0, 0], [1, 0]]}`,
+		`{"type": "Feature", "properties": {}}`}
+
+	for _, geojson := range invalid {
+		geometry, err := ParseGeoJSONGeometry([]byte(geojson))
+
+		if err == nil {
+			_, err = geometry.WKT()
+		}
+
+		if err == nil {
+			t.Fatalf("Expected an error for %v", geojson)
+		}
+	}
+}
+
+func TestReproject(t *testing.T) {
+	// The corner of the web mercator extent
+	lon, lat := 180.0, maxWebMercatorLatitude
+	expectedX, expectedY := 20037508.34, 20037508.34
+
+	x, y, err := Reproject(lon, lat, SRIDWGS84, SRIDWebMercator)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(x-expectedX) > 1 || math.Abs(y-expectedY) > 1 {
+		t.Fatalf("Expected %v, %v, got %v, %v", expectedX, expectedY, x, y)
+	}
+
+	x, y, err = Reproject(x, y, SRIDWebMercator, SRIDWGS84)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(x-lon) > 1e-9 || math.Abs(y-lat) > 1e-9 {
+		t.Fatalf("Expected %v, %v, got %v, %v", lon, lat, x, y)
+	}
+
+	if _, _, err = Reproject(0, 89, SRIDWGS84, SRIDWebMercator); err == nil {
+		t.Fatal("Expected an error for a latitude outside of web mercator")
+	}
+
+	if _, _, err = Reproject(0, 0, 2263, SRIDWebMercator); err == nil {
+		t.Fatal("Expected an error for an unsupported SRID")
+	}
+
+	if err = CheckPoint(-8367351.8, 4859056.6, SRIDWGS84); err == nil {
+		t.Fatal("Expected an error for web mercator as longitude and latitude")
+	}
+
+	if err = CheckPoint(-75.16, 39.95, SRIDWebMercator); err == nil {
+		t.Fatal("Expected an error for longitude and latitude as web mercator")
+	}
+}
+
+func TestPointSRID(t *testing.T) {
+	InitGeos()
+
+	region := "NoEastXXX"
+	regions := []Region{Region{region, makeSurface(2.0)}}
+
+	regiondata := map[string][]*Datafile{
+		region: make([]*Datafile, len(Factors))}
+
+	for i := range Factors {
+		regiondata[region][i] = &Datafile{[]float64{1.0, 3.0},
+			map[string][]float64{"blah": []float64{1.0, 3.0}}}
+	}
+
+	speciesdata := map[string]map[string]string{
+		region: map[string]string{"ACRU": "blah"}}
+
+	// About 278km east and 111km north of the origin
+	// in web mercator
+	testingContext := &TestingContext{true, regioninfo{}, -1,
+		[]*TestRecord{&TestRecord{"ACRU", 2.0, 2.5, 1.0, 1, nil}}}
+
+	factors, _, err := CalcBenefitsWithData(
+		DefaultFactors, regions, testingContext, SRIDWGS84, "", "", speciesdata,
+		regiondata, nil, nil, nil, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if factors["n_trees"] != 1 {
+		t.Fatalf("Expected %v trees, got %v", 1, factors["n_trees"])
+	}
+
+	testingContext.Reset()
+
+	_, _, err = CalcBenefitsWithData(
+		DefaultFactors, regions, testingContext, SRIDWebMercator, "", "", speciesdata,
+		regiondata, nil, nil, nil, nil, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "longitude and latitude") {
+		t.Fatalf("Expected an error for longitude and latitude, got %v", err)
+	}
+
+	GeosDestroy(regions[0].geom)
+}
+
+func TestGeoJSONReproject(t *testing.T) {
+	geometry, err := ParseGeoJSONGeometry([]byte(
+		`{"type": "Polygon", "coordinates": ` +
+			`[[[0, 0], [180, 0], [180, 10], [0, 0]]]}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reprojected, err := geometry.Reproject(SRIDWGS84, SRIDWebMercator)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wkt, _ := reprojected.WKT()
+
+	if !strings.HasPrefix(wkt, "POLYGON ((0 0, 20037508.342789244 0, ") {
+		t.Fatalf("Expected the polygon in web mercator, got %v", wkt)
+	}
+
+	if _, err = geometry.Reproject(SRIDWebMercator, SRIDWGS84); err == nil {
+		t.Fatal("Expected an error for longitude and latitude in web mercator")
+	}
+
+	crsTargets := map[string]int{
+		"EPSG:3857":                     SRIDWebMercator,
+		"urn:ogc:def:crs:EPSG::4326":    SRIDWGS84,
+		"urn:ogc:def:crs:OGC:1.3:CRS84": SRIDWGS84}
+
+	for name, target := range crsTargets {
+		crs := &GeoJSONCrs{Type: "name"}
+		crs.Properties.Name = name
+
+		srid, err := crs.Srid()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if srid != target {
+			t.Fatalf("Expected %v, got %v for %v", target, srid, name)
+		}
+	}
+}
+
+// Find the region code for a longitude and latitude
+func regionCodeForLonLat(t *testing.T, regions map[int]Region, x float64, y float64) string {
+	list := make([]Region, 0, len(regions))
+	for _, region := range regions {
+		list = append(list, region)
+	}
+
+	x, y, err := ToRegionSRID(x, y, SRIDWGS84)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := NewRegionIndex(list)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := index.RegionCodeForPoint(x, y)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func TestLoadRegionGeoJSON(t *testing.T) {
+	InitGeos()
+
+	dir := t.TempDir()
+
+	if _, err := LoadRegionGeoms(dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+
+	geojson := `{
+	  "type": "FeatureCollection",
+	  "features": [
+	    {"type": "Feature", "properties": {"code": "NoEastXXX"},
+	     "geometry": {"type": "Polygon", "coordinates": [
+	       [[-76, 39], [-74, 39], [-74, 41], [-76, 41], [-76, 39]],
+	       [[-75.5, 39.5], [-74.5, 39.5], [-74.5, 40.5], [-75.5, 40.5], [-75.5, 39.5]]]}},
+	    {"type": "Feature", "properties": {"code": "PiedmtCLT"},
+	     "geometry": {"type": "MultiPolygon", "coordinates": [
+	       [[[-81, 35], [-80, 35], [-80, 36], [-81, 36], [-81, 35]]]]}}
+	  ]
+	}`
+
+	path := dir + "/regions.geojson"
+
+	if err := ioutil.WriteFile(path, []byte(geojson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	regions, err := LoadRegionGeoms(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := map[[2]float64]string{
+		{-75.8, 39.2}: "NoEastXXX",
+		{-75, 40}:     "",
+		{-80.5, 35.5}: "PiedmtCLT",
+		{-90, 45}:     ""}
+
+	for point, target := range targets {
+		if code := regionCodeForLonLat(t, regions, point[0], point[1]); code != target {
+			t.Fatalf("Expected %v, got %v for %v", target, code, point)
+		}
+	}
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+
+	invalid := `{"type": "FeatureCollection", "features": [
+	  {"type": "Feature", "properties": {},
+	   "geometry": {"type": "Polygon", "coordinates": [
+	     [[-76, 39], [-74, 39], [-74, 41], [-76, 39]]]}}]}`
+
+	ioutil.WriteFile(path, []byte(invalid), 0644)
+
+	if _, err = LoadRegionGeoms(dir); err == nil {
+		t.Fatal("Expected an error for a region without a code")
+	}
+
+	ioutil.WriteFile(path, []byte(
+		`{"type": "FeatureCollection", "features": [null]}`), 0644)
+
+	if _, err = LoadRegionGeoms(dir); err == nil {
+		t.Fatal("Expected an error for a null region")
+	} else if _, ok := err.(*DataError); !ok {
+		t.Fatalf("Expected a DataError, got %v", err)
+	}
+}
+
+// Write a polygon shapefile with a "code" field. Each shape is
+// a list of rings, and nil shapes are null records
+func writeRegionShapefile(t *testing.T, base string, codes []string, shapes [][][][2]float64) {
+	shp := &bytes.Buffer{}
+	shp.Write(make([]byte, 100))
+
+	for i, rings := range shapes {
+		content := &bytes.Buffer{}
+
+		if rings == nil {
+			binary.Write(content, binary.LittleEndian, int32(shpNull))
+		} else {
+			npoints := 0
+			for _, ring := range rings {
+				npoints += len(ring)
+			}
+
+			binary.Write(content, binary.LittleEndian, int32(shpPolygon))
+			binary.Write(content, binary.LittleEndian, [4]float64{})
+			binary.Write(content, binary.LittleEndian, int32(len(rings)))
+			binary.Write(content, binary.LittleEndian, int32(npoints))
+
+			start := 0
+			for _, ring := range rings {
+				binary.Write(content, binary.LittleEndian, int32(start))
+				start += len(ring)
+			}
+
+			for _, ring := range rings {
+				binary.Write(content, binary.LittleEndian, ring)
+			}
+		}
+
+		binary.Write(shp, binary.BigEndian, int32(i+1))
+		binary.Write(shp, binary.BigEndian, int32(content.Len()/2))
+		shp.Write(content.Bytes())
+	}
+
+	header := shp.Bytes()
+	binary.BigEndian.PutUint32(header, 9994)
+	binary.BigEndian.PutUint32(header[24:], uint32(len(header)/2))
+	binary.LittleEndian.PutUint32(header[28:], 1000)
+	binary.LittleEndian.PutUint32(header[32:], shpPolygon)
+
+	// One 10 character "code" field
+	dbf := make([]byte, 32+32+1)
+	dbf[0] = 3
+	binary.LittleEndian.PutUint32(dbf[4:], uint32(len(codes)))
+	binary.LittleEndian.PutUint16(dbf[8:], uint16(len(dbf)))
+	binary.LittleEndian.PutUint16(dbf[10:], 11)
+	copy(dbf[32:], "CODE")
+	dbf[32+11] = 'C'
+	dbf[32+16] = 10
+	dbf[64] = 0x0d
+
+	for _, code := range codes {
+		dbf = append(dbf, []byte(fmt.Sprintf(" %-10v", code))...)
+	}
+
+	if err := ioutil.WriteFile(base+".shp", header, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(base+".dbf", dbf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRegionShapefile(t *testing.T) {
+	InitGeos()
+
+	dir := t.TempDir()
+
+	// Shells are clockwise and holes counterclockwise
+	writeRegionShapefile(t, dir+"/regions",
+		[]string{"NoEastXXX", "", "PiedmtCLT"},
+		[][][][2]float64{
+			{
+				{{-81, 35}, {-81, 36}, {-80, 36}, {-80, 35}, {-81, 35}},
+				{{-76, 39}, {-76, 41}, {-74, 41}, {-74, 39}, {-76, 39}},
+				{{-75.5, 39.5}, {-74.5, 39.5}, {-74.5, 40.5},
+					{-75.5, 40.5}, {-75.5, 39.5}},
+			},
+			nil,
+			{{{-91, 45}, {-91, 46}, {-90, 46}, {-90, 45}, {-91, 45}}},
+		})
+
+	regions, err := LoadRegionGeoms(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(regions) != 2 {
+		t.Fatalf("Expected 2 regions, got %v", len(regions))
+	}
+
+	targets := map[[2]float64]string{
+		{-75.8, 39.2}: "NoEastXXX",
+		{-80.5, 35.5}: "NoEastXXX",
+		{-75, 40}:     "",
+		{-90.5, 45.5}: "PiedmtCLT"}
+
+	for point, target := range targets {
+		if code := regionCodeForLonLat(t, regions, point[0], point[1]); code != target {
+			t.Fatalf("Expected %v, got %v for %v", target, code, point)
+		}
+	}
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+
+	prj := `PROJCS["NAD83 / UTM zone 18N",GEOGCS["NAD83"]]`
+	ioutil.WriteFile(dir+"/regions.prj", []byte(prj), 0644)
+
+	if _, err = LoadRegionGeoms(dir); err == nil {
+		t.Fatal("Expected an error for an unsupported projection")
+	}
+}
+
+// A grid of n by n square regions, each 100km wide,
+// with gaps between them
+func makeRegionGrid(n int) []Region {
+	regions := make([]Region, 0, n*n)
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			x1, y1 := float64(i)*2*surfaceScale, float64(j)*2*surfaceScale
+			x2, y2 := x1+surfaceScale, y1+surfaceScale
+
+			wkt := fmt.Sprintf(
+				"POLYGON((%f %f, %f %f, %f %f, %f %f, %f %f))",
+				x1, y1, x1, y2, x2, y2, x2, y1, x1, y1)
+
+			regions = append(regions, Region{
+				fmt.Sprintf("%v,%v", i, j), MakeGeosGeom(wkt)})
+		}
+	}
+
+	return regions
+}
+
+// Random points over a grid of regions from makeRegionGrid
+func makeGridPoints(n int, count int) [][2]float64 {
+	points := make([][2]float64, count)
+	extent := float64(n) * 2 * surfaceScale
+
+	for i := range points {
+		points[i] = [2]float64{
+			rand.Float64() * extent, rand.Float64() * extent}
+	}
+
+	return points
+}
+
+func TestRegionIndex(t *testing.T) {
+	InitGeos()
+
+	n := 5
+	regions := makeRegionGrid(n)
+	index, err := NewRegionIndex(regions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, point := range makeGridPoints(n, 1000) {
+		expected, _ := linearRegionCode(regions, point[0], point[1])
+		code, err := index.RegionCodeForPoint(point[0], point[1])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != expected {
+			t.Fatalf("Expected %v, got %v for %v", expected, code, point)
+		}
+	}
+
+	code, _ := index.RegionCodeForPoint(-surfaceScale, -surfaceScale)
+
+	if code != "" {
+		t.Fatalf("Expected no region outside of the index, got %v", code)
+	}
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+}
+
+// Run summaries, and create and destroy geometries, from many
+// goroutines at once. Run with -race to check the geometry
+// backend is safe to share between requests
+func TestConcurrentSummaries(t *testing.T) {
+	InitGeos()
+
+	l := LoadFiles("../data/")
+	speciesdata, _ := LoadSpeciesMap("../data/species.json")
+	prices, _ := LoadPrices("../data/prices.json")
+
+	regions := make([]Region, len(regionInfos))
+	data := make([]*TestRecord, 0)
+
+	for i, info := range regionInfos {
+		regions[i] = Region{info.region, makeSurface(info.xcoord)}
+
+		// Spread the trees out over their regions
+		for _, tree := range generateSpeciesListFromRegion(
+			speciesdata, 200, regions[i]) {
+
+			tree.x += (rand.Float64() - 0.5) * 0.5 * surfaceScale
+			tree.y += (rand.Float64() - 0.5) * surfaceScale
+			data = append(data, tree)
+		}
+	}
+
+	summarize := func() (map[string]float64, error) {
+		context := &TestingContext{true, regionInfos[0], -1, data}
+
+		sums, _, err := CalcBenefitsWithData(
+			DefaultFactors, regions, context, RegionSRID, "", "", speciesdata,
+			l, nil, nil, prices, nil, nil)
+
+		return sums, err
+	}
+
+	expected, err := summarize()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workers, iterations := 8, 10
+	errs := make(chan error, workers*iterations)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < iterations; i++ {
+				area := makeSurface(float64(w))
+				pt := CreateGeosPtWithXY(
+					(float64(w)+0.5)*surfaceScale, surfaceScale)
+
+				if found, err := Intersects(area, pt); err != nil || !found {
+					errs <- fmt.Errorf("Expected worker %v's point in its area", w)
+				}
+
+				DestroyPt(pt)
+				GeosDestroy(area)
+
+				sums, err := summarize()
+
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				// The sums of each region are added in map order, so the
+				// last few bits can differ between runs
+				for factor, sum := range expected {
+					if math.Abs(sums[factor]-sum) > 1e-9*math.Abs(sum) {
+						errs <- fmt.Errorf("Expected %v, got %v for %v",
+							sum, sums[factor], factor)
+						break
+					}
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+}
+
+// Find the code of the region that contains a point by
+// checking every region, to compare with RegionIndex
+func linearRegionCode(regions []Region, x float64, y float64) (string, error) {
+	pt := CreateGeosPtWithXY(x, y)
+	defer DestroyPt(pt)
+
+	for _, region := range regions {
+		intersects, err := Intersects(region.geom, pt)
+
+		if err != nil {
+			return "", err
+		}
+
+		if intersects {
+			return region.Code, nil
+		}
+	}
+
+	return "", nil
+}
+
+// The linear scan over every region that CalcBenefitsWithData
+// used before RegionIndex, trying the last region found first
+func linearRegionScan(regions []Region, x float64, y float64, lastidx int) (int, error) {
+	pt := CreateGeosPtWithXY(x, y)
+	defer DestroyPt(pt)
+
+	for i := range regions {
+		calcidx := (i + lastidx) % len(regions)
+
+		intersects, err := Intersects(regions[calcidx].geom, pt)
+
+		if err != nil {
+			return lastidx, err
+		}
+
+		if intersects {
+			return calcidx, nil
+		}
+	}
+
+	return lastidx, nil
+}
+
+func benchmarkRegionLookup(n int, useIndex bool, b *testing.B) {
+	InitGeos()
+
+	regions := makeRegionGrid(n)
+	points := makeGridPoints(n, 10000)
+	index, _ := NewRegionIndex(regions)
+	ctx := NewGeomContext()
+	defer ctx.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		last := 0
+		for _, point := range points {
+			if useIndex {
+				if found, _ := index.regionForPoint(ctx, point[0], point[1], last); found >= 0 {
+					last = found
+				}
+			} else {
+				last, _ = linearRegionScan(regions, point[0], point[1], last)
+			}
+		}
+	}
+	b.StopTimer()
+
+	for _, r := range regions {
+		GeosDestroy(r.geom)
+	}
+}
+
+func BenchmarkRegionLookupLinear9(b *testing.B)   { benchmarkRegionLookup(3, false, b) }
+func BenchmarkRegionLookupIndex9(b *testing.B)    { benchmarkRegionLookup(3, true, b) }
+func BenchmarkRegionLookupLinear100(b *testing.B) { benchmarkRegionLookup(10, false, b) }
+func BenchmarkRegionLookupIndex100(b *testing.B)  { benchmarkRegionLookup(10, true, b) }
+
 func benchmarkTreesMultiRegionWithOverrides(
 	overrides map[string]map[int]string,
 	regioninfos []regioninfo,
@@ -251,6 +2227,7 @@ func benchmarkTreesMultiRegionWithOverrides(
 
 	l := LoadFiles("../data/")
 	speciesdata, _ := LoadSpeciesMap("../data/species.json")
+	prices, _ := LoadPrices("../data/prices.json")
 
 	targetLengthPerRegion := targetLength / len(regions)
 	data := make([]*TestRecord, 0)
@@ -268,9 +2245,9 @@ func benchmarkTreesMultiRegionWithOverrides(
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		testingContext.Reset()
-		data, err := CalcBenefitsWithData(
-			regions, testingContext, region, speciesdata,
-			l, overrides)
+		data, _, err := CalcBenefitsWithData(
+			DefaultFactors, regions, testingContext, RegionSRID, region, "", speciesdata,
+			l, nil, overrides, prices, nil, nil)
 
 		if err != nil {
 			b.Fatalf("error: %v", err)
@@ -0,0 +1,283 @@
+package eco
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An ordered set of factors and the units of their values
+//
+// Factor data (the []*Datafile of a region) and prices are
+// indexed by the position of each factor in the set they were
+// loaded with. A set made with Subset has fewer factors, and
+// benefits calculated with it are indexed by their position in
+// the subset, but it still reads the data and prices of the set
+// it came from
+type FactorSet struct {
+	names []string
+	units map[string]string
+	index map[string]int
+
+	// The position of each factor in the data, and the
+	// number of factors in the data
+	dataIndex []int
+	dataLen   int
+}
+
+// The global `Factors` and their units, which are the
+// factors of the shipped data
+var DefaultFactors = mustFactorSet(Factors, FactorUnits)
+
+// Factors that are the amount held by a tree rather than
+// an annual benefit. Their dollar value is what the stock
+// is worth, so it isn't added to the yearly "total"
+var StockFactors = map[string]bool{"co2_storage": true}
+
+// Make a set of factors, in the given order
+//
+// Units has the unit of each factor's values. Factors
+// without a unit have an empty unit and aren't converted
+// between unit systems
+func NewFactorSet(names []string, units map[string]string) (*FactorSet, error) {
+	set := &FactorSet{
+		names:     append([]string(nil), names...),
+		units:     make(map[string]string, len(names)),
+		index:     make(map[string]int, len(names)),
+		dataIndex: make([]int, len(names)),
+		dataLen:   len(names)}
+
+	for i, name := range names {
+		if name == "" {
+			return nil, errors.New("Factors need a name")
+		}
+
+		if _, found := set.index[name]; found {
+			return nil, errors.New(
+				fmt.Sprintf("Factor %v is in the set more than once", name))
+		}
+
+		set.index[name] = i
+		set.units[name] = units[name]
+		set.dataIndex[i] = i
+	}
+
+	return set, nil
+}
+
+func mustFactorSet(names []string, units map[string]string) *FactorSet {
+	set, err := NewFactorSet(names, units)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return set
+}
+
+// The names of the factors, in order. The slice
+// must not be modified
+func (set *FactorSet) Names() []string {
+	return set.names
+}
+
+// The number of factors in the set
+func (set *FactorSet) Len() int {
+	return len(set.names)
+}
+
+// Get the position of a factor in the set, or -1 if
+// the set doesn't have the factor
+func (set *FactorSet) Index(name string) int {
+	if i, found := set.index[name]; found {
+		return i
+	}
+
+	return -1
+}
+
+// Get the unit of a factor's values in the data
+func (set *FactorSet) Unit(name string) string {
+	return set.units[name]
+}
+
+// Get the factors with the given names, in the order of
+// this set. An empty list of names gives this set
+func (set *FactorSet) Subset(names []string) (*FactorSet, error) {
+	if len(names) == 0 {
+		return set, nil
+	}
+
+	positions := make([]int, 0, len(names))
+	seen := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		i := set.Index(name)
+
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf(
+				"Unknown factor %v, expected one of %v",
+				name, strings.Join(set.names, ", ")))
+		}
+
+		if seen[name] {
+			return nil, errors.New(
+				fmt.Sprintf("Factor %v is requested more than once", name))
+		}
+
+		seen[name] = true
+		positions = append(positions, i)
+	}
+
+	sort.Ints(positions)
+
+	subset := &FactorSet{
+		names:     make([]string, len(positions)),
+		units:     set.units,
+		index:     make(map[string]int, len(positions)),
+		dataIndex: make([]int, len(positions)),
+		dataLen:   set.dataLen}
+
+	for i, position := range positions {
+		name := set.names[position]
+
+		subset.names[i] = name
+		subset.index[name] = i
+		subset.dataIndex[i] = set.dataIndex[position]
+	}
+
+	return subset, nil
+}
+
+// Make a set with the factors of this set followed by the
+// factors of other that aren't in it. Both sets must be
+// complete sets of data, not subsets
+//
+// Returns an error if a factor has different units
+// in the sets
+func (set *FactorSet) Union(other *FactorSet) (*FactorSet, error) {
+	names := append([]string(nil), set.names...)
+	units := make(map[string]string, len(set.units)+len(other.units))
+
+	for name, unit := range set.units {
+		units[name] = unit
+	}
+
+	for _, name := range other.names {
+		if set.Index(name) >= 0 {
+			if set.Unit(name) != other.Unit(name) {
+				return nil, errors.New(fmt.Sprintf(
+					"Factor %v is in %v in one set and %v in the other",
+					name, set.Unit(name), other.Unit(name)))
+			}
+
+			continue
+		}
+
+		names = append(names, name)
+		units[name] = other.Unit(name)
+	}
+
+	return NewFactorSet(names, units)
+}
+
+// Determine if two sets have the same factors in the
+// same order
+func (set *FactorSet) Equal(other *FactorSet) bool {
+	if set.Len() != other.Len() || set.dataLen != other.dataLen {
+		return false
+	}
+
+	for i, name := range set.names {
+		if other.names[i] != name || other.dataIndex[i] != set.dataIndex[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the datafile of the ith factor of the set from the
+// factor data of a region, or nil if the region doesn't
+// have data for the factor
+//
+// Panics if the factor data wasn't loaded with the set this
+// set came from, since the factors would be mixed up
+func (set *FactorSet) datafile(factorData []*Datafile, i int) *Datafile {
+	if len(factorData) != set.dataLen {
+		panic(fmt.Sprintf("Expected factor data for %v factors, got %v",
+			set.dataLen, len(factorData)))
+	}
+
+	return factorData[set.dataIndex[i]]
+}
+
+// Index the factor data of a set (the []*Datafile of each
+// region) by the factors of another. Factors that aren't in
+// the set have nil data
+func (set *FactorSet) reindex(datafiles []*Datafile, to *FactorSet) []*Datafile {
+	reindexed := make([]*Datafile, to.dataLen)
+
+	for i, name := range set.names {
+		if j := to.Index(name); j >= 0 {
+			reindexed[to.dataIndex[j]] = datafiles[set.dataIndex[i]]
+		}
+	}
+
+	return reindexed
+}
+
+// Convert an array of factors into a map by
+// matching up their indicies
+func (set *FactorSet) ArrayToMap(factors []float64) map[string]float64 {
+	factormap := make(map[string]float64, len(set.names))
+
+	for i, factor := range set.names {
+		factormap[factor] = factors[i]
+	}
+
+	return factormap
+}
+
+// Convert an array of factor dollar values into a map
+// by matching up their indicies
+//
+// The map also contains a "total" key with the sum of
+// all of the factors except the StockFactors
+func (set *FactorSet) DollarArrayToMap(dollars []float64) map[string]float64 {
+	dollarmap := set.ArrayToMap(dollars)
+
+	total := 0.0
+	for i, value := range dollars {
+		if !StockFactors[set.names[i]] {
+			total += value
+		}
+	}
+
+	dollarmap["total"] = total
+
+	return dollarmap
+}
+
+// Calculate the dollar value of a set of factors
+//
+// Factors and dollarsum are indexed by the set, and prices
+// are indexed like the data (see LoadPrices). If there are
+// no prices (for instance, the region doesn't have any
+// pricing data) nothing is added
+//
+// The dollar values will be added to the dollarsum slice
+func (set *FactorSet) CalcDollars(
+	prices []float64,
+	factors []float64,
+	dollarsum []float64) {
+
+	if prices == nil {
+		return
+	}
+
+	for fidx, value := range factors {
+		dollarsum[fidx] += value * prices[set.dataIndex[fidx]]
+	}
+}
@@ -0,0 +1,312 @@
+package eco
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A GeoJSON geometry. Only points, polygons and
+// multipolygons are supported
+type GeoJSONGeometry struct {
+	Type        string
+	Coordinates json.RawMessage
+}
+
+// A GeoJSON feature. The id (a string or a number) and
+// properties are kept as raw JSON so they can be decoded
+// as needed
+type GeoJSONFeature struct {
+	Type       string
+	Id         json.RawMessage
+	Geometry   *GeoJSONGeometry
+	Properties json.RawMessage
+}
+
+// Get the id of a feature as a string. Returns an
+// empty string if the feature doesn't have an id
+func (f *GeoJSONFeature) IdString() string {
+	if f.Id == nil {
+		return ""
+	}
+
+	var id string
+
+	if err := json.Unmarshal(f.Id, &id); err == nil {
+		return id
+	}
+
+	return string(f.Id)
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string
+	Crs      *GeoJSONCrs
+	Features []*GeoJSONFeature
+}
+
+// A named coordinate reference system, as in the 2008
+// GeoJSON specification
+type GeoJSONCrs struct {
+	Type       string
+	Properties struct {
+		Name string
+	}
+}
+
+// Get the SRID of a named coordinate reference system, such
+// as "EPSG:3857" or "urn:ogc:def:crs:EPSG::4326"
+func (c *GeoJSONCrs) Srid() (int, error) {
+	name := c.Properties.Name
+
+	if c.Type != "name" {
+		return 0, errors.New(
+			fmt.Sprintf("Unsupported GeoJSON crs type %v", c.Type))
+	}
+
+	// The GeoJSON default, which is longitude and latitude
+	if strings.HasSuffix(name, "CRS84") {
+		return SRIDWGS84, nil
+	}
+
+	srid, err := strconv.Atoi(name[strings.LastIndex(name, ":")+1:])
+
+	if err != nil || !strings.Contains(name, "EPSG") {
+		return 0, errors.New(
+			fmt.Sprintf("Unsupported GeoJSON crs %v", name))
+	}
+
+	return srid, nil
+}
+
+// Parse a GeoJSON geometry. A feature can also be
+// given, in which case its geometry is used
+func ParseGeoJSONGeometry(data []byte) (*GeoJSONGeometry, error) {
+	feature := &GeoJSONFeature{}
+
+	if err := json.Unmarshal(data, feature); err != nil {
+		return nil, err
+	}
+
+	if feature.Type == "Feature" {
+		if feature.Geometry == nil {
+			return nil, errors.New("GeoJSON feature has no geometry")
+		}
+
+		return feature.Geometry, nil
+	}
+
+	geometry := &GeoJSONGeometry{}
+
+	if err := json.Unmarshal(data, geometry); err != nil {
+		return nil, err
+	}
+
+	return geometry, nil
+}
+
+// Get the coordinates of a point geometry
+func (g *GeoJSONGeometry) Point() (float64, float64, error) {
+	if g.Type != "Point" {
+		return 0, 0, errors.New(
+			fmt.Sprintf("Expected a GeoJSON Point, got %v", g.Type))
+	}
+
+	var coordinates []float64
+
+	if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+		return 0, 0, err
+	}
+
+	if len(coordinates) < 2 {
+		return 0, 0, errors.New("GeoJSON Point has too few coordinates")
+	}
+
+	return coordinates[0], coordinates[1], nil
+}
+
+// Reproject the geometry from one SRID to another (see
+// Reproject), checking each of its points (see CheckPoint)
+func (g *GeoJSONGeometry) Reproject(from int, to int) (*GeoJSONGeometry, error) {
+	var coordinates interface{}
+
+	if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+		return nil, err
+	}
+
+	coordinates, err := reprojectCoordinates(coordinates, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reprojected, err := json.Marshal(coordinates)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &GeoJSONGeometry{g.Type, reprojected}, nil
+}
+
+// Reproject the positions in a (possibly nested) array
+// of GeoJSON coordinates
+func reprojectCoordinates(coordinates interface{}, from int, to int) (interface{}, error) {
+	values, ok := coordinates.([]interface{})
+
+	if !ok {
+		return nil, errors.New("Invalid GeoJSON coordinates")
+	}
+
+	// Positions are arrays of numbers, everything
+	// else is an array of positions (or arrays of them)
+	if len(values) >= 2 {
+		x, xok := values[0].(float64)
+		y, yok := values[1].(float64)
+
+		if xok && yok {
+			if err := CheckPoint(x, y, from); err != nil {
+				return nil, err
+			}
+
+			x, y, err := Reproject(x, y, from, to)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return []interface{}{x, y}, nil
+		}
+	}
+
+	for i, value := range values {
+		reprojected, err := reprojectCoordinates(value, from, to)
+
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = reprojected
+	}
+
+	return values, nil
+}
+
+// Convert the geometry to WKT
+func (g *GeoJSONGeometry) WKT() (string, error) {
+	switch g.Type {
+	case "Point":
+		x, y, err := g.Point()
+
+		if err != nil {
+			return "", err
+		}
+
+		return "POINT (" + wktCoordinate([]float64{x, y}) + ")", nil
+
+	case "Polygon":
+		var rings [][][]float64
+
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return "", err
+		}
+
+		polygon, err := wktPolygon(rings)
+
+		if err != nil {
+			return "", err
+		}
+
+		return "POLYGON " + polygon, nil
+
+	case "MultiPolygon":
+		var polygons [][][][]float64
+
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return "", err
+		}
+
+		if len(polygons) == 0 {
+			return "", errors.New("GeoJSON MultiPolygon has no polygons")
+		}
+
+		parts := make([]string, len(polygons))
+
+		for i, rings := range polygons {
+			polygon, err := wktPolygon(rings)
+
+			if err != nil {
+				return "", err
+			}
+
+			parts[i] = polygon
+		}
+
+		return "MULTIPOLYGON (" + strings.Join(parts, ", ") + ")", nil
+	}
+
+	return "", errors.New(
+		fmt.Sprintf("Unsupported GeoJSON geometry type %v", g.Type))
+}
+
+func wktCoordinate(coordinate []float64) string {
+	return strconv.FormatFloat(coordinate[0], 'f', -1, 64) + " " +
+		strconv.FormatFloat(coordinate[1], 'f', -1, 64)
+}
+
+// Format the rings of a polygon as WKT, without the
+// geometry type
+func wktPolygon(rings [][][]float64) (string, error) {
+	if len(rings) == 0 {
+		return "", errors.New("GeoJSON Polygon has no rings")
+	}
+
+	parts := make([]string, len(rings))
+
+	for i, ring := range rings {
+		if len(ring) < 4 {
+			return "", errors.New(
+				"GeoJSON Polygon rings need at least 4 positions")
+		}
+
+		coordinates := make([]string, len(ring))
+
+		for j, coordinate := range ring {
+			if len(coordinate) < 2 {
+				return "", errors.New(
+					"GeoJSON position has too few coordinates")
+			}
+
+			coordinates[j] = wktCoordinate(coordinate)
+		}
+
+		parts[i] = "(" + strings.Join(coordinates, ", ") + ")"
+	}
+
+	return "(" + strings.Join(parts, ", ") + ")", nil
+}
+
+// Format a bounding box (minx, miny, maxx and maxy)
+// as a WKT polygon
+func BboxWKT(bbox []float64) (string, error) {
+	if len(bbox) != 4 {
+		return "", errors.New(
+			fmt.Sprintf("Expected a bounding box with 4 values, got %v",
+				len(bbox)))
+	}
+
+	minx, miny, maxx, maxy := bbox[0], bbox[1], bbox[2], bbox[3]
+
+	polygon, err := wktPolygon([][][]float64{[][]float64{
+		[]float64{minx, miny}, []float64{maxx, miny},
+		[]float64{maxx, maxy}, []float64{minx, maxy},
+		[]float64{minx, miny}}})
+
+	if err != nil {
+		return "", err
+	}
+
+	return "POLYGON " + polygon, nil
+}
@@ -1,5 +1,27 @@
+//go:build !nogeos
+// +build !nogeos
+
 package eco
 
+// The GEOS geometry backend (see geometry.go)
+//
+// This uses the reentrant (_r) GEOS API. A context handle
+// can only be used by one thread at a time, so a GeomContext
+// borrows one from a free list for a goroutine and gives it
+// back when it's closed. Loops that query many points (like
+// CalcBenefitsWithData) use one GeomContext throughout, and
+// the other functions borrow a context for each call.
+//
+// Geometries are shared between goroutines and only read,
+// but a prepared geometry builds indexes the first time it
+// is queried, so it can't be shared. Each context prepares
+// the geometries it is asked about and keeps them until the
+// geometry is destroyed, so concurrent queries against the
+// same region don't wait for each other. Contexts are never
+// finished, so their prepared geometries are kept for as
+// long as the geometries are. There are only ever as many
+// contexts as goroutines that have used GEOS at once.
+
 // #cgo LDFLAGS: -lgeos_c
 // #include <stdlib.h>
 // #include <geos_c.h>
@@ -7,38 +29,132 @@ import "C"
 
 import (
 	"errors"
+	"math"
+	"sync"
 	"unsafe"
 )
 
 type Geom struct {
-	geom   *C.struct_GEOSGeom_t
-	preped *C.struct_GEOSPrepGeom_t
+	geom *C.struct_GEOSGeom_t
+
+	// The bounding box, found when the geometry is read. Nil
+	// if the geometry is empty
+	env *envelope
 }
 
 type Point struct {
-	coordseqptr *C.struct_GEOSCoordSeq_t
-	pointptr    *C.struct_GEOSGeom_t
+	pointptr *C.struct_GEOSGeom_t
+}
+
+// A context handle and the geometries it has prepared
+//
+// The lock is held while the context is borrowed, so
+// GeosDestroy can wait for a context to be given back
+// before it frees the context's prepared geometry
+type geosContext struct {
+	handle   C.GEOSContextHandle_t
+	lock     sync.Mutex
+	prepared map[*C.struct_GEOSGeom_t]*C.struct_GEOSPrepGeom_t
+}
+
+// Every context, and the ones that aren't borrowed
+var contexts = struct {
+	sync.Mutex
+	all  []*geosContext
+	idle []*geosContext
+}{}
+
+func getContext() *geosContext {
+	var ctx *geosContext
+
+	contexts.Lock()
+
+	if n := len(contexts.idle); n > 0 {
+		ctx = contexts.idle[n-1]
+		contexts.idle = contexts.idle[:n-1]
+	} else {
+		ctx = &geosContext{
+			handle:   C.GEOS_init_r(),
+			prepared: make(map[*C.struct_GEOSGeom_t]*C.struct_GEOSPrepGeom_t)}
+
+		contexts.all = append(contexts.all, ctx)
+	}
+
+	contexts.Unlock()
+
+	ctx.lock.Lock()
+
+	return ctx
 }
 
-type Region struct {
-	Code string
-	geom Geom
+func putContext(ctx *geosContext) {
+	ctx.lock.Unlock()
+
+	contexts.Lock()
+	contexts.idle = append(contexts.idle, ctx)
+	contexts.Unlock()
+}
+
+// A borrowed GEOS context for a goroutine that makes many
+// point queries. It must be closed when it's done
+type GeomContext struct {
+	ctx *geosContext
+}
+
+func NewGeomContext() *GeomContext {
+	return &GeomContext{getContext()}
 }
 
-// initialize the geos system
-// this must be called before any other geometry functions
-var didInit = false
+// Give the context back
+func (c *GeomContext) Close() {
+	putContext(c.ctx)
+	c.ctx = nil
+}
+
+// Get the context's prepared version of a geometry,
+// preparing it the first time, or nil if it can't be
+// prepared
+func (ctx *geosContext) prepare(geom *C.struct_GEOSGeom_t) *C.struct_GEOSPrepGeom_t {
+	if preped, found := ctx.prepared[geom]; found {
+		return preped
+	}
+
+	preped := C.GEOSPrepare_r(ctx.handle, geom)
 
-func InitGeos() {
-	if !didInit {
-		C.initGEOS(nil, nil)
+	if preped != nil {
+		ctx.prepared[geom] = preped
 	}
-	didInit = true
+
+	return preped
 }
 
+// Context handles are created as they are needed, so
+// there is nothing to set up. This is kept so that callers
+// don't depend on the backend
+func InitGeos() {}
+
 // Determine if p intersects g
 func Intersects(g Geom, p Point) (bool, error) {
-	r := C.GEOSPreparedContains(g.preped, p.pointptr)
+	c := NewGeomContext()
+	defer c.Close()
+
+	return c.Intersects(g, p)
+}
+
+// Determine if p intersects g
+func (c *GeomContext) Intersects(g Geom, p Point) (bool, error) {
+	if g.geom == nil || p.pointptr == nil {
+		return false, errors.New("Invalid geometry")
+	}
+
+	ctx := c.ctx
+	preped := ctx.prepare(g.geom)
+
+	if preped == nil {
+		return false, errors.New("Failed to prepare geometry")
+	}
+
+	r := C.GEOSPreparedContains_r(ctx.handle, preped, p.pointptr)
 
 	if r == 1 {
 		return true, nil
@@ -52,69 +168,304 @@ func Intersects(g Geom, p Point) (bool, error) {
 	return false, errors.New("C call failed")
 }
 
+// Determine if g intersects another geometry
+func IntersectsGeom(g Geom, other Geom) (bool, error) {
+	if g.geom == nil || other.geom == nil {
+		return false, errors.New("Invalid geometry")
+	}
+
+	ctx := getContext()
+	defer putContext(ctx)
+
+	preped := ctx.prepare(g.geom)
+
+	if preped == nil {
+		return false, errors.New("Failed to prepare geometry")
+	}
+
+	r := C.GEOSPreparedIntersects_r(ctx.handle, preped, other.geom)
+
+	if r == 1 {
+		return true, nil
+	}
+
+	if r == 0 {
+		return false, nil
+	}
+
+	return false, errors.New("C call failed")
+}
+
+// Check a geometry read by GEOS and find its envelope,
+// taking ownership of it
+//
+// GEOS caches the envelopes of a geometry and its parts
+// the first time they are needed. Preparing the geometry
+// here fills those caches before the geometry is shared,
+// so other goroutines only ever read it
+func prepareGeom(ctx *geosContext, geom *C.struct_GEOSGeom_t) (Geom, error) {
+	if ctx.prepare(geom) == nil {
+		C.GEOSGeom_destroy_r(ctx.handle, geom)
+		return Geom{}, errors.New("Failed to prepare geometry")
+	}
+
+	env, err := geomEnvelope(ctx.handle, geom)
+
+	if err != nil {
+		C.GEOSPreparedGeom_destroy_r(ctx.handle, ctx.prepared[geom])
+		delete(ctx.prepared, geom)
+		C.GEOSGeom_destroy_r(ctx.handle, geom)
+		return Geom{}, err
+	}
+
+	return Geom{geom, env}, nil
+}
+
+// Find the bounding box of a geometry, or nil if it's empty
+//
+// GEOSGeom_getXMin_r and friends need GEOS 3.7, so this reads
+// the corners from the coordinates of GEOSEnvelope_r, which
+// is a polygon, or a point if the geometry is a single point
+func geomEnvelope(handle C.GEOSContextHandle_t, geom *C.struct_GEOSGeom_t) (*envelope, error) {
+	envgeom := C.GEOSEnvelope_r(handle, geom)
+
+	if envgeom == nil {
+		return nil, errors.New("C call failed")
+	}
+
+	defer C.GEOSGeom_destroy_r(handle, envgeom)
+
+	if C.GEOSisEmpty_r(handle, envgeom) != 0 {
+		return nil, nil
+	}
+
+	ring := envgeom
+
+	if C.GEOSGeomTypeId_r(handle, envgeom) == C.GEOS_POLYGON {
+		ring = C.GEOSGetExteriorRing_r(handle, envgeom)
+	}
+
+	coords := C.GEOSGeom_getCoordSeq_r(handle, ring)
+
+	var size C.uint
+
+	if coords == nil || C.GEOSCoordSeq_getSize_r(handle, coords, &size) == 0 || size == 0 {
+		return nil, errors.New("C call failed")
+	}
+
+	env := &envelope{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+
+	for i := C.uint(0); i < size; i++ {
+		var x, y C.double
+
+		if C.GEOSCoordSeq_getX_r(handle, coords, i, &x) == 0 ||
+			C.GEOSCoordSeq_getY_r(handle, coords, i, &y) == 0 {
+
+			return nil, errors.New("C call failed")
+		}
+
+		env.minx = math.Min(env.minx, float64(x))
+		env.miny = math.Min(env.miny, float64(y))
+		env.maxx = math.Max(env.maxx, float64(x))
+		env.maxy = math.Max(env.maxy, float64(y))
+	}
+
+	return env, nil
+}
+
+// Create a new geometry from the given wkt string,
+// returning an error if the wkt is invalid
+//
+// Like MakeGeosGeom, the caller is responsible for
+// destroying the returned geometry with "GeosDestroy"
+func ParseGeosGeom(wkt string) (Geom, error) {
+	ctx := getContext()
+	defer putContext(ctx)
+
+	reader := C.GEOSWKTReader_create_r(ctx.handle)
+
+	cwkt := C.CString(wkt)
+	geom := C.GEOSWKTReader_read_r(ctx.handle, reader, cwkt)
+
+	C.free(unsafe.Pointer(cwkt))
+	C.GEOSWKTReader_destroy_r(ctx.handle, reader)
+
+	if geom == nil {
+		return Geom{}, errors.New("Invalid WKT geometry")
+	}
+
+	return prepareGeom(ctx, geom)
+}
+
+// Create a new geometry from WKB (or PostGIS EWKB),
+// returning an error if the wkb is invalid
+//
+// Like MakeGeosGeom, the caller is responsible for
+// destroying the returned geometry with "GeosDestroy"
+func ParseWKBGeom(wkb []byte) (Geom, error) {
+	if len(wkb) == 0 {
+		return Geom{}, errors.New("Invalid WKB geometry")
+	}
+
+	ctx := getContext()
+	defer putContext(ctx)
+
+	reader := C.GEOSWKBReader_create_r(ctx.handle)
+
+	geom := C.GEOSWKBReader_read_r(ctx.handle, reader,
+		(*C.uchar)(unsafe.Pointer(&wkb[0])), C.size_t(len(wkb)))
+
+	C.GEOSWKBReader_destroy_r(ctx.handle, reader)
+
+	if geom == nil {
+		return Geom{}, errors.New("Invalid WKB geometry")
+	}
+
+	return prepareGeom(ctx, geom)
+}
+
 // Create a new geometry from the given
 // wkt string
 //
 // The geometry will be 'prepared' to make
-// intersects/contains queries faster
+// intersects/contains queries faster. Invalid
+// geometries don't contain or intersect anything,
+// use ParseGeosGeom to check the wkt
 //
 // The caller is responsible for destroying
 // the returned geometry with "GeosDestroy"
 func MakeGeosGeom(wkt string) Geom {
-	reader := C.GEOSWKTReader_create()
+	g, _ := ParseGeosGeom(wkt)
+	return g
+}
 
-	cwkt := C.CString(wkt)
-	geom := C.GEOSWKTReader_read(reader, cwkt)
+// The caller is responsible for destroying
+// the returned geometry with "DestroyPt"
+func CreateGeosPtWithXY(x float64, y float64) Point {
+	c := NewGeomContext()
+	defer c.Close()
 
-	prepgeom := C.GEOSPrepare(geom)
+	return c.CreatePt(x, y)
+}
 
-	C.free(unsafe.Pointer(cwkt))
-	C.GEOSWKTReader_destroy(reader)
+// Like CreateGeosPtWithXY. The point can be destroyed
+// with any context
+func (c *GeomContext) CreatePt(x float64, y float64) Point {
+	ctx := c.ctx
+	coordseqptr := C.GEOSCoordSeq_create_r(ctx.handle, 1, 2)
+
+	if coordseqptr == nil {
+		return Point{}
+	}
 
-	return Geom{geom, prepgeom}
+	C.GEOSCoordSeq_setX_r(ctx.handle, coordseqptr, 0, C.double(x))
+	C.GEOSCoordSeq_setY_r(ctx.handle, coordseqptr, 0, C.double(y))
+
+	// The point owns the coordinate sequence once it has
+	// been created, and frees it when it is destroyed
+	pointptr := C.GEOSGeom_createPoint_r(ctx.handle, coordseqptr)
+
+	if pointptr == nil {
+		C.GEOSCoordSeq_destroy_r(ctx.handle, coordseqptr)
+	}
+
+	return Point{pointptr}
 }
 
-// The caller is responsible for destroying
-// the returned geometry with "DestroyPt"
-func CreateGeosPtWithXY(x float64, y float64) Point {
-	coordseqptr := C.GEOSCoordSeq_create(1, 2)
+// Get the bounding box of a geometry as minx,
+// miny, maxx and maxy
+func Envelope(g Geom) (float64, float64, float64, float64, error) {
+	if g.geom == nil {
+		return 0, 0, 0, 0, errors.New("Invalid geometry")
+	}
 
-	C.GEOSCoordSeq_setX(coordseqptr, 0, C.double(x))
-	C.GEOSCoordSeq_setY(coordseqptr, 0, C.double(y))
+	if g.env == nil {
+		return 0, 0, 0, 0, errors.New("Empty geometry")
+	}
 
-	pointptr := C.GEOSGeom_createPoint(coordseqptr)
+	e := g.env
 
-	return Point{coordseqptr, pointptr}
+	return e.minx, e.miny, e.maxx, e.maxy, nil
 }
 
 func GetXYOnSurface(g Geom) (float64, float64) {
-	pt := C.GEOSGetCentroid(g.geom)
+	ctx := getContext()
+	defer putContext(ctx)
+
+	pt := C.GEOSGetCentroid_r(ctx.handle, g.geom)
+
+	if pt == nil {
+		panic("C call failed")
+	}
+
+	defer C.GEOSGeom_destroy_r(ctx.handle, pt)
 
 	var x C.double
 	var y C.double
 
-	coord := C.GEOSGeom_getCoordSeq(pt)
+	coord := C.GEOSGeom_getCoordSeq_r(ctx.handle, pt)
 
-	err := C.GEOSCoordSeq_getX(coord, 0, &x)
+	err := C.GEOSCoordSeq_getX_r(ctx.handle, coord, 0, &x)
 
-	if err == -1 {
+	if err == 0 {
 		panic(err)
 	}
 
-	err = C.GEOSCoordSeq_getY(coord, 0, &y)
+	err = C.GEOSCoordSeq_getY_r(ctx.handle, coord, 0, &y)
 
-	if err == -1 {
+	if err == 0 {
 		panic(err)
 	}
 
 	return float64(x), float64(y)
 }
 
+// Destroy a geometry and every context's prepared version
+// of it. Contexts that are in use are waited for, so the
+// geometry mustn't be used while it's being destroyed
 func GeosDestroy(geom Geom) {
-	C.GEOSPreparedGeom_destroy(geom.preped)
-	C.GEOSGeom_destroy(geom.geom)
+	if geom.geom == nil {
+		return
+	}
+
+	// Contexts created after this can't have prepared the
+	// geometry, since it isn't being used
+	contexts.Lock()
+	all := append([]*geosContext(nil), contexts.all...)
+	contexts.Unlock()
+
+	for _, ctx := range all {
+		ctx.lock.Lock()
+
+		if preped, found := ctx.prepared[geom.geom]; found {
+			C.GEOSPreparedGeom_destroy_r(ctx.handle, preped)
+			delete(ctx.prepared, geom.geom)
+		}
+
+		ctx.lock.Unlock()
+	}
+
+	ctx := getContext()
+	defer putContext(ctx)
+
+	C.GEOSGeom_destroy_r(ctx.handle, geom.geom)
 }
 
+// Destroy a point and its coordinate sequence
 func DestroyPt(p Point) {
-	C.GEOSGeom_destroy(p.pointptr)
+	if p.pointptr == nil {
+		return
+	}
+
+	c := NewGeomContext()
+	defer c.Close()
+
+	c.DestroyPt(p)
+}
+
+// Like DestroyPt
+func (c *GeomContext) DestroyPt(p Point) {
+	if p.pointptr != nil {
+		C.GEOSGeom_destroy_r(c.ctx.handle, p.pointptr)
+	}
 }
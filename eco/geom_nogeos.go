@@ -0,0 +1,117 @@
+//go:build nogeos
+// +build nogeos
+
+package eco
+
+// The pure Go geometry backend (see geometry.go)
+
+import (
+	"errors"
+)
+
+type Geom struct {
+	planar *planarGeometry
+}
+
+type Point struct {
+	x float64
+	y float64
+}
+
+// There is nothing to set up for the pure Go backend
+func InitGeos() {}
+
+// There are no contexts in the pure Go backend, so
+// these just call the plain functions
+type GeomContext struct{}
+
+func NewGeomContext() *GeomContext { return &GeomContext{} }
+
+func (c *GeomContext) Close() {}
+
+func (c *GeomContext) Intersects(g Geom, p Point) (bool, error) {
+	return Intersects(g, p)
+}
+
+func (c *GeomContext) CreatePt(x float64, y float64) Point {
+	return CreateGeosPtWithXY(x, y)
+}
+
+func (c *GeomContext) DestroyPt(p Point) {}
+
+// Determine if p intersects g
+func Intersects(g Geom, p Point) (bool, error) {
+	if g.planar == nil {
+		return false, errors.New("Invalid geometry")
+	}
+
+	return g.planar.contains(p.x, p.y), nil
+}
+
+// Determine if g intersects another geometry
+func IntersectsGeom(g Geom, other Geom) (bool, error) {
+	if g.planar == nil || other.planar == nil {
+		return false, errors.New("Invalid geometry")
+	}
+
+	return g.planar.intersects(other.planar), nil
+}
+
+// Create a new geometry from the given wkt string,
+// returning an error if the wkt is invalid
+func ParseGeosGeom(wkt string) (Geom, error) {
+	planar, err := parsePlanarWKT(wkt)
+
+	if err != nil {
+		return Geom{}, err
+	}
+
+	return Geom{planar}, nil
+}
+
+// Create a new geometry from WKB (or PostGIS EWKB),
+// returning an error if the wkb is invalid
+func ParseWKBGeom(wkb []byte) (Geom, error) {
+	planar, err := parsePlanarWKB(wkb)
+
+	if err != nil {
+		return Geom{}, err
+	}
+
+	return Geom{planar}, nil
+}
+
+// Create a new geometry from the given wkt string
+//
+// Invalid geometries don't contain or intersect anything.
+// Use ParseGeosGeom to check the wkt
+func MakeGeosGeom(wkt string) Geom {
+	g, _ := ParseGeosGeom(wkt)
+	return g
+}
+
+func CreateGeosPtWithXY(x float64, y float64) Point {
+	return Point{x, y}
+}
+
+// Get the bounding box of a geometry as minx,
+// miny, maxx and maxy
+func Envelope(g Geom) (float64, float64, float64, float64, error) {
+	if g.planar == nil || len(g.planar.polygons) == 0 {
+		return 0, 0, 0, 0, errors.New("Empty geometry")
+	}
+
+	e := g.planar.env
+
+	return e.minx, e.miny, e.maxx, e.maxy, nil
+}
+
+func GetXYOnSurface(g Geom) (float64, float64) {
+	return g.planar.centroid()
+}
+
+// Geometries and points are garbage collected, so
+// these don't need to do anything
+func GeosDestroy(geom Geom) {}
+
+func DestroyPt(p Point) {}
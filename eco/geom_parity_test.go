@@ -0,0 +1,302 @@
+//go:build !nogeos
+// +build !nogeos
+
+package eco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// These tests check that the pure Go geometry backend
+// (planar.go) agrees with GEOS. The service doesn't ship any
+// region geometries so most use synthetic shapes that cover
+// the cases region boundaries have: concave edges, holes and
+// multiple parts. TestPlanarParityRegions also checks the
+// regions of a data directory (see parityRegionsEnv)
+var parityShapes = []string{
+	"POLYGON ((0 0, 10 0, 10 10, 0 10, 0 0))",
+
+	// A U shape, which is concave
+	"POLYGON ((0 0, 30 0, 30 30, 20 30, 20 10, 10 10, 10 30, 0 30, 0 0))",
+
+	// A square with a square hole
+	"POLYGON ((0 0, 40 0, 40 40, 0 40, 0 0), (10 10, 30 10, 30 30, 10 30, 10 10))",
+
+	// Two triangles, one of which is inside the hole of the other
+	"MULTIPOLYGON (((0 0, 50 0, 25 45, 0 0), (15 5, 35 5, 25 25, 15 5)), " +
+		"((20 8, 30 8, 25 18, 20 8)))",
+
+	"POLYGON ((-73.5 40.1, -73.1 40.3, -72.8 40.9, -73.4 41.2, -73.5 40.1))",
+}
+
+func parityPlanar(t *testing.T, wkt string) *planarGeometry {
+	planar, err := parsePlanarWKT(wkt)
+
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %v", wkt, err)
+	}
+
+	return planar
+}
+
+// The region geometries TestPlanarParityRegions checks, as
+// the path of a regions.geojson (see RegionFiles), such as
+// an export of the i-Tree regions of an OpenTreeMap database
+const parityRegionsEnv = "OTM_ECO_PARITY_REGIONS"
+
+// Check that random points in (and a little around) each
+// shape are in it for both backends
+func checkParityIntersects(t *testing.T, shapes []string, samples int) {
+	random := rand.New(rand.NewSource(1))
+
+	for _, wkt := range shapes {
+		geom := MakeGeosGeom(wkt)
+		planar := parityPlanar(t, wkt)
+		e := planar.env
+
+		// Sample a little outside the envelope too
+		w, h := e.maxx-e.minx, e.maxy-e.miny
+
+		for i := 0; i < samples; i++ {
+			x := e.minx - w/10 + random.Float64()*w*1.2
+			y := e.miny - h/10 + random.Float64()*h*1.2
+
+			pt := CreateGeosPtWithXY(x, y)
+			expected, err := Intersects(geom, pt)
+			DestroyPt(pt)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if planar.contains(x, y) != expected {
+				t.Fatalf("Expected contains(%v, %v) to be %v for %v",
+					x, y, expected, wkt)
+			}
+		}
+
+		GeosDestroy(geom)
+	}
+}
+
+func TestPlanarParityIntersects(t *testing.T) {
+	InitGeos()
+	checkParityIntersects(t, parityShapes, 2000)
+}
+
+func TestPlanarParityIntersectsGeom(t *testing.T) {
+	InitGeos()
+
+	probes := append([]string{
+		// Inside the hole of the third shape, and
+		// crossing the edge of its hole
+		"POLYGON ((12 12, 18 12, 18 18, 12 18, 12 12))",
+		"POLYGON ((5 5, 15 5, 15 15, 5 15, 5 5))",
+
+		// Far away from everything
+		"POLYGON ((100 100, 110 100, 110 110, 100 110, 100 100))",
+
+		// Surrounding everything
+		"POLYGON ((-1000 -1000, 1000 -1000, 1000 1000, -1000 1000, -1000 -1000))",
+	}, parityShapes...)
+
+	for _, wkt := range parityShapes {
+		geom := MakeGeosGeom(wkt)
+		planar := parityPlanar(t, wkt)
+
+		for _, probe := range probes {
+			other := MakeGeosGeom(probe)
+
+			expected, err := IntersectsGeom(geom, other)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if planar.intersects(parityPlanar(t, probe)) != expected {
+				t.Fatalf("Expected %v intersects %v to be %v",
+					wkt, probe, expected)
+			}
+
+			GeosDestroy(other)
+		}
+
+		GeosDestroy(geom)
+	}
+}
+
+// Check that the envelope and centroid of each shape are
+// the same for both backends
+func checkParityEnvelopeAndCentroid(t *testing.T, shapes []string) {
+	for _, wkt := range shapes {
+		geom := MakeGeosGeom(wkt)
+		planar := parityPlanar(t, wkt)
+
+		minx, miny, maxx, maxy, err := Envelope(geom)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (envelope{minx, miny, maxx, maxy}) != planar.env {
+			t.Fatalf("Expected envelope %v for %v, got %v",
+				envelope{minx, miny, maxx, maxy}, wkt, planar.env)
+		}
+
+		x, y := GetXYOnSurface(geom)
+		px, py := planar.centroid()
+
+		// Region coordinates are in meters, so compare centroids
+		// relative to the size of the shape
+		tolerance := 1e-9 * math.Max(1, math.Max(
+			planar.env.maxx-planar.env.minx, planar.env.maxy-planar.env.miny))
+
+		if math.Abs(x-px) > tolerance || math.Abs(y-py) > tolerance {
+			t.Fatalf("Expected centroid %v, %v for %v, got %v, %v",
+				x, y, wkt, px, py)
+		}
+
+		GeosDestroy(geom)
+	}
+}
+
+func TestPlanarParityEnvelopeAndCentroid(t *testing.T) {
+	InitGeos()
+	checkParityEnvelopeAndCentroid(t, parityShapes)
+}
+
+// Compare the backends on real region boundaries, which have
+// far more vertices than the synthetic shapes
+func TestPlanarParityRegions(t *testing.T) {
+	path := os.Getenv(parityRegionsEnv)
+
+	if path == "" {
+		t.Skipf("Set %v to a regions.geojson to check real regions",
+			parityRegionsEnv)
+	}
+
+	InitGeos()
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collection := &GeoJSONFeatureCollection{}
+
+	if err = json.Unmarshal(data, collection); err != nil {
+		t.Fatal(err)
+	}
+
+	srid := SRIDWGS84
+
+	if collection.Crs != nil {
+		if srid, err = collection.Crs.Srid(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shapes := make([]string, 0, len(collection.Features))
+
+	for _, feature := range collection.Features {
+		geometry, err := feature.Geometry.Reproject(srid, RegionSRID)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wkt, err := geometry.WKT()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shapes = append(shapes, wkt)
+	}
+
+	if len(shapes) == 0 {
+		t.Fatalf("Expected regions in %v", path)
+	}
+
+	checkParityIntersects(t, shapes, 500)
+	checkParityEnvelopeAndCentroid(t, shapes)
+}
+
+// Encode a polygon as little endian WKB, with a PostGIS SRID
+// when srid isn't zero
+func makeWKBPolygon(rings [][][2]float64, srid uint32) []byte {
+	buf := &bytes.Buffer{}
+	kind := uint32(wkbPolygon)
+
+	if srid != 0 {
+		kind |= 0x20000000
+	}
+
+	buf.WriteByte(1)
+	binary.Write(buf, binary.LittleEndian, kind)
+
+	if srid != 0 {
+		binary.Write(buf, binary.LittleEndian, srid)
+	}
+
+	binary.Write(buf, binary.LittleEndian, uint32(len(rings)))
+
+	for _, ring := range rings {
+		binary.Write(buf, binary.LittleEndian, uint32(len(ring)))
+		binary.Write(buf, binary.LittleEndian, ring)
+	}
+
+	return buf.Bytes()
+}
+
+func TestPlanarParityWKB(t *testing.T) {
+	InitGeos()
+
+	rings := [][][2]float64{
+		{{0, 0}, {40, 0}, {40, 40}, {0, 40}, {0, 0}},
+		{{10, 10}, {30, 10}, {30, 30}, {10, 30}, {10, 10}}}
+
+	for _, srid := range []uint32{0, RegionSRID} {
+		wkb := makeWKBPolygon(rings, srid)
+
+		geom, err := ParseWKBGeom(wkb)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		planar, err := parsePlanarWKB(wkb)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range [][2]float64{{5, 5}, {20, 20}, {35, 20}, {50, 50}} {
+			pt := CreateGeosPtWithXY(p[0], p[1])
+			expected, err := Intersects(geom, pt)
+			DestroyPt(pt)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if planar.contains(p[0], p[1]) != expected {
+				t.Fatalf("Expected contains(%v) to be %v", p, expected)
+			}
+		}
+
+		GeosDestroy(geom)
+	}
+
+	if _, err := parsePlanarWKB(makeWKBPolygon(rings, 0)[:30]); err == nil {
+		t.Fatal("Expected an error for truncated WKB")
+	}
+}
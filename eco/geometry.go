@@ -0,0 +1,35 @@
+package eco
+
+// Geometry backends
+//
+// Region geometries and the points of trees are handled by one
+// of two backends, chosen at build time. By default geom.go uses
+// GEOS through cgo. Building with the "nogeos" tag uses the pure
+// Go backend in geom_nogeos.go instead, which doesn't need libgeos
+// and can be cross compiled and statically linked.
+//
+// Both backends provide the same Geom and Point types and the
+// same functions:
+//
+//   InitGeos                   set up the backend
+//   MakeGeosGeom, ParseGeosGeom,
+//   ParseWKBGeom               parse and prepare a geometry
+//   CreateGeosPtWithXY         create a point
+//   Intersects                 prepared point in polygon test
+//   IntersectsGeom             prepared geometry intersection test
+//   Envelope                   bounding box of a geometry
+//   GetXYOnSurface             centroid of a geometry
+//   GeosDestroy, DestroyPt     free a geometry or point
+//
+// GeomContext has CreatePt, Intersects and DestroyPt methods for
+// loops that query many points from one goroutine. With GEOS it
+// holds one context handle from NewGeomContext until Close, so
+// the loop doesn't borrow a context for every call.
+//
+// The pure Go backend only supports polygons and multipolygons,
+// which is all that region geometries and areas of interest use
+
+type Region struct {
+	Code string
+	geom Geom
+}
@@ -0,0 +1,189 @@
+package eco
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Growth files have tree ages (in years) as breaks and the
+// average diameter (in centimeters) of each species at those
+// ages as values
+const growthFactor = "dbh_by_age_class"
+
+// Load the growth data files
+//
+// the growth files are stored in the format:
+// output__<regioncode>__dbh_by_age_class.csv
+//
+// The returned map has region codes as keys and the
+// growth datafile for that region as values
+//
+// Errors are returned like ReadDataFiles
+func ReadGrowthFiles(basePath string) (map[string]*Datafile, error) {
+	return readGrowthFiles(os.DirFS(basePath), basePath)
+}
+
+func readGrowthFiles(fsys fs.FS, basePath string) (map[string]*Datafile, error) {
+	names, err := listDataFiles(fsys, basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]*Datafile)
+	errs := DataErrors{}
+
+	for _, name := range names {
+		if name.factor != growthFactor {
+			continue
+		}
+
+		datafile, err := name.read()
+
+		if err != nil {
+			errs = appendDataErrors(errs, err)
+			continue
+		}
+
+		m[name.region] = datafile
+	}
+
+	return m, errs.err()
+}
+
+// Like ReadGrowthFiles, but panics if the files can't be loaded
+func LoadGrowthFiles(basePath string) map[string]*Datafile {
+	m, err := ReadGrowthFiles(basePath)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// Get the growth curve for a species as a list of ages and
+// diameters. The curve starts at the origin since a newly
+// planted tree has neither age nor diameter
+func growthCurve(
+	growth *Datafile, itreecode string) ([]float64, []float64, error) {
+
+	if growth == nil {
+		return nil, nil, errors.New("No growth data is available")
+	}
+
+	values := growth.Values[itreecode]
+
+	if len(values) == 0 {
+		return nil, nil, errors.New(
+			fmt.Sprintf("No growth data is available for %v", itreecode))
+	}
+
+	ages := append([]float64{0.0}, growth.Breaks...)
+	diameters := append([]float64{0.0}, values...)
+
+	return ages, diameters, nil
+}
+
+// Linearly interpolate y at x along the curve given by xs
+// and ys, which must be sorted by x. Values past the end
+// of the curve are extrapolated from the last segment
+func interpolateCurve(xs []float64, ys []float64, x float64) float64 {
+	i := 1
+	for i < len(xs)-1 && x > xs[i] {
+		i++
+	}
+
+	dx := xs[i] - xs[i-1]
+
+	if dx == 0 {
+		return ys[i]
+	}
+
+	m := (ys[i] - ys[i-1]) / dx
+
+	return ys[i-1] + m*(x-xs[i-1])
+}
+
+// Calculate the diameter (in centimeters) of a tree at
+// the given age (in years)
+//
+// Ages past the end of the growth data are extrapolated
+// using the growth rate of the oldest age class
+func DiameterAtAge(
+	growth *Datafile, itreecode string, age float64) (float64, error) {
+
+	ages, diameters, err := growthCurve(growth, itreecode)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return interpolateCurve(ages, diameters, age), nil
+}
+
+// Estimate the age (in years) of a tree from its
+// diameter (in centimeters)
+//
+// Growth curves can level off, so the youngest age
+// that reaches the diameter is used
+func AgeForDiameter(
+	growth *Datafile, itreecode string, diameter float64) (float64, error) {
+
+	ages, diameters, err := growthCurve(growth, itreecode)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Walk the curve to find the first segment that
+	// reaches the diameter. If no segment does we
+	// extrapolate from the last one that grows
+	i := 1
+	lastGrowing := 0
+	for ; i < len(ages); i++ {
+		if diameters[i] > diameters[i-1] {
+			lastGrowing = i
+		}
+
+		if diameters[i] >= diameter {
+			break
+		}
+	}
+
+	if i == len(ages) {
+		if lastGrowing == 0 {
+			return 0, errors.New(
+				fmt.Sprintf("Growth data for %v never increases", itreecode))
+		}
+
+		i = lastGrowing
+	}
+
+	return interpolateCurve(diameters[i-1:i+1], ages[i-1:i+1], diameter), nil
+}
+
+// Project the diameter (in centimeters) of a tree for each year
+// of a scenario from its age (in years) at the start
+//
+// The first element is the diameter at the given age
+func ProjectDiameters(
+	growth *Datafile, itreecode string,
+	age float64, years int) ([]float64, error) {
+
+	ages, diameters, err := growthCurve(growth, itreecode)
+
+	if err != nil {
+		return nil, err
+	}
+
+	projected := make([]float64, years)
+
+	for i := range projected {
+		projected[i] = interpolateCurve(ages, diameters, age+float64(i))
+	}
+
+	return projected, nil
+}
@@ -0,0 +1,208 @@
+package eco
+
+import (
+	"math"
+)
+
+// A bounding box
+type envelope struct {
+	minx, miny, maxx, maxy float64
+}
+
+func (e envelope) contains(x float64, y float64) bool {
+	return x >= e.minx && x <= e.maxx && y >= e.miny && y <= e.maxy
+}
+
+// A grid index over the envelopes of a set of regions
+//
+// Each cell of the grid lists the regions whose envelopes
+// overlap it, so finding the region of a point only tests
+// the polygons of the regions that could contain it. The
+// index doesn't change once it is built, so it can be
+// shared between goroutines
+type RegionIndex struct {
+	regions   []Region
+	envelopes []envelope
+
+	bounds       envelope
+	cols, rows   int
+	cellw, cellh float64
+	cells        [][]int
+}
+
+// Build an index over the given regions
+//
+// The grid has about four cells for every region, which keeps
+// the number of candidates for each point small without
+// using much memory
+func NewRegionIndex(regions []Region) (*RegionIndex, error) {
+	index := &RegionIndex{
+		regions:   regions,
+		envelopes: make([]envelope, len(regions)),
+		bounds:    envelope{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}}
+
+	for i, region := range regions {
+		minx, miny, maxx, maxy, err := Envelope(region.geom)
+
+		if err != nil {
+			return nil, err
+		}
+
+		index.envelopes[i] = envelope{minx, miny, maxx, maxy}
+
+		index.bounds.minx = math.Min(index.bounds.minx, minx)
+		index.bounds.miny = math.Min(index.bounds.miny, miny)
+		index.bounds.maxx = math.Max(index.bounds.maxx, maxx)
+		index.bounds.maxy = math.Max(index.bounds.maxy, maxy)
+	}
+
+	if len(regions) == 0 {
+		return index, nil
+	}
+
+	size := 2 * int(math.Ceil(math.Sqrt(float64(len(regions)))))
+
+	index.cols, index.rows = size, size
+	index.cellw = (index.bounds.maxx - index.bounds.minx) / float64(size)
+	index.cellh = (index.bounds.maxy - index.bounds.miny) / float64(size)
+	index.cells = make([][]int, size*size)
+
+	for i, e := range index.envelopes {
+		mincol, minrow := index.cell(e.minx, e.miny)
+		maxcol, maxrow := index.cell(e.maxx, e.maxy)
+
+		for row := minrow; row <= maxrow; row++ {
+			for col := mincol; col <= maxcol; col++ {
+				cell := row*index.cols + col
+				index.cells[cell] = append(index.cells[cell], i)
+			}
+		}
+	}
+
+	return index, nil
+}
+
+// Get the column and row of the cell containing a point,
+// clamped to the grid
+func (index *RegionIndex) cell(x float64, y float64) (int, int) {
+	clamp := func(i int, size int) int {
+		if i < 0 {
+			return 0
+		}
+
+		if i >= size {
+			return size - 1
+		}
+
+		return i
+	}
+
+	col, row := 0, 0
+
+	if index.cellw > 0 {
+		col = clamp(int((x-index.bounds.minx)/index.cellw), index.cols)
+	}
+
+	if index.cellh > 0 {
+		row = clamp(int((y-index.bounds.miny)/index.cellh), index.rows)
+	}
+
+	return col, row
+}
+
+// A point that is only created once it is needed, since most
+// candidate regions are ruled out by their envelopes
+type lazyPoint struct {
+	ctx     *GeomContext
+	x, y    float64
+	pt      Point
+	created bool
+}
+
+func (p *lazyPoint) get() Point {
+	if !p.created {
+		p.pt = p.ctx.CreatePt(p.x, p.y)
+		p.created = true
+	}
+
+	return p.pt
+}
+
+func (p *lazyPoint) destroy() {
+	if p.created {
+		p.ctx.DestroyPt(p.pt)
+		p.created = false
+	}
+}
+
+// Determine if the ith region contains a point
+func (index *RegionIndex) contains(i int, pt *lazyPoint) (bool, error) {
+	if !index.envelopes[i].contains(pt.x, pt.y) {
+		return false, nil
+	}
+
+	return pt.ctx.Intersects(index.regions[i].geom, pt.get())
+}
+
+// Find the index of the region that contains a point, or -1
+// if no region contains it
+//
+// Consecutive trees have a high spatial correlation so the
+// region at last (the previous result) is tried first. The
+// point is created, tested and destroyed with ctx
+func (index *RegionIndex) regionForPoint(ctx *GeomContext, x float64, y float64, last int) (int, error) {
+	if !index.bounds.contains(x, y) {
+		return -1, nil
+	}
+
+	// The point is destroyed as soon as the lookup is done
+	pt := &lazyPoint{ctx: ctx, x: x, y: y}
+	defer pt.destroy()
+
+	if last >= 0 {
+		found, err := index.contains(last, pt)
+
+		if err != nil {
+			return -1, err
+		}
+
+		if found {
+			return last, nil
+		}
+	}
+
+	col, row := index.cell(x, y)
+
+	for _, i := range index.cells[row*index.cols+col] {
+		if i == last {
+			continue
+		}
+
+		found, err := index.contains(i, pt)
+
+		if err != nil {
+			return -1, err
+		}
+
+		if found {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// Find the code of the region that contains a point. Returns
+// an empty string if no region contains the point
+func (index *RegionIndex) RegionCodeForPoint(x float64, y float64) (string, error) {
+	ctx := NewGeomContext()
+	defer ctx.Close()
+
+	i, err := index.regionForPoint(ctx, x, y, -1)
+
+	if err != nil || i < 0 {
+		return "", err
+	}
+
+	return index.regions[i].Code, nil
+}
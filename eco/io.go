@@ -3,21 +3,84 @@ package eco
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 var (
-	// List of "factor" files that we will load. Files generally have the form:
+	// The factors of the shipped data, in the order of
+	// DefaultFactors. Files generally have the form:
 	// output__{region}__{factor}.csv
+	//
+	// The factors of a data directory are found from the names
+	// of its files (see ReadFactorSet), so a new factor only
+	// needs its files. These give the order of the factors that
+	// are listed here, which come before the others.
+	//
+	// "cpa" (crown projection area) and "lsa" (leaf surface
+	// area) aren't benefits but describe the size of the tree's
+	// canopy. They don't have a price.
+	//
+	// "net_co2_sequestered" is "co2_sequestered" less the CO2
+	// released by decomposition ("co2_decomp") and maintenance
+	// ("co2_maint"), and "net_vocs" is "aq_voc_avoided" plus
+	// "bvoc". These are reported alongside the gross factors but
+	// don't have a price, since that would count the same
+	// benefit twice.
 	Factors = []string{"natural_gas", "electricity",
 		"hydro_interception", "co2_sequestered",
 		"co2_avoided", "co2_storage", "aq_nox_dep", "aq_ozone_dep",
 		"aq_nox_avoided", "aq_pm10_dep", "aq_pm10_avoided",
-		"aq_sox_dep", "aq_sox_avoided", "aq_voc_avoided", "bvoc"}
+		"aq_sox_dep", "aq_sox_avoided", "aq_voc_avoided", "bvoc",
+		"property_value", "cpa", "lsa", "co2_decomp", "co2_maint",
+		"net_co2_sequestered", "net_vocs"}
+
+	// The units of the values in each factor's data files,
+	// per tree per year for the annual benefits. Diameter
+	// breaks are always in DiameterUnit. The values of factors
+	// that aren't listed don't have a unit, so they aren't
+	// converted between unit systems
+	FactorUnits = map[string]string{
+		"natural_gas": "kBtu", "electricity": "kWh",
+		"hydro_interception": "m^3", "co2_sequestered": "kg",
+		"co2_avoided": "kg", "co2_storage": "kg", "aq_nox_dep": "kg",
+		"aq_ozone_dep": "kg", "aq_nox_avoided": "kg",
+		"aq_pm10_dep": "kg", "aq_pm10_avoided": "kg",
+		"aq_sox_dep": "kg", "aq_sox_avoided": "kg",
+		"aq_voc_avoided": "kg", "bvoc": "kg", "property_value": "m^2",
+		"cpa": "m^2", "lsa": "m^2", "co2_decomp": "kg",
+		"co2_maint": "kg", "net_co2_sequestered": "kg", "net_vocs": "kg"}
+
+	// Files in a data directory that aren't factors: the
+	// growth data (see ReadGrowthFiles) and other tables that
+	// are exported from i-Tree Streets with the factors
+	nonFactorFiles = []string{growthFactor,
+		"interpolation_range", "numbers", "species_codes", "toc"}
+)
+
+// The unit of the diameter breaks in the factor data files
+const DiameterUnit = "cm"
+
+var (
+	// Building types that can have their own energy and
+	// avoided emission factors:
+	// sfr - single family residential
+	// mfr - multi family residential
+	// ci  - commercial/industrial
+	// it  - institutional
+	BuildingTypes = []string{"sfr", "mfr", "ci", "it"}
+
+	// File name suffixes of the building type factor files
+	buildingTypeSuffixes = map[string]string{
+		"-sfr": "sfr", "-mfr": "mfr", "-ci": "ci", "-it": "it",
+		"_sf": "sfr", "_mf": "mfr", "_ci": "ci", "_it": "it"}
 )
 
 // A datafile contains a particular set of dbh breaks and data points
@@ -35,6 +98,12 @@ type Datafile struct {
 	Values map[string][]float64
 }
 
+// Get the index of a factor in DefaultFactors, or -1
+// if there is no such factor
+func FactorIndex(factor string) int {
+	return DefaultFactors.Index(factor)
+}
+
 func indexOf(value string, l []string) int {
 	for p, v := range l {
 		if v == value {
@@ -49,7 +118,13 @@ func indexOf(value string, l []string) int {
 // The output map combines regions with species codes
 // and returns the iTree Code
 func LoadSpeciesMap(speciesMasterList string) (map[string]map[string]string, error) {
-	bytes, err := ioutil.ReadFile(speciesMasterList)
+	return LoadSpeciesMapFS(os.DirFS(filepath.Dir(speciesMasterList)),
+		filepath.Base(speciesMasterList))
+}
+
+// Like LoadSpeciesMap, for a file in fsys
+func LoadSpeciesMapFS(fsys fs.FS, name string) (map[string]map[string]string, error) {
+	bytes, err := fs.ReadFile(fsys, name)
 
 	if err != nil {
 		return nil, err
@@ -61,6 +136,219 @@ func LoadSpeciesMap(speciesMasterList string) (map[string]map[string]string, err
 	return data, err
 }
 
+// Load the resource unit prices
+//
+// The price file is a json map of region code to factor to
+// the price (in dollars) of a single unit of that factor, where
+// units are the same as the ones used in the factor data files
+//
+// The returned map has region codes as keys and a slice of prices
+// as values. The price slice is indexed like the factor data
+// of DefaultFactors. Use LoadPricesFS with the factors of other
+// data. Factors without a price are left at zero.
+func LoadPrices(pricesPath string) (map[string][]float64, error) {
+	return LoadPricesFS(os.DirFS(filepath.Dir(pricesPath)),
+		filepath.Base(pricesPath), DefaultFactors)
+}
+
+// Like LoadPrices, for a file in fsys and the factor data
+// of a set of factors. The prices are indexed like the data
+func LoadPricesFS(fsys fs.FS, name string, factors *FactorSet) (map[string][]float64, error) {
+	bytes, err := fs.ReadFile(fsys, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]map[string]float64)
+	err = json.Unmarshal(bytes, &data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string][]float64, len(data))
+
+	for region, factorprices := range data {
+		regionprices := make([]float64, factors.dataLen)
+
+		for factor, price := range factorprices {
+			fidx := factors.Index(factor)
+
+			if fidx >= 0 {
+				regionprices[factors.dataIndex[fidx]] = price
+			}
+		}
+
+		prices[region] = regionprices
+	}
+
+	return prices, nil
+}
+
+// A problem with a data file. Line is zero for problems
+// with the file as a whole
+type DataError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (e *DataError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%v: %v", e.Path, e.Message)
+	}
+
+	return fmt.Sprintf("%v:%v: %v", e.Path, e.Line, e.Message)
+}
+
+// Every problem found while loading or validating data files
+type DataErrors []*DataError
+
+func (e DataErrors) Error() string {
+	messages := make([]string, len(e))
+
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Return the errors as an error, or nil if there aren't any
+func (e DataErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// A data file in a data directory, with the region and
+// factor from its name
+type dataFileName struct {
+	fsys fs.FS
+	name string
+
+	// The name with the directory, for errors
+	path string
+
+	region string
+	factor string
+}
+
+// Read a data file like ReadDatafile
+func (f dataFileName) read() (*Datafile, error) {
+	fi, err := f.fsys.Open(f.name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	return readDatafile(f.path, fi)
+}
+
+// List the data files (output__<regioncode>__<factor>.csv)
+// in a directory. basePath is the directory's path, for errors
+//
+// Returns a DataErrors for files that start with "output__"
+// but don't have a region and factor in their name
+func listDataFiles(fsys fs.FS, basePath string) ([]dataFileName, error) {
+	files, err := fs.ReadDir(fsys, ".")
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]dataFileName, 0, len(files))
+	errs := DataErrors{}
+
+	for _, f := range files {
+		// We only care about "output" files that have
+		// been generated from itree streets
+		if !strings.HasPrefix(f.Name(), "output__") {
+			continue
+		}
+
+		path := filepath.Join(basePath, f.Name())
+		region, factor, err := splitDataFileName(f.Name())
+
+		if err != nil {
+			errs = append(errs, &DataError{path, 0, err.Error()})
+			continue
+		}
+
+		names = append(names, dataFileName{fsys, f.Name(), path, region, factor})
+	}
+
+	return names, errs.err()
+}
+
+// Find the factors of the data files in a directory
+//
+// Every output__<region>__<factor>.csv file is a factor,
+// except for nonFactorFiles and the building type variants
+// of other factors (see ReadBuildingTypeFiles). The factors
+// in the global `Factors` come first, in its order, followed
+// by the others in alphabetical order. Their units are given
+// by FactorUnits
+//
+// Errors are returned like ReadDataFiles
+func ReadFactorSet(basePath string) (*FactorSet, error) {
+	names, err := listDataFiles(os.DirFS(basePath), basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dataFactorSet(names)
+}
+
+// Get the factors of a list of data files (see ReadFactorSet)
+func dataFactorSet(names []dataFileName) (*FactorSet, error) {
+	candidates := make(map[string]bool)
+
+	for _, name := range names {
+		if indexOf(name.factor, nonFactorFiles) < 0 {
+			candidates[name.factor] = true
+		}
+	}
+
+	isCandidate := func(factor string) bool { return candidates[factor] }
+	units := make(map[string]string)
+
+	for factor := range candidates {
+		if base, _ := buildingTypeBase(factor, isCandidate); base == "" {
+			units[factor] = FactorUnits[factor]
+		}
+	}
+
+	return orderedFactorSet(units)
+}
+
+// Make a set of the factors in units, with the factors of the
+// global `Factors` first, in its order, and the others after
+// them in alphabetical order
+func orderedFactorSet(units map[string]string) (*FactorSet, error) {
+	names := make([]string, 0, len(units))
+
+	for _, factor := range Factors {
+		if _, found := units[factor]; found {
+			names = append(names, factor)
+		}
+	}
+
+	for _, factor := range sortedKeys(units) {
+		if indexOf(factor, Factors) < 0 {
+			names = append(names, factor)
+		}
+	}
+
+	return NewFactorSet(names, units)
+}
+
 // Load the data files
 //
 // the relevant data files are stored in the format:
@@ -71,75 +359,347 @@ func LoadSpeciesMap(speciesMasterList string) (map[string]map[string]string, err
 //
 // The returned data stucture has region codes as keys and an array of data files
 // as values.
-// the data file array is indexed by factor id, as determined by the global `Factors`.
+// the data file array is indexed by factor id, as determined by the factors
+// of the directory (see ReadFactorSet). For the shipped data these
+// are DefaultFactors.
 //
 // For instance, Factors[3] = hydro_interception so
 // the datafile for NoCalXXX region and hydro interception
 // would be:
 //
-// files = LoadFiles('/path/to/data/folder')
+// files, err = ReadDataFiles('/path/to/data/folder')
 // hydro_data = files['NoCalXXX'][3]
 //
-func LoadFiles(basePath string) map[string][]*Datafile {
+// Returns the directory's error if it can't be read, or a
+// DataErrors with the problems in every file that couldn't
+// be loaded (see ReadDatafile)
+func ReadDataFiles(basePath string) (map[string][]*Datafile, error) {
+	factors, err := ReadFactorSet(basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return readDataFiles(os.DirFS(basePath), basePath, factors)
+}
+
+func readDataFiles(
+	fsys fs.FS, basePath string,
+	factors *FactorSet) (map[string][]*Datafile, error) {
+
+	names, err := listDataFiles(fsys, basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
 	m := make(map[string][]*Datafile)
+	errs := DataErrors{}
 
-	files, _ := ioutil.ReadDir(basePath)
-	for _, f := range files {
-		// We only care about "output" files that have
-		// been generated from itree streets
-		if strings.Contains(f.Name(), "output") {
-			parts := strings.Split(f.Name(), "__")
-			region := parts[1]
-			factor_with_csv := parts[2]
-			// strip .csv
-			factor := factor_with_csv[0 : len(factor_with_csv)-4]
+	for _, name := range names {
+		fidx := factors.Index(name.factor)
 
-			fidx := indexOf(factor, Factors)
+		if fidx < 0 {
+			continue
+		}
 
-			if fidx >= 0 {
-				if m[region] == nil {
-					m[region] = make([]*Datafile, len(Factors))
-				}
+		datafile, err := name.read()
+
+		if err != nil {
+			errs = appendDataErrors(errs, err)
+			continue
+		}
+
+		if m[name.region] == nil {
+			m[name.region] = make([]*Datafile, factors.Len())
+		}
+
+		m[name.region][fidx] = datafile
+	}
 
-				m[region][fidx] = LoadFile(basePath + f.Name())
+	return m, errs.err()
+}
+
+// Like ReadDataFiles, but panics if the files can't be loaded
+func LoadFiles(basePath string) map[string][]*Datafile {
+	m, err := ReadDataFiles(basePath)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// Add an error from reading a file to a list of errors
+func appendDataErrors(errs DataErrors, err error) DataErrors {
+	switch err := err.(type) {
+	case DataErrors:
+		return append(errs, err...)
+	case *DataError:
+		return append(errs, err)
+	}
+
+	return append(errs, &DataError{"", 0, err.Error()})
+}
+
+// Split a data file name into its region and factor parts
+//
+// output__NoEastXXX__electricity-ci.csv gives
+// "NoEastXXX" and "electricity-ci"
+func splitDataFileName(name string) (string, string, error) {
+	parts := strings.Split(name, "__")
+
+	if len(parts) != 3 || parts[1] == "" ||
+		!strings.HasSuffix(parts[2], ".csv") || len(parts[2]) == 4 {
+
+		return "", "", errors.New(
+			"Expected a name like output__<region>__<factor>.csv")
+	}
+
+	region := parts[1]
+	factor_with_csv := parts[2]
+	// strip .csv
+	factor := factor_with_csv[0 : len(factor_with_csv)-4]
+
+	return region, factor, nil
+}
+
+// Split a building type specific factor name (such as
+// "electricity-sfr" or "nox_avoided_ci") into the blended
+// factor of the set that it refines and its building type
+//
+// Returns an empty factor if the name isn't a building type
+// variant of one of the factors
+func (set *FactorSet) splitBuildingTypeFactor(name string) (string, string) {
+	return buildingTypeBase(name, func(factor string) bool {
+		return set.Index(factor) >= 0
+	})
+}
+
+// Split a factor name like splitBuildingTypeFactor, where
+// isFactor determines if a name is a blended factor
+func buildingTypeBase(name string, isFactor func(string) bool) (string, string) {
+	for suffix, buildingtype := range buildingTypeSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		base := name[0 : len(name)-len(suffix)]
+
+		// The air quality variants drop the "aq_" prefix
+		for _, factor := range []string{base, "aq_" + base} {
+			if isFactor(factor) {
+				return factor, buildingtype
 			}
 		}
 	}
 
+	return "", ""
+}
+
+// Load the building type specific data files
+//
+// Some regions have separate energy and avoided emission
+// files for each building type, stored in the format:
+// output__<regioncode>__<factor>-<sfr|mfr|ci|it>.csv
+// or, for air quality factors:
+// output__<regioncode>__<pollutant>_avoided_<sf|mf|ci|it>.csv
+//
+// The returned data structure maps region codes to building
+// types to an array of data files, indexed by factor id just
+// like the ones returned by ReadDataFiles. Factors without a
+// building type variant use the blended datafile from regiondata
+// so the arrays can be passed directly to CalcOneTree.
+//
+// Regions without any variant files are not included. Use
+// FactorDataForBuildingType to get the data with a fallback.
+//
+// Errors are returned like ReadDataFiles
+func ReadBuildingTypeFiles(
+	basePath string,
+	regiondata map[string][]*Datafile) (map[string]map[string][]*Datafile, error) {
+
+	factors, err := ReadFactorSet(basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return readBuildingTypeFiles(os.DirFS(basePath), basePath, factors, regiondata)
+}
+
+func readBuildingTypeFiles(
+	fsys fs.FS, basePath string, factors *FactorSet,
+	regiondata map[string][]*Datafile) (map[string]map[string][]*Datafile, error) {
+
+	names, err := listDataFiles(fsys, basePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]map[string][]*Datafile)
+	errs := DataErrors{}
+
+	for _, name := range names {
+		factor, buildingtype := factors.splitBuildingTypeFactor(name.factor)
+		blended, found := regiondata[name.region]
+
+		if factor == "" || !found {
+			continue
+		}
+
+		datafile, err := name.read()
+
+		if err != nil {
+			errs = appendDataErrors(errs, err)
+			continue
+		}
+
+		if m[name.region] == nil {
+			m[name.region] = make(map[string][]*Datafile)
+		}
+
+		if m[name.region][buildingtype] == nil {
+			datafiles := make([]*Datafile, factors.Len())
+			copy(datafiles, blended)
+			m[name.region][buildingtype] = datafiles
+		}
+
+		m[name.region][buildingtype][factors.Index(factor)] = datafile
+	}
+
+	return m, errs.err()
+}
+
+// Like ReadBuildingTypeFiles, but panics if the files
+// can't be loaded
+func LoadBuildingTypeFiles(
+	basePath string,
+	regiondata map[string][]*Datafile) map[string]map[string][]*Datafile {
+
+	m, err := ReadBuildingTypeFiles(basePath, regiondata)
+
+	if err != nil {
+		panic(err)
+	}
+
 	return m
 }
 
-// TODO - Parse these all out to json
-// The data files are in shambles due to the xls exporter
-// we should clean these up once and for all
-func LoadFile(path string) *Datafile {
+// Load a data file
+//
+// The first line of a data file has the DBH breaks, after a
+// label in the first column. Each of the following lines has
+// an i-Tree code and a value for each break. The files were
+// exported from spreadsheets, so the table ends at the first
+// line without an i-Tree code and anything after it is ignored,
+// as are extra cells after the last break.
+//
+// Returns the file's error if it can't be read, or a DataErrors
+// with every problem in the file: breaks or values that aren't
+// numbers, breaks that don't increase, rows with too few values
+// and i-Tree codes that appear more than once
+func ReadDatafile(path string) (*Datafile, error) {
 	fi, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fi.Close()
+
+	return readDatafile(path, fi)
+}
+
+func readDatafile(path string, r io.Reader) (*Datafile, error) {
+	datafile, errs, err := parseDatafile(path, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return datafile, nil
+}
+
+// Like ReadDatafile, but panics if the file can't be loaded
+func LoadFile(path string) *Datafile {
+	datafile, err := ReadDatafile(path)
+
 	if err != nil {
 		panic(err)
 	}
 
-	// close fi on exit and check for its returned error
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
-		}
-	}()
+	return datafile
+}
 
-	// Scanner used to read line by line
-	scanner := bufio.NewReader(fi)
-	str, _ := scanner.ReadString(0x0A)
+// Parse a data file, collecting its problems
+//
+// Rows with problems are left out of the returned datafile.
+// The error is only set if the file couldn't be read
+func parseDatafile(path string, r io.Reader) (*Datafile, DataErrors, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
 
-	str = strings.TrimSpace(str)
-	headerFields := strings.Split(str, ",")[1:]
-	breaks := make([]float64, 0, len(headerFields))
+	errs := DataErrors{}
+	addError := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &DataError{path, line, fmt.Sprintf(format, args...)})
+	}
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		addError(0, "The file is empty")
+		return nil, errs, nil
+	}
 
 	// The first line is always the list of
 	// diameter breaks
-	for _, l := range headerFields {
-		if len(l) > 0 {
-			n, _ := strconv.ParseFloat(l, 64)
-			breaks = append(breaks, n)
+	headerFields := strings.Split(strings.TrimSpace(scanner.Text()), ",")[1:]
+	breaks := make([]float64, 0, len(headerFields))
+
+	for i, l := range headerFields {
+		if len(l) == 0 {
+			// The breaks end at the first empty cell
+			for _, rest := range headerFields[i:] {
+				if len(rest) > 0 {
+					addError(1, "Empty cell between DBH breaks")
+					break
+				}
+			}
+
+			break
+		}
+
+		n, err := parseCell(l)
+
+		if err != nil {
+			addError(1, "Invalid DBH break %q", l)
+			continue
+		}
+
+		if len(breaks) > 0 && n <= breaks[len(breaks)-1] {
+			addError(1, "DBH break %v doesn't increase", l)
 		}
+
+		breaks = append(breaks, n)
+	}
+
+	// Values above the last break are extrapolated from
+	// the last two, so there have to be at least two
+	if len(breaks) < 2 {
+		addError(1, "Expected at least 2 DBH breaks, got %v", len(breaks))
+	}
+
+	if len(errs) > 0 {
+		return nil, errs, nil
 	}
 
 	tgtLen := len(breaks)
@@ -148,33 +708,65 @@ func LoadFile(path string) *Datafile {
 	// list of values at
 	m := make(map[string][]float64)
 
-	for {
-		str, err := scanner.ReadString(0x0A)
+	for line := 2; scanner.Scan(); line++ {
+		cells := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		code := cells[0]
 
-		if err == io.EOF {
+		if code == "" {
 			break
-		} else if err != nil {
-			panic(err)
 		}
 
-		line := strings.Split(strings.TrimSpace(str), ",")
+		if _, found := m[code]; found {
+			addError(line, "Duplicate i-Tree code %v", code)
+			continue
+		}
+
+		if len(cells)-1 < tgtLen {
+			addError(line, "%v has %v values, expected %v",
+				code, len(cells)-1, tgtLen)
+			continue
+		}
+
+		values := make([]float64, 0, tgtLen)
 
-		if len(line) >= tgtLen {
-			code := line[0]
-			breaks := make([]float64, 0, len(breaks))
+		for _, l := range cells[1 : tgtLen+1] {
+			n, err := parseCell(l)
 
-			for _, l := range line[1 : tgtLen+1] {
-				n, _ := strconv.ParseFloat(l, 64)
-				breaks = append(breaks, n)
+			if err != nil {
+				addError(line, "Invalid value %q for %v", l, code)
+				break
 			}
 
-			m[code] = breaks
+			values = append(values, n)
+		}
+
+		if len(values) == tgtLen {
+			m[code] = values
 		}
 	}
 
-	file := &Datafile{breaks, m}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
 
-	return file
+	return &Datafile{breaks, m}, errs, nil
+}
+
+// Parse a number in a data file. Blank cells, spreadsheet
+// errors (such as "#VALUE!") and NaN or infinite values
+// are errors
+func parseCell(cell string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, errors.New("Not a finite number")
+	}
+
+	return n, nil
 }
 
 func GetITreeCodesByRegion(regionData map[string][]*Datafile) map[string][]string {
@@ -184,8 +776,22 @@ func GetITreeCodesByRegion(regionData map[string][]*Datafile) map[string][]strin
 	//       ...}
 	codes := make(map[string][]string, len(regionData))
 	for regionCode, data := range regionData {
-		// All value maps for a region use the same i-Tree codes, so just use the first one
-		valueMap := data[0].Values
+		// All value maps for a region use the same i-Tree codes, so
+		// just use the first one. A region doesn't have data for
+		// the factors that only other regions have (see
+		// FactorData.Override), so skip those
+		var valueMap map[string][]float64
+		for _, datafile := range data {
+			if datafile != nil {
+				valueMap = datafile.Values
+				break
+			}
+		}
+
+		if valueMap == nil {
+			continue
+		}
+
 		keys := make([]string, 0, len(valueMap))
 		for k := range valueMap {
 			keys = append(keys, k)
@@ -0,0 +1,125 @@
+package eco
+
+// Annual mortality rate (between 0 and 1) of a tree
+// with the given diameter
+type MortalityRateFunc func(diameter float64) float64
+
+// Expected number of living trees in each year of a
+// scenario for a single planting site
+type Survival struct {
+	// Expected number of the original trees alive in each
+	// year. This is zero before the tree has been planted
+	// (its diameter is zero) and after its diameters run out
+	Trees []float64
+
+	// Expected number of the original trees that die during
+	// each year or, if their diameters run out before the end
+	// of the scenario, are removed at the end of their last year
+	Removed []float64
+
+	// Replacements[i][k] is the expected number of
+	// replacement trees alive in year i that were planted
+	// k years earlier. This is nil if dead trees are not
+	// replaced
+	Replacements [][]float64
+
+	// ReplacementsRemoved[i][k] is the expected number of
+	// replacement trees planted k years before year i that
+	// die during year i. This is nil if dead trees are not
+	// replaced
+	ReplacementsRemoved [][]float64
+}
+
+// The expected number of living trees (original and
+// replacement) in the given year
+func (s *Survival) Living(year int) float64 {
+	living := s.Trees[year]
+
+	if s.Replacements != nil {
+		for _, weight := range s.Replacements[year] {
+			living += weight
+		}
+	}
+
+	return living
+}
+
+// Calculate the expected survival of a tree over a scenario
+//
+// Diameters are the diameters of the tree in each year, as in
+// a scenario. Each year a fraction of the living trees, given
+// by rate, dies.
+//
+// If replacementDiameters is not nil the trees that die in one
+// year are replaced in the next year with trees that have
+// replacementDiameters[k] as their diameter k years after
+// planting. Replacement trees die (and are replaced) according
+// to replacementRate. replacementDiameters must have an element
+// for every year of the scenario
+func CalcSurvival(
+	diameters []float64,
+	rate MortalityRateFunc,
+	replacementDiameters []float64,
+	replacementRate MortalityRateFunc,
+	years int) *Survival {
+
+	survival := &Survival{
+		Trees:   make([]float64, years),
+		Removed: make([]float64, years)}
+
+	replacing := replacementDiameters != nil
+	if replacing {
+		survival.Replacements = make([][]float64, years)
+		survival.ReplacementsRemoved = make([][]float64, years)
+	}
+
+	alive := 1.0
+
+	// Replacement trees alive in the current year by
+	// years since planting
+	replacements := make([]float64, 0, years)
+
+	for i := 0; i < years; i++ {
+		deaths := 0.0
+
+		if i < len(diameters) && diameters[i] > 0 {
+			survival.Trees[i] = alive
+
+			died := alive * rate(diameters[i])
+			alive -= died
+			deaths += died
+
+			// Trees without diameters for the rest of the
+			// scenario are removed at the end of the year
+			if i == len(diameters)-1 && i < years-1 {
+				survival.Removed[i] = alive
+				alive = 0.0
+			}
+
+			survival.Removed[i] += died
+		}
+
+		if !replacing {
+			continue
+		}
+
+		survival.Replacements[i] = append([]float64(nil), replacements...)
+		survival.ReplacementsRemoved[i] = make([]float64, len(replacements))
+
+		for k, weight := range replacements {
+			died := weight * replacementRate(replacementDiameters[k])
+			replacements[k] -= died
+			deaths += died
+
+			survival.ReplacementsRemoved[i][k] = died
+		}
+
+		// Everything gets a year older and the
+		// dead trees are replaced
+		replacements = append(replacements, 0.0)
+		copy(replacements[1:], replacements)
+		replacements[0] = deaths
+	}
+
+	return survival
+}
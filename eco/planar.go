@@ -0,0 +1,597 @@
+package eco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Planar polygon geometry in pure Go
+//
+// This backs the pure Go geometry backend (see geom_nogeos.go)
+// and only supports what the service needs: parsing polygons and
+// multipolygons from WKT and WKB, point in polygon tests, polygon
+// intersection tests and centroids
+
+type planarRing struct {
+	points [][2]float64
+	env    envelope
+}
+
+type planarPolygon struct {
+	// The first ring is the shell, the rest are holes
+	rings []*planarRing
+	env   envelope
+}
+
+// An edge of a ring, with its y range for indexing
+type planarEdge struct {
+	x1, y1, x2, y2 float64
+}
+
+// A parsed geometry, prepared for point in polygon tests
+type planarGeometry struct {
+	polygons []*planarPolygon
+	env      envelope
+
+	// Edges of every ring, bucketed into horizontal bands
+	// by their y ranges so a point only tests the edges
+	// that could cross its ray
+	bands     [][]planarEdge
+	bandminy  float64
+	bandwidth float64
+}
+
+func newPlanarRing(points [][2]float64) (*planarRing, error) {
+	if len(points) < 4 {
+		return nil, errors.New("Polygon rings need at least 4 points")
+	}
+
+	ring := &planarRing{points: points,
+		env: envelope{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}}
+
+	for _, p := range points {
+		ring.env.expand(p[0], p[1])
+	}
+
+	return ring, nil
+}
+
+func (e *envelope) expand(x float64, y float64) {
+	e.minx = math.Min(e.minx, x)
+	e.miny = math.Min(e.miny, y)
+	e.maxx = math.Max(e.maxx, x)
+	e.maxy = math.Max(e.maxy, y)
+}
+
+func (e envelope) intersects(other envelope) bool {
+	return e.minx <= other.maxx && other.minx <= e.maxx &&
+		e.miny <= other.maxy && other.miny <= e.maxy
+}
+
+// Build a geometry from polygons and prepare its edge index
+func newPlanarGeometry(polygons []*planarPolygon) *planarGeometry {
+	g := &planarGeometry{polygons: polygons,
+		env: envelope{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}}
+
+	edges := make([]planarEdge, 0)
+
+	for _, polygon := range polygons {
+		polygon.env = polygon.rings[0].env
+
+		g.env.expand(polygon.env.minx, polygon.env.miny)
+		g.env.expand(polygon.env.maxx, polygon.env.maxy)
+
+		for _, ring := range polygon.rings {
+			for i := 1; i < len(ring.points); i++ {
+				a, b := ring.points[i-1], ring.points[i]
+				edges = append(edges, planarEdge{a[0], a[1], b[0], b[1]})
+			}
+		}
+	}
+
+	if len(edges) == 0 {
+		return g
+	}
+
+	// About 8 edges per band for evenly spread edges
+	nbands := len(edges)/8 + 1
+	g.bandminy = g.env.miny
+	g.bandwidth = (g.env.maxy - g.env.miny) / float64(nbands)
+	g.bands = make([][]planarEdge, nbands)
+
+	for _, edge := range edges {
+		first := g.band(math.Min(edge.y1, edge.y2))
+		last := g.band(math.Max(edge.y1, edge.y2))
+
+		for i := first; i <= last; i++ {
+			g.bands[i] = append(g.bands[i], edge)
+		}
+	}
+
+	return g
+}
+
+func (g *planarGeometry) band(y float64) int {
+	if g.bandwidth <= 0 {
+		return 0
+	}
+
+	i := int((y - g.bandminy) / g.bandwidth)
+
+	if i < 0 {
+		return 0
+	}
+
+	if i >= len(g.bands) {
+		return len(g.bands) - 1
+	}
+
+	return i
+}
+
+// Determine if the geometry contains a point
+//
+// This casts a ray from the point and counts the edges it
+// crosses. Since holes are rings too, an odd count means the
+// point is inside a shell but not inside one of its holes
+func (g *planarGeometry) contains(x float64, y float64) bool {
+	if len(g.bands) == 0 || !g.env.contains(x, y) {
+		return false
+	}
+
+	inside := false
+
+	for _, e := range g.bands[g.band(y)] {
+		if (e.y1 > y) != (e.y2 > y) &&
+			x < (e.x2-e.x1)*(y-e.y1)/(e.y2-e.y1)+e.x1 {
+
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Twice the signed area of a ring and the sums used
+// for its centroid
+func ringMoments(points [][2]float64) (float64, float64, float64) {
+	area, cx, cy := 0.0, 0.0, 0.0
+
+	// Coordinates are relative to the first point
+	// to keep the sums precise for large coordinates
+	ox, oy := points[0][0], points[0][1]
+
+	for i := 1; i < len(points); i++ {
+		x1, y1 := points[i-1][0]-ox, points[i-1][1]-oy
+		x2, y2 := points[i][0]-ox, points[i][1]-oy
+
+		cross := x1*y2 - x2*y1
+		area += cross
+		cx += (x1 + x2) * cross
+		cy += (y1 + y2) * cross
+	}
+
+	return area, cx + 3*area*ox, cy + 3*area*oy
+}
+
+// Get the area weighted centroid of the geometry
+func (g *planarGeometry) centroid() (float64, float64) {
+	area, cx, cy := 0.0, 0.0, 0.0
+
+	for _, polygon := range g.polygons {
+		for i, ring := range polygon.rings {
+			a, x, y := ringMoments(ring.points)
+
+			// Shells add to the area and holes take away from
+			// it, whichever way their points go around
+			if (i == 0) != (a > 0) {
+				a, x, y = -a, -x, -y
+			}
+
+			area += a
+			cx += x
+			cy += y
+		}
+	}
+
+	if area == 0 {
+		return (g.env.minx + g.env.maxx) / 2, (g.env.miny + g.env.maxy) / 2
+	}
+
+	return cx / (3 * area), cy / (3 * area)
+}
+
+// Determine if two line segments intersect
+func segmentsIntersect(a1, a2, b1, b2 [2]float64) bool {
+	orientation := func(p, q, r [2]float64) float64 {
+		return (q[0]-p[0])*(r[1]-p[1]) - (q[1]-p[1])*(r[0]-p[0])
+	}
+
+	onSegment := func(p, q, r [2]float64) bool {
+		return math.Min(p[0], q[0]) <= r[0] && r[0] <= math.Max(p[0], q[0]) &&
+			math.Min(p[1], q[1]) <= r[1] && r[1] <= math.Max(p[1], q[1])
+	}
+
+	d1 := orientation(b1, b2, a1)
+	d2 := orientation(b1, b2, a2)
+	d3 := orientation(a1, a2, b1)
+	d4 := orientation(a1, a2, b2)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	return (d1 == 0 && onSegment(b1, b2, a1)) ||
+		(d2 == 0 && onSegment(b1, b2, a2)) ||
+		(d3 == 0 && onSegment(a1, a2, b1)) ||
+		(d4 == 0 && onSegment(a1, a2, b2))
+}
+
+func ringsIntersect(a *planarRing, b *planarRing) bool {
+	if !a.env.intersects(b.env) {
+		return false
+	}
+
+	for i := 1; i < len(a.points); i++ {
+		for j := 1; j < len(b.points); j++ {
+			if segmentsIntersect(a.points[i-1], a.points[i],
+				b.points[j-1], b.points[j]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Determine if two geometries intersect. They do if their
+// boundaries cross or if one contains a point of the other
+func (g *planarGeometry) intersects(other *planarGeometry) bool {
+	if !g.env.intersects(other.env) {
+		return false
+	}
+
+	for _, p := range g.polygons {
+		for _, q := range other.polygons {
+			if !p.env.intersects(q.env) {
+				continue
+			}
+
+			for _, a := range p.rings {
+				for _, b := range q.rings {
+					if ringsIntersect(a, b) {
+						return true
+					}
+				}
+			}
+
+			shell := q.rings[0].points[0]
+			if g.contains(shell[0], shell[1]) {
+				return true
+			}
+
+			shell = p.rings[0].points[0]
+			if other.contains(shell[0], shell[1]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Parse a polygon or multipolygon from WKT. Z and M values
+// are ignored
+func parsePlanarWKT(wkt string) (*planarGeometry, error) {
+	wkt = strings.TrimSpace(wkt)
+	open := strings.Index(wkt, "(")
+
+	if open < 0 {
+		if strings.HasSuffix(strings.ToUpper(wkt), "EMPTY") {
+			return newPlanarGeometry(nil), nil
+		}
+
+		return nil, errors.New("Invalid WKT geometry")
+	}
+
+	kind := strings.Fields(strings.ToUpper(wkt[:open]))
+
+	if len(kind) == 0 {
+		return nil, errors.New("Invalid WKT geometry")
+	}
+
+	// The body is nested lists of coordinates, which
+	// we parse depth first
+	parser := &wktParser{body: wkt[open:]}
+	polygons := make([]*planarPolygon, 0)
+
+	switch kind[0] {
+	case "POLYGON":
+		polygon, err := parser.polygon()
+
+		if err != nil {
+			return nil, err
+		}
+
+		polygons = append(polygons, polygon)
+
+	case "MULTIPOLYGON":
+		if err := parser.expect('('); err != nil {
+			return nil, err
+		}
+
+		for {
+			polygon, err := parser.polygon()
+
+			if err != nil {
+				return nil, err
+			}
+
+			polygons = append(polygons, polygon)
+
+			if !parser.accept(',') {
+				break
+			}
+		}
+
+		if err := parser.expect(')'); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, errors.New(
+			fmt.Sprintf("Unsupported WKT geometry %v", kind[0]))
+	}
+
+	if strings.TrimSpace(parser.body[parser.pos:]) != "" {
+		return nil, errors.New("Invalid WKT geometry")
+	}
+
+	return newPlanarGeometry(polygons), nil
+}
+
+type wktParser struct {
+	body string
+	pos  int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.body) && strings.ContainsRune(" \t\r\n", rune(p.body[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *wktParser) accept(c byte) bool {
+	p.skipSpace()
+
+	if p.pos < len(p.body) && p.body[p.pos] == c {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *wktParser) expect(c byte) error {
+	if !p.accept(c) {
+		return errors.New(
+			fmt.Sprintf("Invalid WKT geometry, expected %q at %v", c, p.pos))
+	}
+
+	return nil
+}
+
+func (p *wktParser) polygon() (*planarPolygon, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	polygon := &planarPolygon{}
+
+	for {
+		ring, err := p.ring()
+
+		if err != nil {
+			return nil, err
+		}
+
+		polygon.rings = append(polygon.rings, ring)
+
+		if !p.accept(',') {
+			break
+		}
+	}
+
+	return polygon, p.expect(')')
+}
+
+func (p *wktParser) ring() (*planarRing, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	end := strings.IndexByte(p.body[p.pos:], ')')
+
+	if end < 0 {
+		return nil, errors.New("Invalid WKT geometry, unclosed ring")
+	}
+
+	coordinates := strings.Split(p.body[p.pos:p.pos+end], ",")
+	points := make([][2]float64, len(coordinates))
+
+	for i, coordinate := range coordinates {
+		fields := strings.Fields(coordinate)
+
+		if len(fields) < 2 {
+			return nil, errors.New(
+				fmt.Sprintf("Invalid WKT coordinate %q", coordinate))
+		}
+
+		for j := 0; j < 2; j++ {
+			value, err := strconv.ParseFloat(fields[j], 64)
+
+			if err != nil {
+				return nil, err
+			}
+
+			points[i][j] = value
+		}
+	}
+
+	p.pos += end + 1
+
+	return newPlanarRing(points)
+}
+
+// WKB geometry types, without Z, M or SRID flags
+const (
+	wkbPolygon      = 3
+	wkbMultiPolygon = 6
+)
+
+// Parse a polygon or multipolygon from WKB or PostGIS EWKB.
+// Z and M values are ignored
+func parsePlanarWKB(wkb []byte) (*planarGeometry, error) {
+	reader := bytes.NewReader(wkb)
+	polygons, err := readWKBGeometry(reader)
+
+	if err != nil {
+		return nil, errors.New("Invalid WKB geometry: " + err.Error())
+	}
+
+	return newPlanarGeometry(polygons), nil
+}
+
+func readWKBGeometry(reader *bytes.Reader) ([]*planarPolygon, error) {
+	order, err := reader.ReadByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var byteOrder binary.ByteOrder = binary.BigEndian
+	if order == 1 {
+		byteOrder = binary.LittleEndian
+	}
+
+	var kind uint32
+
+	if err = binary.Read(reader, byteOrder, &kind); err != nil {
+		return nil, err
+	}
+
+	// EWKB flags
+	dimensions := 2
+	if kind&0x80000000 != 0 {
+		dimensions++
+	}
+	if kind&0x40000000 != 0 {
+		dimensions++
+	}
+	if kind&0x20000000 != 0 {
+		var srid uint32
+		if err = binary.Read(reader, byteOrder, &srid); err != nil {
+			return nil, err
+		}
+	}
+	kind &= 0x0fffffff
+
+	// ISO WKB dimensions
+	switch kind / 1000 {
+	case 1, 2:
+		dimensions = 3
+	case 3:
+		dimensions = 4
+	}
+	kind %= 1000
+
+	switch kind {
+	case wkbPolygon:
+		polygon, err := readWKBPolygon(reader, byteOrder, dimensions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []*planarPolygon{polygon}, nil
+
+	case wkbMultiPolygon:
+		var count uint32
+
+		if err = binary.Read(reader, byteOrder, &count); err != nil {
+			return nil, err
+		}
+
+		polygons := make([]*planarPolygon, 0, count)
+
+		for i := uint32(0); i < count; i++ {
+			parts, err := readWKBGeometry(reader)
+
+			if err != nil {
+				return nil, err
+			}
+
+			polygons = append(polygons, parts...)
+		}
+
+		return polygons, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unsupported geometry type %v", kind))
+}
+
+func readWKBPolygon(
+	reader *bytes.Reader, byteOrder binary.ByteOrder,
+	dimensions int) (*planarPolygon, error) {
+
+	var nrings uint32
+
+	if err := binary.Read(reader, byteOrder, &nrings); err != nil {
+		return nil, err
+	}
+
+	polygon := &planarPolygon{}
+
+	for i := uint32(0); i < nrings; i++ {
+		var npoints uint32
+
+		if err := binary.Read(reader, byteOrder, &npoints); err != nil {
+			return nil, err
+		}
+
+		if int(npoints)*dimensions*8 > reader.Len() {
+			return nil, errors.New("ring is longer than the geometry")
+		}
+
+		values := make([]float64, int(npoints)*dimensions)
+
+		if err := binary.Read(reader, byteOrder, values); err != nil {
+			return nil, err
+		}
+
+		points := make([][2]float64, npoints)
+		for j := range points {
+			points[j] = [2]float64{values[j*dimensions], values[j*dimensions+1]}
+		}
+
+		ring, err := newPlanarRing(points)
+
+		if err != nil {
+			return nil, err
+		}
+
+		polygon.rings = append(polygon.rings, ring)
+	}
+
+	if len(polygon.rings) == 0 {
+		return nil, errors.New("polygon has no rings")
+	}
+
+	return polygon, nil
+}
@@ -0,0 +1,175 @@
+package eco
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The SRID of the tree geometries in the OpenTreeMap
+// database
+const TreeSRID = SRIDWebMercator
+
+// A filter for the trees in an OpenTreeMap instance
+//
+// Every field other than InstanceId is optional. Nil
+// or empty fields don't filter anything
+type TreeFilter struct {
+	InstanceId int
+
+	// The bounding box of the trees as minx, miny, maxx and
+	// maxy in TreeSRID coordinates
+	Bbox []float64
+
+	// The otmcodes and species ids of the trees. Trees
+	// matching either list are included
+	Otmcodes   []string
+	SpeciesIds []int
+
+	// The range of the diameters of the trees, in inches.
+	// Both ends are inclusive
+	MinDiameter *float64
+	MaxDiameter *float64
+
+	// The range of the planting dates of the trees.
+	// Both ends are inclusive
+	PlantedAfter  *time.Time
+	PlantedBefore *time.Time
+
+	// A polygon (as WKT in TreeSRID coordinates) that
+	// contains the trees
+	Polygon string
+
+	// A column of the trees (one of GroupColumns) to select
+	// after the id, as text, so the trees can be grouped by it
+	GroupColumn string
+}
+
+// The columns of treemap_tree that a TreeFilter
+// can select as its GroupColumn
+var GroupColumns = []string{"date_planted", "date_removed",
+	"diameter", "height", "canopy_height", "readonly"}
+
+// Builds the where clause of a query, numbering its
+// parameters in the order they are added
+type queryBuilder struct {
+	conditions []string
+	args       []interface{}
+}
+
+// Add a condition to the query. Each %v in condition is
+// replaced with a parameter for the matching arg
+func (q *queryBuilder) add(condition string, args ...interface{}) {
+	placeholders := make([]interface{}, len(args))
+
+	for i, arg := range args {
+		q.args = append(q.args, arg)
+		placeholders[i] = fmt.Sprintf("$%v", len(q.args))
+	}
+
+	q.conditions = append(q.conditions,
+		fmt.Sprintf(condition, placeholders...))
+}
+
+// Build a parameterized query for the trees that match the filter
+//
+// The query selects the columns expected by Fetchable, including
+// the coordinates of the trees when withRegion is true, followed
+// by the id of each tree (see IdColumn) and GroupColumn, if it's
+// set. Trees without a species
+// have an empty otmcode and a species id of zero
+//
+// Returns the query and its parameters
+func (f *TreeFilter) Query(withRegion bool) (string, []interface{}, error) {
+	q := &queryBuilder{}
+
+	q.add("treemap_tree.instance_id = %v", f.InstanceId)
+
+	if f.Bbox != nil {
+		if len(f.Bbox) != 4 {
+			return "", nil, fmt.Errorf(
+				"Expected a bounding box with 4 values, got %v",
+				len(f.Bbox))
+		}
+
+		q.add(fmt.Sprintf("treemap_mapfeature.the_geom_webmercator && "+
+			"ST_MakeEnvelope(%%v, %%v, %%v, %%v, %v)", TreeSRID),
+			f.Bbox[0], f.Bbox[1], f.Bbox[2], f.Bbox[3])
+	}
+
+	if len(f.Otmcodes) > 0 || len(f.SpeciesIds) > 0 {
+		species := &queryBuilder{args: q.args}
+
+		for _, otmcode := range f.Otmcodes {
+			species.add("treemap_species.otm_code = %v", otmcode)
+		}
+
+		for _, speciesid := range f.SpeciesIds {
+			species.add("treemap_species.id = %v", speciesid)
+		}
+
+		q.args = species.args
+		q.conditions = append(q.conditions,
+			"("+strings.Join(species.conditions, " or ")+")")
+	}
+
+	if f.MinDiameter != nil {
+		q.add("treemap_tree.diameter >= %v", *f.MinDiameter)
+	}
+
+	if f.MaxDiameter != nil {
+		q.add("treemap_tree.diameter <= %v", *f.MaxDiameter)
+	}
+
+	if f.PlantedAfter != nil {
+		q.add("treemap_tree.date_planted >= %v", *f.PlantedAfter)
+	}
+
+	if f.PlantedBefore != nil {
+		q.add("treemap_tree.date_planted <= %v", *f.PlantedBefore)
+	}
+
+	if f.Polygon != "" {
+		q.add(fmt.Sprintf("ST_Intersects(ST_GeomFromText(%%v, %v), "+
+			"treemap_mapfeature.the_geom_webmercator)", TreeSRID),
+			f.Polygon)
+	}
+
+	columns := []string{
+		"treemap_tree.diameter",
+		"coalesce(treemap_species.id, 0)",
+		"coalesce(treemap_species.otm_code, '')"}
+
+	if withRegion {
+		columns = append(columns,
+			"ST_X(treemap_mapfeature.the_geom_webmercator)",
+			"ST_Y(treemap_mapfeature.the_geom_webmercator)")
+	}
+
+	columns = append(columns, "treemap_tree.id as "+IdColumn)
+
+	if f.GroupColumn != "" {
+		if indexOf(f.GroupColumn, GroupColumns) < 0 {
+			return "", nil, fmt.Errorf(
+				"Can't group by %v, expected one of %v",
+				f.GroupColumn, strings.Join(GroupColumns, ", "))
+		}
+
+		columns = append(columns, fmt.Sprintf(
+			"treemap_tree.%v::text as %v", f.GroupColumn, f.GroupColumn))
+	}
+
+	query := fmt.Sprintf(`select %v
+		  from treemap_tree
+		    inner join treemap_plot
+		      on treemap_plot.mapfeature_ptr_id = treemap_tree.plot_id
+		    inner join treemap_mapfeature
+		      on treemap_mapfeature.id = treemap_plot.mapfeature_ptr_id
+		    left join treemap_species
+		      on treemap_species.id = treemap_tree.species_id
+		  where %v`,
+		strings.Join(columns, ", "),
+		strings.Join(q.conditions, " and "))
+
+	return query, q.args, nil
+}
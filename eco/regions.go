@@ -0,0 +1,141 @@
+package eco
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The names of the region geometry files in a data
+// directory, in the order they are looked for
+var RegionFiles = []string{"regions.geojson", "regions.shp"}
+
+// The name of the attribute (a GeoJSON property or a
+// shapefile field) that has the code of each region
+const RegionCodeAttribute = "code"
+
+// Load the region geometries from the first of RegionFiles
+// that exists in a directory
+//
+// Returns an error satisfying os.IsNotExist if none of
+// the files exist
+func LoadRegionGeoms(basePath string) (map[int]Region, error) {
+	for _, name := range RegionFiles {
+		path := filepath.Join(basePath, name)
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		if strings.HasSuffix(name, ".shp") {
+			return LoadRegionShapefile(path)
+		}
+
+		return LoadRegionGeoJSON(path)
+	}
+
+	return nil, &os.PathError{Op: "open",
+		Path: filepath.Join(basePath, RegionFiles[0]), Err: os.ErrNotExist}
+}
+
+// Load region geometries, in RegionSRID, from a GeoJSON
+// FeatureCollection of polygons and multipolygons
+//
+// The code of each region is given by its RegionCodeAttribute
+// property. Coordinates are longitude and latitude unless the
+// collection has a crs. Regions are numbered from one in the
+// order of the features
+func LoadRegionGeoJSON(path string) (map[int]Region, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := &GeoJSONFeatureCollection{}
+
+	if err = json.Unmarshal(data, collection); err != nil {
+		return nil, err
+	}
+
+	if collection.Type != "FeatureCollection" {
+		return nil, errors.New(fmt.Sprintf(
+			"Expected a GeoJSON FeatureCollection in %v", path))
+	}
+
+	srid := SRIDWGS84
+
+	if collection.Crs != nil {
+		if srid, err = collection.Crs.Srid(); err != nil {
+			return nil, err
+		}
+	}
+
+	regions := make(map[int]Region)
+
+	for i, feature := range collection.Features {
+		if feature == nil {
+			return nil, &DataError{path, 0,
+				fmt.Sprintf("Region %v is null, expected a Feature", i+1)}
+		}
+
+		var properties map[string]interface{}
+
+		if feature.Properties != nil {
+			if err = json.Unmarshal(feature.Properties, &properties); err != nil {
+				return nil, err
+			}
+		}
+
+		code, _ := properties[RegionCodeAttribute].(string)
+
+		if code == "" || feature.Geometry == nil {
+			return nil, errors.New(fmt.Sprintf(
+				"Region %v in %v needs a %v and a geometry",
+				i+1, path, RegionCodeAttribute))
+		}
+
+		region, err := makeRegion(code, feature.Geometry, srid)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"Region %v (%v) in %v: %v", i+1, code, path, err))
+		}
+
+		regions[i+1] = region
+	}
+
+	return regions, nil
+}
+
+// Make a region from a GeoJSON geometry in srid
+func makeRegion(code string, geometry *GeoJSONGeometry, srid int) (Region, error) {
+	if geometry.Type != "Polygon" && geometry.Type != "MultiPolygon" {
+		return Region{}, errors.New(fmt.Sprintf(
+			"Expected a Polygon or MultiPolygon, got %v", geometry.Type))
+	}
+
+	geometry, err := geometry.Reproject(srid, RegionSRID)
+
+	if err != nil {
+		return Region{}, err
+	}
+
+	wkt, err := geometry.WKT()
+
+	if err != nil {
+		return Region{}, err
+	}
+
+	geom, err := ParseGeosGeom(wkt)
+
+	if err != nil {
+		return Region{}, err
+	}
+
+	return Region{code, geom}, nil
+}
@@ -0,0 +1,313 @@
+package eco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ESRI shapefile polygon shape types
+const (
+	shpNull     = 0
+	shpPolygon  = 5
+	shpPolygonZ = 15
+	shpPolygonM = 25
+)
+
+// Load region geometries, in RegionSRID, from a polygon
+// shapefile
+//
+// The .dbf file next to the .shp file must have a
+// RegionCodeAttribute field. The .prj file, if there is one,
+// must be for longitude and latitude or web mercator; without
+// it coordinates are taken to be longitude and latitude.
+// Regions are numbered from one in the order of the records
+func LoadRegionShapefile(path string) (map[int]Region, error) {
+	base := strings.TrimSuffix(path, ".shp")
+
+	shp, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dbf, err := ioutil.ReadFile(base + ".dbf")
+
+	if err != nil {
+		return nil, err
+	}
+
+	srid := SRIDWGS84
+	prj, err := ioutil.ReadFile(base + ".prj")
+
+	if err == nil {
+		if srid, err = prjSrid(string(prj)); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	shapes, err := readShpPolygons(shp)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", path, err))
+	}
+
+	codes, err := readDbfColumn(dbf, RegionCodeAttribute)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v.dbf: %v", base, err))
+	}
+
+	if len(codes) != len(shapes) {
+		return nil, errors.New(fmt.Sprintf(
+			"%v has %v shapes but %v.dbf has %v records",
+			path, len(shapes), base, len(codes)))
+	}
+
+	regions := make(map[int]Region)
+
+	for i, polygons := range shapes {
+		// Records without a shape don't have a region
+		if polygons == nil {
+			continue
+		}
+
+		coordinates, err := json.Marshal(polygons)
+
+		if err != nil {
+			return nil, err
+		}
+
+		region, err := makeRegion(codes[i],
+			&GeoJSONGeometry{"MultiPolygon", coordinates}, srid)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"Region %v (%v) in %v: %v", i+1, codes[i], path, err))
+		}
+
+		regions[i+1] = region
+	}
+
+	return regions, nil
+}
+
+// Get the SRID of a shapefile projection (a .prj file). Only
+// longitude and latitude and web mercator are supported
+func prjSrid(prj string) (int, error) {
+	prj = strings.ToUpper(prj)
+
+	if strings.HasPrefix(strings.TrimSpace(prj), "GEOGCS") {
+		return SRIDWGS84, nil
+	}
+
+	if strings.Contains(prj, "WEB_MERCATOR") ||
+		strings.Contains(prj, "PSEUDO-MERCATOR") ||
+		strings.Contains(prj, "PSEUDO_MERCATOR") {
+
+		return SRIDWebMercator, nil
+	}
+
+	return 0, errors.New(
+		"Unsupported shapefile projection, regions must be " +
+			"in longitude and latitude or web mercator")
+}
+
+// Read the polygons of each record in a .shp file as the
+// coordinates of a GeoJSON MultiPolygon. Records with a null
+// shape are nil
+func readShpPolygons(shp []byte) ([][][][][]float64, error) {
+	if len(shp) < 100 || binary.BigEndian.Uint32(shp) != 9994 {
+		return nil, errors.New("Not a shapefile")
+	}
+
+	kind := binary.LittleEndian.Uint32(shp[32:])
+
+	if kind != shpPolygon && kind != shpPolygonZ && kind != shpPolygonM {
+		return nil, errors.New(fmt.Sprintf(
+			"Expected a polygon shapefile, got shape type %v", kind))
+	}
+
+	shapes := make([][][][][]float64, 0)
+	reader := bytes.NewReader(shp[100:])
+
+	for reader.Len() > 0 {
+		var header struct {
+			Number, Length int32
+		}
+
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+
+		// Lengths are in 16 bit words
+		content := make([]byte, header.Length*2)
+
+		if _, err := io.ReadFull(reader, content); err != nil || len(content) < 4 {
+			return nil, errors.New(fmt.Sprintf(
+				"Record %v is truncated", header.Number))
+		}
+
+		polygons, err := readShpPolygon(content)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"Record %v: %v", header.Number, err))
+		}
+
+		shapes = append(shapes, polygons)
+	}
+
+	return shapes, nil
+}
+
+// Read the rings of a polygon record and group them into
+// polygons. Shells are clockwise and holes counterclockwise,
+// and each hole belongs to the shell that contains it
+func readShpPolygon(content []byte) ([][][][]float64, error) {
+	reader := bytes.NewReader(content)
+
+	var kind int32
+	binary.Read(reader, binary.LittleEndian, &kind)
+
+	if kind == shpNull {
+		return nil, nil
+	}
+
+	var header struct {
+		Bbox            [4]float64
+		NParts, NPoints int32
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if header.NParts <= 0 || header.NPoints <= 0 ||
+		int(header.NParts)*4+int(header.NPoints)*16 > reader.Len() {
+
+		return nil, errors.New("Invalid polygon")
+	}
+
+	parts := make([]int32, header.NParts+1)
+	points := make([][2]float64, header.NPoints)
+
+	binary.Read(reader, binary.LittleEndian, parts[:header.NParts])
+	binary.Read(reader, binary.LittleEndian, points)
+
+	parts[header.NParts] = header.NPoints
+
+	shells := make([]*planarRing, 0)
+	polygons := make([][][][]float64, 0)
+	holes := make([]*planarRing, 0)
+
+	for i := 0; i < int(header.NParts); i++ {
+		if parts[i] < 0 || parts[i] > parts[i+1] {
+			return nil, errors.New("Invalid polygon parts")
+		}
+
+		ring, err := newPlanarRing(points[parts[i]:parts[i+1]])
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Shells have a negative signed area
+		if area, _, _ := ringMoments(ring.points); area < 0 {
+			shells = append(shells, ring)
+			polygons = append(polygons,
+				[][][]float64{ringCoordinates(ring)})
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+
+	for _, hole := range holes {
+		found := false
+
+		for i, shell := range shells {
+			polygon := newPlanarGeometry([]*planarPolygon{
+				&planarPolygon{rings: []*planarRing{shell}}})
+
+			if polygon.contains(hole.points[0][0], hole.points[0][1]) {
+				polygons[i] = append(polygons[i], ringCoordinates(hole))
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, errors.New("Hole outside of every shell")
+		}
+	}
+
+	return polygons, nil
+}
+
+func ringCoordinates(ring *planarRing) [][]float64 {
+	coordinates := make([][]float64, len(ring.points))
+
+	for i, point := range ring.points {
+		coordinates[i] = []float64{point[0], point[1]}
+	}
+
+	return coordinates
+}
+
+// Read the values of a column in a dBASE (.dbf) file, with
+// their padding trimmed. Deleted records have empty values
+func readDbfColumn(dbf []byte, column string) ([]string, error) {
+	if len(dbf) < 32 {
+		return nil, errors.New("Not a dBASE file")
+	}
+
+	nrecords := int(binary.LittleEndian.Uint32(dbf[4:]))
+	headerLength := int(binary.LittleEndian.Uint16(dbf[8:]))
+	recordLength := int(binary.LittleEndian.Uint16(dbf[10:]))
+
+	if headerLength+nrecords*recordLength > len(dbf) {
+		return nil, errors.New("dBASE file is truncated")
+	}
+
+	// Field descriptors are 32 bytes each and end with 0x0d.
+	// Each record starts with a deletion flag
+	offset, length := -1, 0
+
+	for pos, start := 32, 1; pos+32 <= headerLength && dbf[pos] != 0x0d; pos += 32 {
+		name := string(bytes.TrimRight(dbf[pos:pos+11], "\x00"))
+		size := int(dbf[pos+16])
+
+		if strings.EqualFold(name, column) {
+			offset, length = start, size
+			break
+		}
+
+		start += size
+	}
+
+	if offset < 0 || offset+length > recordLength {
+		return nil, errors.New(fmt.Sprintf("No %v field", column))
+	}
+
+	values := make([]string, nrecords)
+
+	for i := range values {
+		record := dbf[headerLength+i*recordLength:]
+
+		if record[0] == '*' {
+			continue
+		}
+
+		values[i] = strings.TrimSpace(string(record[offset : offset+length]))
+	}
+
+	return values, nil
+}
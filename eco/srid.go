@@ -0,0 +1,112 @@
+package eco
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Spatial reference systems that points can be given in
+const (
+	// Longitude and latitude
+	SRIDWGS84 = 4326
+
+	// Web mercator, in meters
+	SRIDWebMercator = 3857
+)
+
+// The radius of the sphere used by web mercator
+const webMercatorRadius = 6378137.0
+
+// The latitude where web mercator becomes square. Points
+// past it can't be projected
+const maxWebMercatorLatitude = 85.0511287798
+
+// Reproject a point from one SRID to another. Only
+// SRIDWGS84 and SRIDWebMercator are supported
+func Reproject(x float64, y float64, from int, to int) (float64, float64, error) {
+	for _, srid := range []int{from, to} {
+		if srid != SRIDWGS84 && srid != SRIDWebMercator {
+			return 0, 0, errors.New(
+				fmt.Sprintf("Unsupported SRID %v, expected %v or %v",
+					srid, SRIDWGS84, SRIDWebMercator))
+		}
+	}
+
+	if from == to {
+		return x, y, nil
+	}
+
+	if from == SRIDWGS84 {
+		if math.Abs(y) > maxWebMercatorLatitude || math.Abs(x) > 180 {
+			return 0, 0, errors.New(
+				fmt.Sprintf("Longitude %v, latitude %v is outside of web mercator",
+					x, y))
+		}
+
+		lon := x * math.Pi / 180
+		lat := y * math.Pi / 180
+
+		return webMercatorRadius * lon,
+			webMercatorRadius * math.Log(math.Tan(math.Pi/4+lat/2)), nil
+	}
+
+	lon := x / webMercatorRadius
+	lat := 2*math.Atan(math.Exp(y/webMercatorRadius)) - math.Pi/2
+
+	return lon * 180 / math.Pi, lat * 180 / math.Pi, nil
+}
+
+// The SRID of the region geometries. They are transformed
+// to it when they are loaded
+const RegionSRID = SRIDWebMercator
+
+// The largest x or y in web mercator
+const webMercatorExtent = 20037508.342789244
+
+// Check that a point is a valid coordinate in an SRID
+//
+// Web mercator points must be inside its extent. Since no i-Tree
+// region is near the web mercator origin, points that look like
+// longitude and latitude are rejected as well
+func CheckPoint(x float64, y float64, srid int) error {
+	lonlat := math.Abs(x) <= 180 && math.Abs(y) <= 90
+
+	switch srid {
+	case SRIDWGS84:
+		if !lonlat {
+			return errors.New(fmt.Sprintf(
+				"Point (%v, %v) is not a longitude and latitude, "+
+					"but its SRID is %v", x, y, srid))
+		}
+
+	case SRIDWebMercator:
+		if lonlat {
+			return errors.New(fmt.Sprintf(
+				"Point (%v, %v) looks like a longitude and latitude, "+
+					"but its SRID is %v. Use %v for longitude and latitude",
+				x, y, srid, SRIDWGS84))
+		}
+
+		if math.Abs(x) > webMercatorExtent || math.Abs(y) > webMercatorExtent {
+			return errors.New(fmt.Sprintf(
+				"Point (%v, %v) is outside of web mercator", x, y))
+		}
+
+	default:
+		return errors.New(
+			fmt.Sprintf("Unsupported SRID %v, expected %v or %v",
+				srid, SRIDWGS84, SRIDWebMercator))
+	}
+
+	return nil
+}
+
+// Check a point and reproject it to RegionSRID
+func ToRegionSRID(x float64, y float64, srid int) (float64, float64, error) {
+	if err := CheckPoint(x, y, srid); err != nil {
+		return 0, 0, err
+	}
+
+	return Reproject(x, y, srid, RegionSRID)
+}
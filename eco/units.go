@@ -0,0 +1,128 @@
+package eco
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A unit of the data files (see FactorUnits and DiameterUnit)
+// and its metric and imperial equivalents
+type Unit struct {
+	// The metric unit. Units that are already metric
+	// are their own equivalent
+	Metric string
+
+	// The number of Metric units in one of this unit
+	ToMetric float64
+
+	// The imperial unit. Units that are used in both
+	// systems (like kWh) are their own equivalent
+	Imperial string
+
+	// The number of Imperial units in one of this unit
+	ToImperial float64
+}
+
+// The units of the data files, by name. Factors with
+// other units aren't converted
+//
+// Natural gas is in kBtu, which isn't metric, so it's
+// in kWh for metric benefits and therms for imperial
+var Units = map[string]Unit{
+	"kWh":  {"kWh", 1, "kWh", 1},
+	"kBtu": {"kWh", 0.29307107, "therms", 0.01},
+	"m^3":  {"m^3", 1, "gal", 264.172052},
+	"kg":   {"kg", 1, "lbs", 2.20462262},
+	"m^2":  {"m^2", 1, "ft^2", 10.7639104},
+	"cm":   {"cm", 1, "in", 1 / CentimetersPerInch}}
+
+// A system of units for benefits
+type UnitSystem string
+
+const (
+	// The units of the data files, unconverted. This is
+	// the default, so benefits don't change for requests
+	// that don't ask for a unit system
+	DataUnits UnitSystem = ""
+
+	// The metric equivalents of the units of the data
+	// files, which are mostly the same (see Units)
+	MetricUnits UnitSystem = "metric"
+
+	// The imperial equivalents of the units of the data
+	// files (see Units)
+	ImperialUnits UnitSystem = "imperial"
+)
+
+// Parse the name of a unit system. An empty name gives
+// DataUnits
+func ParseUnitSystem(name string) (UnitSystem, error) {
+	switch UnitSystem(name) {
+	case DataUnits:
+		return DataUnits, nil
+	case MetricUnits:
+		return MetricUnits, nil
+	case ImperialUnits:
+		return ImperialUnits, nil
+	}
+
+	return "", errors.New(fmt.Sprintf(
+		"Invalid units %v, expected %v or %v",
+		name, MetricUnits, ImperialUnits))
+}
+
+// Get the unit of the system that replaces a unit of the
+// data files, and the number of those units in one of it
+func (system UnitSystem) Convert(unit string) (string, float64) {
+	u, found := Units[unit]
+
+	if !found || system == DataUnits {
+		return unit, 1
+	}
+
+	if system == ImperialUnits {
+		return u.Imperial, u.ToImperial
+	}
+
+	return u.Metric, u.ToMetric
+}
+
+// Get the unit of each of a set of factors in the system
+func (system UnitSystem) FactorUnits(factors *FactorSet) map[string]string {
+	units := make(map[string]string, factors.Len())
+
+	for _, factor := range factors.Names() {
+		units[factor], _ = system.Convert(factors.Unit(factor))
+	}
+
+	return units
+}
+
+// Convert the benefits in a map of factors (as returned by
+// FactorSet.ArrayToMap) from the units of the data files to
+// the system. Keys that aren't in the set are left alone
+func (system UnitSystem) ConvertFactorMap(
+	factors *FactorSet, factormap map[string]float64) {
+
+	for factor, value := range factormap {
+		if factors.Index(factor) >= 0 {
+			_, scale := system.Convert(factors.Unit(factor))
+			factormap[factor] = value * scale
+		}
+	}
+}
+
+// Get the number of centimeters (DiameterUnit) in one of
+// the given diameter unit, which is either "cm" or "in"
+func DiameterScale(unit string) (float64, error) {
+	switch unit {
+	case DiameterUnit:
+		return 1, nil
+	case Units[DiameterUnit].Imperial:
+		return CentimetersPerInch, nil
+	}
+
+	return 0, errors.New(fmt.Sprintf(
+		"Invalid diameter units %v, expected %v or %v",
+		unit, DiameterUnit, Units[DiameterUnit].Imperial))
+}
@@ -0,0 +1,177 @@
+package eco
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The most species listed in a single validation problem
+const maxValidationSpecies = 10
+
+// Check the data files in a directory
+//
+// This reports the problems that would stop the files from
+// loading (see ReadDatafile) along with problems that don't,
+// but give wrong or missing benefits:
+//
+// - Regions without a data file for a factor (see ReadFactorSet)
+// - Species in some of a region's factor files but not others
+//
+// Returns an error only if the directory can't be read. The
+// problems are sorted by file and line
+func ValidateData(basePath string) (DataErrors, error) {
+	return ValidateOverrideData(basePath, nil)
+}
+
+// Check the data files in a directory that overrides base
+// (see FactorData.Override), like ValidateData
+//
+// A region missing a factor isn't a problem if base has
+// data for that region and factor, since it's kept
+func ValidateOverrideData(basePath string, base *FactorData) (DataErrors, error) {
+	names, err := listDataFiles(os.DirFS(basePath), basePath)
+	problems := DataErrors{}
+
+	if errs, ok := err.(DataErrors); ok {
+		problems = append(problems, errs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	factors, err := dataFactorSet(names)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Regions end up with the factors of both
+	if base != nil {
+		factors, err = base.Factors.Union(factors)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The factor files (blended and building type) of
+	// each region, by file path
+	regions := make(map[string]map[string]*Datafile)
+
+	for _, name := range names {
+		factor, _ := factors.splitBuildingTypeFactor(name.factor)
+
+		if factors.Index(name.factor) < 0 && factor == "" &&
+			name.factor != growthFactor {
+
+			continue
+		}
+
+		fi, err := name.fsys.Open(name.name)
+
+		if err != nil {
+			problems = append(problems, &DataError{name.path, 0, err.Error()})
+			continue
+		}
+
+		datafile, errs, err := parseDatafile(name.path, fi)
+		fi.Close()
+
+		if err != nil {
+			problems = append(problems, &DataError{name.path, 0, err.Error()})
+			continue
+		}
+
+		problems = append(problems, errs...)
+
+		if datafile == nil || name.factor == growthFactor {
+			continue
+		}
+
+		if regions[name.region] == nil {
+			regions[name.region] = make(map[string]*Datafile)
+		}
+
+		regions[name.region][name.path] = datafile
+	}
+
+	for region, datafiles := range regions {
+		problems = append(problems,
+			validateRegion(basePath, factors, base, region, datafiles)...)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Path != problems[j].Path {
+			return problems[i].Path < problems[j].Path
+		}
+
+		return problems[i].Line < problems[j].Line
+	})
+
+	return problems, nil
+}
+
+// Check that a region has every factor, either in the
+// directory or in base, and that each of its factor files
+// has the same species
+func validateRegion(
+	basePath string, factors *FactorSet, base *FactorData,
+	region string, datafiles map[string]*Datafile) DataErrors {
+
+	problems := DataErrors{}
+
+	for _, factor := range factors.Names() {
+		path := filepath.Join(basePath,
+			fmt.Sprintf("output__%v__%v.csv", region, factor))
+
+		if _, found := datafiles[path]; !found &&
+			!base.hasFactor(region, factor) {
+
+			problems = append(problems, &DataError{path, 0,
+				fmt.Sprintf("Region %v has no %v data", region, factor)})
+		}
+	}
+
+	species := make(map[string]bool)
+
+	for _, datafile := range datafiles {
+		for code := range datafile.Values {
+			species[code] = true
+		}
+	}
+
+	for path, datafile := range datafiles {
+		missing := make([]string, 0)
+
+		for code := range species {
+			if _, found := datafile.Values[code]; !found {
+				missing = append(missing, code)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		sort.Strings(missing)
+
+		listed := missing
+		if len(listed) > maxValidationSpecies {
+			listed = listed[:maxValidationSpecies]
+		}
+
+		message := fmt.Sprintf(
+			"Missing %v species that other %v files have: %v",
+			len(missing), region, strings.Join(listed, ", "))
+
+		if len(listed) < len(missing) {
+			message += ", ..."
+		}
+
+		problems = append(problems, &DataError{path, 0, message})
+	}
+
+	return problems
+}
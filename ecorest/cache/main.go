@@ -3,9 +3,14 @@ package cache
 import (
 	"errors"
 	"fmt"
+	"github.com/OpenTreeMap/otm-ecoservice/data"
 	"github.com/OpenTreeMap/otm-ecoservice/eco"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/config"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 )
 
 type speciesDataMap map[string]map[string]string
@@ -14,56 +19,278 @@ type overridesMap map[int]map[string]map[int]string
 
 type regionDataMap map[string][]*eco.Datafile
 
+type buildingDataMap map[string]map[string][]*eco.Datafile
+
+type growthDataMap map[string]*eco.Datafile
+
 type regionGeometryMap map[int]eco.Region
 
+type pricesMap map[string][]float64
+
 type iTreeCodeRetrieverFunc func(string, int, string, int) (string, error)
 
-type Cache struct {
+// The data loaded by the cache
+//
+// A snapshot isn't changed once it has been loaded. Invalidating
+// the cache loads a new one, so a request that uses a single
+// snapshot throughout never mixes data from different loads
+// (for instance a factor set with data read for another one)
+type Snapshot struct {
+	// The factors that are calculated. The data and
+	// prices are indexed by the set these came from
+	Factors *eco.FactorSet
+
 	RegionData     regionDataMap
+	BuildingData   buildingDataMap
+	GrowthData     growthDataMap
 	RegionGeometry regionGeometryMap
+	RegionIndex    *eco.RegionIndex
 	Overrides      overridesMap
 	SpeciesData    speciesDataMap
+	Prices         pricesMap
 	GetITreeCode   iTreeCodeRetrieverFunc
-	Db             eco.DBContext
+
+	// The database is nil when running standalone
+	Db *eco.DBContext
+
+	// True if RegionGeometry was loaded from the database
+	// rather than the data directory
+	RegionsFromDb bool
+
+	// Set from the config, this doesn't change when
+	// the cache is invalidated
+	AllowRawSql bool
+}
+
+// The current snapshot of the data, which is replaced as
+// a whole when the cache is invalidated
+type Cache struct {
+	snapshot atomic.Value
+}
+
+// Get the current data. Requests should get it once and
+// use it for everything they do
+func (cache *Cache) Snapshot() *Snapshot {
+	snapshot, _ := cache.snapshot.Load().(*Snapshot)
+	return snapshot
+}
+
+// Replace the data. Requests that already have the
+// previous snapshot keep using it
+func (cache *Cache) Store(snapshot *Snapshot) {
+	cache.snapshot.Store(snapshot)
 }
 
 func Init(cfg config.Config) (*Cache, func()) {
 	cache := &Cache{}
 	return cache, func() {
-		dbraw, err := eco.OpenDatabaseConnection(&cfg.Database)
-		config.PanicOnError(err)
+		// The connection pool lives on in the cache. The database
+		// config doesn't change, so when the cache is invalidated
+		// the pool is reused rather than replaced, which would
+		// mean closing it under requests that are still using it
+		var db *eco.DBContext
 
-		// this is tricky. Though the db connection will close at
-		// the end of this function, we cast it and keep a pointer in
-		// the cache, so the actual struct will live on, and be used
-		// for data to open new database connections
-		db := (*eco.DBContext)(dbraw)
-		defer dbraw.Close()
+		if previous := cache.Snapshot(); previous != nil {
+			db = previous.Db
+		}
+
+		if !cfg.Standalone && db == nil {
+			dbraw, err := eco.OpenDatabaseConnection(&cfg.Database)
+			config.PanicOnError(err)
+
+			db = (*eco.DBContext)(dbraw)
+		}
 
 		eco.InitGeos()
 
-		regiondata := eco.LoadFiles(cfg.DataPath)
-		speciesdata, err := eco.LoadSpeciesMap(cfg.DataPath + "/species.json")
+		// The data embedded in the binary is the default. Each
+		// region in the data directory, if there is one, replaces
+		// the embedded region with the same code
+		factordata, _, err := eco.ReadFactorDataFS(data.Files, "data")
+		config.PanicOnError(err)
+
+		speciesdata, err := eco.LoadSpeciesMapFS(data.Files, "species.json")
 		config.PanicOnError(err)
-		overrides, err := db.GetOverrideMap()
 
-		if err != nil {
-			log.Fatal(err)
+		if cfg.DataPath != "" {
+			config.PanicOnError(overrideData(
+				cfg.DataPath, factordata, speciesdata))
 		}
 
-		regiongeometry, err := db.GetRegionGeoms()
+		// Prices are indexed like the data, so they can only
+		// be loaded once the factors are known
+		prices, err := loadPrices(cfg.DataPath, factordata.Factors)
+		config.PanicOnError(err)
+
+		factors, err := factordata.Factors.Subset(cfg.Factors)
+		config.PanicOnError(err)
+
+		regiondata := factordata.Regions
+		buildingdata := factordata.BuildingTypes
+		growthdata := factordata.Growth
+
+		overrides := make(overridesMap)
+
+		if db != nil {
+			overrides, err = db.GetOverrideMap()
+
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// Region geometries in the data directory take
+		// precedence over the ones in the database
+		regiongeometry, err := loadRegionGeoms(cfg.DataPath)
+		regionsfromdb := false
+
+		if os.IsNotExist(err) && db != nil {
+			log.Println("No region geometries found in the data " +
+				"directory, loading them from the database")
+
+			regiongeometry, err = db.GetRegionGeoms()
+			regionsfromdb = true
+		}
+
+		// Without a database there's nowhere else to
+		// find the regions
+		if os.IsNotExist(err) && db == nil {
+			log.Fatalf("Standalone mode needs the region geometries "+
+				"(%v) in the data directory. Set OTM_ECO_DATA_DIR to "+
+				"a directory that has them",
+				strings.Join(eco.RegionFiles, " or "))
+		}
+
+		config.PanicOnError(err)
+
+		regions := make([]eco.Region, 0, len(regiongeometry))
+		for _, region := range regiongeometry {
+			regions = append(regions, region)
+		}
+
+		regionindex, err := eco.NewRegionIndex(regions)
 		config.PanicOnError(err)
 
 		retriever := makeItreeCodeRetriever(overrides, speciesdata)
-		cache.RegionData = regiondata
-		cache.RegionGeometry = regiongeometry
-		cache.Overrides = overrides
-		cache.SpeciesData = speciesdata
-		cache.GetITreeCode = retriever
-		cache.Db = *db
+		cache.Store(&Snapshot{
+			Factors:        factors,
+			RegionData:     regiondata,
+			BuildingData:   buildingdata,
+			GrowthData:     growthdata,
+			RegionGeometry: regiongeometry,
+			RegionIndex:    regionindex,
+			Overrides:      overrides,
+			SpeciesData:    speciesdata,
+			Prices:         prices,
+			GetITreeCode:   retriever,
+			Db:             db,
+			RegionsFromDb:  regionsfromdb,
+			AllowRawSql:    cfg.AllowRawSql})
 	}
 }
 
+// Replace the embedded data of each region in a data directory
+//
+// species.json is optional, and replaces the species map
+// of the regions it has
+func overrideData(
+	dataPath string, factordata *eco.FactorData,
+	speciesdata speciesDataMap) error {
+
+	override, bundlepath, err := eco.ReadFactorData(dataPath)
+
+	if err != nil {
+		return err
+	}
+
+	if bundlepath != "" {
+		log.Println("Loaded the factor data from", bundlepath)
+	}
+
+	for region := range override.Regions {
+		log.Println("Using the factor data for", region, "in", dataPath)
+	}
+
+	if err = factordata.Override(override); err != nil {
+		return err
+	}
+
+	overridespecies, err := eco.LoadSpeciesMap(
+		filepath.Join(dataPath, "species.json"))
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for region, species := range overridespecies {
+		speciesdata[region] = species
+	}
+
+	return nil
+}
+
+// Load the embedded prices for the factor data of a set of
+// factors. The prices.json in the data directory, if there
+// is one, replaces the prices of the regions it has
+func loadPrices(dataPath string, factors *eco.FactorSet) (pricesMap, error) {
+	prices, err := eco.LoadPricesFS(data.Files, "prices.json", factors)
+
+	if err != nil || dataPath == "" {
+		return prices, err
+	}
+
+	overrideprices, err := eco.LoadPricesFS(
+		os.DirFS(dataPath), "prices.json", factors)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for region, regionprices := range overrideprices {
+		prices[region] = regionprices
+	}
+
+	return prices, nil
+}
+
+// Load the region geometries in a data directory, as in
+// eco.LoadRegionGeoms. Without a data directory this returns
+// an error satisfying os.IsNotExist
+func loadRegionGeoms(dataPath string) (map[int]eco.Region, error) {
+	if dataPath == "" {
+		return nil, os.ErrNotExist
+	}
+
+	return eco.LoadRegionGeoms(dataPath)
+}
+
+// Get the regions that intersect the bounds of an instance
+func (cache *Snapshot) RegionsForInstance(instance int) ([]eco.Region, error) {
+	if cache.Db == nil {
+		return nil, errors.New(
+			"Instances can't be used without an OpenTreeMap database")
+	}
+
+	if cache.RegionsFromDb {
+		return cache.Db.GetRegionsForInstance(cache.RegionGeometry, instance)
+	}
+
+	bounds, err := cache.Db.GetInstanceBounds(instance)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer eco.GeosDestroy(bounds)
+
+	regions := make([]eco.Region, 0, len(cache.RegionGeometry))
+	for _, region := range cache.RegionGeometry {
+		regions = append(regions, region)
+	}
+
+	return eco.RegionsIntersecting(regions, bounds)
+}
+
 func makeItreeCodeRetriever(overrides overridesMap, speciesdata speciesDataMap) iTreeCodeRetrieverFunc {
 	// This is implemented as a curried function so it can
 	// close over the variables set at the start of the main
@@ -3,13 +3,32 @@ package config
 import (
 	"github.com/OpenTreeMap/otm-ecoservice/eco"
 	"os"
+	"strings"
 )
 
 type Config struct {
-	Database   eco.DBInfo
-	DataPath   string
+	Database eco.DBInfo
+
+	// An optional directory of data that replaces the data
+	// embedded in the binary, region by region
+	DataPath string
+
+	// The factors to calculate, a subset of the factors of
+	// the data. Empty for all of them
+	Factors []string
+
 	ServerHost string
 	ServerPort string
+
+	// Allow summaries to run the raw SQL in their request
+	// instead of using filters. This lets any client run
+	// arbitrary queries against the database
+	AllowRawSql bool
+
+	// Run without an OpenTreeMap database. Region geometries
+	// must then be in the data directory (see eco.RegionFiles),
+	// and requests for instances or summaries fail
+	Standalone bool
 }
 
 func getEnvOrDefault(name string, defaultVal string) string {
@@ -20,6 +39,21 @@ func getEnvOrDefault(name string, defaultVal string) string {
 	return defaultVal
 }
 
+// Get a comma separated list from the environment. Returns
+// nil if the variable isn't set
+func getListEnv(name string) []string {
+	val := os.Getenv(name)
+	if val == "" {
+		return nil
+	}
+
+	items := strings.Split(val, ",")
+	for i, item := range items {
+		items[i] = strings.TrimSpace(item)
+	}
+	return items
+}
+
 func LoadConfig() Config {
 	return Config{
 		Database: eco.DBInfo{
@@ -28,9 +62,12 @@ func LoadConfig() Config {
 			Database: getEnvOrDefault("OTM_DB_NAME", "otm"),
 			Host:     getEnvOrDefault("OTM_DB_HOST", "localhost"),
 		},
-		DataPath:   getEnvOrDefault("OTM_ECO_DATA_DIR", "../data/"),
-		ServerHost: getEnvOrDefault("OTM_ECO_HOST", "127.0.0.1"),
-		ServerPort: getEnvOrDefault("OTM_ECO_PORT", "13000"),
+		DataPath:    getEnvOrDefault("OTM_ECO_DATA_DIR", ""),
+		Factors:     getListEnv("OTM_ECO_FACTORS"),
+		ServerHost:  getEnvOrDefault("OTM_ECO_HOST", "127.0.0.1"),
+		ServerPort:  getEnvOrDefault("OTM_ECO_PORT", "13000"),
+		AllowRawSql: getEnvOrDefault("OTM_ECO_ALLOW_RAW_SQL", "") == "true",
+		Standalone:  getEnvOrDefault("OTM_ECO_STANDALONE", "") == "true",
 	}
 }
 
@@ -7,12 +7,87 @@ import (
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
 	"net/url"
 	"strconv"
+	"strings"
 )
 
 // We can't marshall maps directly with
 // go-rest so we just wrap it here
+//
+// Dollars has the same keys as Benefits (plus a
+// "total" key, which leaves out eco.StockFactors) and
+// holds the dollar value of each factor. Units has the
+// unit of each of the benefits
 type BenefitsWrapper struct {
 	Benefits map[string]float64
+	Dollars  map[string]float64
+	Units    map[string]string `json:",omitempty"`
+}
+
+// The factors and units of a request
+//
+// Only the factors in the request's "factors" are calculated,
+// or all of the service's factors if it doesn't have any.
+// Benefits are in the unit system given by its "units"
+// ("metric" or "imperial", or the units of the data files by
+// default). Diameters are in its
+// "diameter_units" ("in" or "cm"), which defaults to a unit
+// that depends on the endpoint
+type requestOptions struct {
+	factors *eco.FactorSet
+	system  eco.UnitSystem
+
+	// The number of centimeters in one diameter unit
+	diameterScale float64
+}
+
+func parseRequestOptions(
+	cache *cache.Snapshot, factornames []string,
+	units string, diameterUnits string,
+	defaultDiameterUnits string) (*requestOptions, error) {
+
+	factors, err := cache.Factors.Subset(factornames)
+
+	if err != nil {
+		return nil, err
+	}
+
+	system, err := eco.ParseUnitSystem(units)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if diameterUnits == "" {
+		diameterUnits = defaultDiameterUnits
+	}
+
+	scale, err := eco.DiameterScale(diameterUnits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestOptions{factors, system, scale}, nil
+}
+
+// Convert an array of the request's factors into a map
+// of their benefits in the request's units
+func (options *requestOptions) benefits(factors []float64) map[string]float64 {
+	factormap := options.factors.ArrayToMap(factors)
+	options.system.ConvertFactorMap(options.factors, factormap)
+
+	return factormap
+}
+
+// Convert an array of the dollar values of the request's
+// factors into a map with a "total"
+func (options *requestOptions) dollars(dollars []float64) map[string]float64 {
+	return options.factors.DollarArrayToMap(dollars)
+}
+
+// Get the unit of each of the request's factors
+func (options *requestOptions) units() map[string]string {
+	return options.system.FactorUnits(options.factors)
 }
 
 // Given a values list return the single value
@@ -28,6 +103,29 @@ func getSingleValue(in url.Values, key string) (string, error) {
 		fmt.Sprintf("Missing or invalid %v parameter", key))
 }
 
+// Given a values list return the single value
+// associated with an optional key. Missing keys
+// give an empty string
+func getOptionalValue(in url.Values, key string) (string, error) {
+	if _, ok := in[key]; !ok {
+		return "", nil
+	}
+
+	return getSingleValue(in, key)
+}
+
+// Check that a building type is either empty (to use
+// the blended factors) or a known building type
+func checkBuildingType(buildingtype string) error {
+	if buildingtype == "" || eco.IsBuildingType(buildingtype) {
+		return nil
+	}
+
+	return errors.New(
+		fmt.Sprintf("Invalid building type %v, expected one of %v",
+			buildingtype, eco.BuildingTypes))
+}
+
 func getSingleIntValue(in url.Values, key string) (int, error) {
 	str, err := getSingleValue(in, key)
 
@@ -44,8 +142,79 @@ func getSingleIntValue(in url.Values, key string) (int, error) {
 	return intv, nil
 }
 
-func EcoGET(cache *cache.Cache) func(url.Values) (*BenefitsWrapper, error) {
+// Calculate the benefits of a single tree, with the given
+// factors and units
+//
+// The diameter must be in centimeters
+func calcTreeBenefits(
+	cache *cache.Snapshot,
+	options *requestOptions,
+	otmcode string,
+	speciesid int,
+	diameter float64,
+	region string,
+	buildingtype string,
+	instanceid int) (*BenefitsWrapper, error) {
+
+	if err := checkBuildingType(buildingtype); err != nil {
+		return nil, err
+	}
+
+	_, found := cache.RegionData[region]
+
+	if !found {
+		return nil, errors.New("invalid region")
+	}
+
+	factorDataForRegion := eco.FactorDataForBuildingType(
+		cache.RegionData, cache.BuildingData, region, buildingtype)
+
+	itreecode, err := cache.GetITreeCode(otmcode, speciesid, region, instanceid)
+	if err != nil {
+		return nil, err
+	}
+
+	factorsum := make([]float64, options.factors.Len())
+
+	eco.CalcOneTree(
+		options.factors,
+		factorDataForRegion,
+		itreecode,
+		diameter,
+		factorsum)
+
+	dollarsum := make([]float64, options.factors.Len())
+
+	options.factors.CalcDollars(cache.Prices[region], factorsum, dollarsum)
+
+	return &BenefitsWrapper{
+		Benefits: options.benefits(factorsum),
+		Dollars:  options.dollars(dollarsum)}, nil
+}
+
+// Calculate the benefits of a single tree
+//
+// The diameter is in inches unless "diameter_units" is "cm",
+// and the benefits are in the units of the data files unless
+// "units" is "metric" or "imperial". The response has the
+// unit of each of the benefits. "factors" is an optional comma separated list
+// of the factors to calculate.
+//
+// Request (with bogus example parameters):
+//
+// GET /eco.json?otmcode=CACO&speciesid=1&diameter=12&region=NoEastXXX&instanceid=1&units=imperial&factors=co2_storage,hydro_interception
+//
+// Response (with bogus example values):
+//
+// {
+//   "Benefits": {"co2_storage": 108.3, "hydro_interception": 1320.6},
+//   "Dollars": {"co2_storage": 0.36, "hydro_interception": 6.6, "total": 6.6},
+//   "Units": {"co2_storage": "lbs", "hydro_interception": "gal"}
+// }
+func EcoGET(ecoCache *cache.Cache) func(url.Values) (*BenefitsWrapper, error) {
 	return func(in url.Values) (*BenefitsWrapper, error) {
+		cache := ecoCache.Snapshot()
+
 		instanceid, err := getSingleIntValue(in, "instanceid")
 
 		if err != nil {
@@ -76,33 +245,59 @@ func EcoGET(cache *cache.Cache) func(url.Values) (*BenefitsWrapper, error) {
 			return nil, err
 		}
 
-		diameter = diameter * eco.CentimetersPerInch
+		unitsstr, err := getOptionalValue(in, "units")
 
-		region, err := getSingleValue(in, "region")
+		if err != nil {
+			return nil, err
+		}
+
+		diameterunits, err := getOptionalValue(in, "diameter_units")
 
 		if err != nil {
 			return nil, err
 		}
 
-		factorDataForRegion, found := cache.RegionData[region]
+		factors, err := getOptionalValue(in, "factors")
 
-		if !found {
-			return nil, errors.New("invalid region")
+		if err != nil {
+			return nil, err
 		}
 
-		itreecode, err := cache.GetITreeCode(otmcode, speciesid, region, instanceid)
+		var factornames []string
+		if factors != "" {
+			factornames = strings.Split(factors, ",")
+		}
+
+		options, err := parseRequestOptions(cache, factornames,
+			unitsstr, diameterunits, "in")
+
+		if err != nil {
+			return nil, err
+		}
+
+		diameter = diameter * options.diameterScale
+
+		region, err := getSingleValue(in, "region")
+
 		if err != nil {
 			return nil, err
 		}
 
-		factorsum := make([]float64, len(eco.Factors))
+		buildingtype, err := getOptionalValue(in, "buildingtype")
+
+		if err != nil {
+			return nil, err
+		}
+
+		benefits, err := calcTreeBenefits(cache, options, otmcode,
+			speciesid, diameter, region, buildingtype, instanceid)
+
+		if err != nil {
+			return nil, err
+		}
 
-		eco.CalcOneTree(
-			factorDataForRegion,
-			itreecode,
-			diameter,
-			factorsum)
+		benefits.Units = options.units()
 
-		return &BenefitsWrapper{Benefits: eco.FactorArrayToMap(factorsum)}, nil
+		return benefits, nil
 	}
 }
@@ -0,0 +1,284 @@
+package endpoints
+
+import (
+	"fmt"
+	"github.com/OpenTreeMap/otm-ecoservice/eco"
+	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
+	"strconv"
+	"time"
+)
+
+// Trees can be given as a list, as a GeoJSON FeatureCollection
+// of points (see BatchTree for the properties) or both
+//
+// Srid is the SRID of the points of the trees. It defaults to
+// the "crs" of the GeoJSON or web mercator
+//
+// Factors, Units and Diameter_units are optional (see
+// requestOptions). Diameters default to inches
+type BatchPostData struct {
+	Instance_id    string
+	Region         string
+	Building_type  string
+	Trees          []BatchTree
+	Geojson        *eco.GeoJSONFeatureCollection
+	Srid           int
+	Factors        []string
+	Units          string
+	Diameter_units string
+}
+
+// A tree needs either a "region" or an "x" and "y" that
+// fall inside one of the i-Tree regions
+//
+// Ids and species ids can be strings or numbers
+type BatchTree struct {
+	Id            looseString
+	Otmcode       string
+	Species_id    looseInt
+	Diameter      float64
+	Region        string
+	X             *float64
+	Y             *float64
+	Building_type string
+
+	// The problem with the GeoJSON feature of the tree,
+	// if it couldn't be read
+	problem string
+}
+
+// Benefits for a single tree in a batch. If the benefits
+// couldn't be calculated only Error is set
+type BatchTreeBenefits struct {
+	Region   string
+	Benefits map[string]float64
+	Dollars  map[string]float64
+	Error    string
+}
+
+// Units has the unit of each of the benefits
+type BatchBenefits struct {
+	Trees map[string]*BatchTreeBenefits
+	Units map[string]string
+}
+
+// Calculate the benefits of many trees at once
+//
+// Each tree is calculated as it would be by /eco.json, with
+// the diameter in inches unless "diameter_units" is "cm" and
+// the benefits in the units of the data files unless "units"
+// is "metric" or "imperial". Only the "factors" given in the batch are
+// calculated, if it has any. The tree's region is the first of
+// its "region", its location ("x" and "y") or the batch-level
+// "region". As with scenarios, a tree's "building_type"
+// overrides the batch-level value.
+//
+// Trees can also be given as a GeoJSON FeatureCollection in
+// "geojson". Each feature's point is the location of the tree
+// and its properties are the other fields of the tree. Features
+// without an "id" property use the id of the feature. These
+// trees are calculated after the trees in "trees". Features that
+// can't be read have an "Error", like trees that can't be
+// calculated.
+//
+// Points are in the batch's "srid" (4326 for longitude and
+// latitude or 3857 for web mercator), the "crs" of the GeoJSON
+// or, by default, web mercator. Trees with points that don't
+// look like they are in that SRID have an "Error".
+//
+// Results are keyed by the "id" of each tree, or by its index
+// in the list of trees when it has no id. If another tree has
+// that id, the index is followed by "-1" (or "-2" and so on).
+// Trees that can't be calculated have an "Error" rather than
+// failing the batch, including trees that have the same id as
+// another, which has the error for all of them.
+//
+// Request (with bogus example parameters):
+//
+// POST /eco_batch.json
+//
+// {
+//   "instance_id": 1,
+//   "region": "NoEastXXX",
+//   "trees": [
+//     {
+//       "id": "14",
+//       "otmcode": "CACO",
+//       "species_id": 1,
+//       "diameter": 12
+//     },
+//     {
+//       "id": "15",
+//       "otmcode": "ACRU",
+//       "species_id": 2,
+//       "diameter": 8,
+//       "x": -8366541.2,
+//       "y": 4859184.8
+//     }
+//   ]
+// }
+//
+// Response (with bogus example values):
+//
+// {
+//   "Trees": {
+//     "14": {
+//       "Region": "NoEastXXX",
+//       "Benefits": {"aq_nox_avoided": 0.01548490, ...},
+//       "Dollars": {"aq_nox_avoided": 0.14234823, ..., "total": 42.1},
+//       "Error": ""
+//     },
+//     "15": {
+//       "Region": "",
+//       "Benefits": null,
+//       "Dollars": null,
+//       "Error": "No i-Tree region contains the tree"
+//     }
+//   },
+//   "Units": {"aq_nox_avoided": "kg", ...}
+// }
+func EcoBatchPOST(ecoCache *cache.Cache) func(*BatchPostData) (*BatchBenefits, error) {
+	return func(data *BatchPostData) (*BatchBenefits, error) {
+		t := time.Now()
+		cache := ecoCache.Snapshot()
+
+		// Overrides are optional for a batch, so
+		// the instance is too
+		instanceid := 0
+
+		if len(data.Instance_id) > 0 {
+			var err error
+			instanceid, err = strconv.Atoi(data.Instance_id)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := checkBuildingType(data.Building_type); err != nil {
+			return nil, err
+		}
+
+		options, err := parseRequestOptions(cache, data.Factors,
+			data.Units, data.Diameter_units, "in")
+
+		if err != nil {
+			return nil, err
+		}
+
+		srid, err := requestSrid(data.Srid, data.Geojson)
+
+		if err != nil {
+			return nil, err
+		}
+
+		trees := data.Trees
+
+		if data.Geojson != nil {
+			featureTrees, err := batchTreesFromGeoJSON(data.Geojson)
+
+			if err != nil {
+				return nil, err
+			}
+
+			trees = append(trees, featureTrees...)
+		}
+
+		results := make(map[string]*BatchTreeBenefits, len(trees))
+
+		// The number of trees with each id
+		ids := make(map[string]int, len(trees))
+
+		for _, tree := range trees {
+			if len(tree.Id) > 0 {
+				ids[string(tree.Id)]++
+			}
+		}
+
+		for i, tree := range trees {
+			id := string(tree.Id)
+			if len(id) == 0 {
+				id = defaultTreeId(i, ids)
+			}
+
+			if ids[id] > 1 {
+				results[id] = &BatchTreeBenefits{
+					Error: fmt.Sprintf("Duplicate tree id %v", id)}
+				continue
+			}
+
+			result := &BatchTreeBenefits{}
+			results[id] = result
+
+			if len(tree.problem) != 0 {
+				result.Error = tree.problem
+				continue
+			}
+
+			region := tree.Region
+			if len(region) == 0 && tree.X != nil && tree.Y != nil {
+				x, y, err := eco.ToRegionSRID(*tree.X, *tree.Y, srid)
+
+				if err != nil {
+					result.Error = err.Error()
+					continue
+				}
+
+				region, err = cache.RegionIndex.RegionCodeForPoint(x, y)
+
+				if err != nil {
+					result.Error = err.Error()
+					continue
+				}
+
+				if len(region) == 0 {
+					result.Error = "No i-Tree region contains the tree"
+					continue
+				}
+			}
+			if len(region) == 0 {
+				region = data.Region
+			}
+
+			buildingtype := data.Building_type
+			if len(tree.Building_type) != 0 {
+				buildingtype = tree.Building_type
+			}
+
+			benefits, err := calcTreeBenefits(cache, options, tree.Otmcode,
+				int(tree.Species_id), tree.Diameter*options.diameterScale,
+				region, buildingtype, instanceid)
+
+			result.Region = region
+
+			if err != nil {
+				result.Error = err.Error()
+				continue
+			}
+
+			result.Benefits = benefits.Benefits
+			result.Dollars = benefits.Dollars
+		}
+
+		fmt.Println("                   ",
+			int64(time.Since(t)/time.Millisecond), "ms (total)")
+
+		return &BatchBenefits{Trees: results,
+			Units: options.units()}, nil
+	}
+}
+
+// Get an id for the ith tree of a batch, which doesn't
+// have one, that none of the other trees have. ids counts
+// the trees with each id, and the new id is added to it
+func defaultTreeId(i int, ids map[string]int) string {
+	id := strconv.Itoa(i)
+
+	for n := 1; ids[id] > 0; n++ {
+		id = fmt.Sprintf("%v-%v", i, n)
+	}
+
+	ids[id] = 1
+
+	return id
+}
@@ -0,0 +1,82 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"github.com/ungerik/go-rest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Trees that can't be calculated have an error, and
+// the rest of the batch is calculated anyway
+func TestEcoBatchTreeErrors(t *testing.T) {
+	rest.HandlePOST("/eco_batch.json", EcoBatchPOST(mockCache(t, nil)))
+
+	body := `{
+	  "region": "NoEastXXX",
+	  "srid": 4326,
+	  "trees": [
+	    {"id": "ok", "otmcode": "ACRU", "diameter": 12},
+	    {"id": "elsewhere", "otmcode": "ACRU", "diameter": 12,
+	     "region": "Atlantis"},
+	    {"id": "castle", "otmcode": "ACRU", "diameter": 12,
+	     "building_type": "castle"},
+	    {"id": "offmap", "otmcode": "ACRU", "diameter": 12,
+	     "x": 500, "y": 100},
+	    {"id": "twin", "otmcode": "ACRU", "diameter": 12},
+	    {"id": "twin", "otmcode": "QURU", "diameter": 8}
+	  ],
+	  "geojson": {
+	    "type": "FeatureCollection",
+	    "features": [{
+	      "type": "Feature",
+	      "id": "line",
+	      "geometry": {"type": "LineString",
+	                   "coordinates": [[-75, 40], [-75.1, 40.1]]},
+	      "properties": {"otmcode": "ACRU", "diameter": 12}
+	    }]
+	  }
+	}`
+
+	request := httptest.NewRequest(
+		"POST", "/eco_batch.json", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	response := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	result := &BatchBenefits{}
+
+	if err := json.Unmarshal(response.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := result.Trees["ok"]
+
+	if tree == nil || tree.Error != "" || tree.Region != "NoEastXXX" ||
+		tree.Benefits["co2_storage"] <= 0 {
+		t.Fatalf("Expected benefits for ok, got %+v", tree)
+	}
+
+	for _, id := range []string{"elsewhere", "castle", "offmap", "twin", "line"} {
+		tree := result.Trees[id]
+
+		if tree == nil || tree.Error == "" || tree.Benefits != nil {
+			t.Fatalf("Expected an error for %v, got %+v", id, tree)
+		}
+	}
+
+	if len(result.Trees) != 6 {
+		t.Fatalf("Expected 6 results, got %v", len(result.Trees))
+	}
+
+	if result.Units["co2_storage"] == "" {
+		t.Fatalf("Expected the units of co2_storage, got %v", result.Units)
+	}
+}
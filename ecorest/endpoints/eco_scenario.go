@@ -5,27 +5,288 @@ import (
 	"fmt"
 	"github.com/OpenTreeMap/otm-ecoservice/eco"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
+	"sort"
 	"strconv"
 	"time"
 )
 
+// Factors, Units and Diameter_units are optional (see
+// requestOptions). Diameters default to centimeters
 type ScenarioPostData struct {
 	Region         string
 	Instance_id    string
 	Years          int
+	Building_type  string
+	Mortality      *ScenarioMortality
 	Scenario_trees []ScenarioTree
+	Geojson        *eco.GeoJSONFeatureCollection
+	Srid           int
+	Factors        []string
+	Units          string
+	Diameter_units string
 }
 
+// Annual mortality rates (between 0 and 1) for the trees
+// in a scenario
+//
+// A tree uses the rate for its species (by otmcode) if there
+// is one, otherwise the rate of the first size class with a
+// "max_diameter" above the tree's diameter, otherwise the
+// default "rate"
+type ScenarioMortality struct {
+	Rate         float64
+	Species      map[string]float64
+	Size_classes []MortalitySizeClass
+	Replacement  *ScenarioReplacement
+}
+
+type MortalitySizeClass struct {
+	Max_diameter float64
+	Rate         float64
+}
+
+// Trees that die are replaced the next year with a tree
+// of the given species (or the same species, if no
+// otmcode is given) at the given planting diameter
+type ScenarioReplacement struct {
+	Otmcode           string
+	Species_id        int
+	Planting_diameter float64
+}
+
+// Species ids can be strings or numbers
 type ScenarioTree struct {
-	Otmcode    string
-	Species_id int
-	Region     string
-	Diameters  []float64
+	Otmcode           string
+	Species_id        looseInt
+	Region            string
+	Building_type     string
+	Diameters         []float64
+	Planting_diameter float64
+	Age               float64
 }
 
+// Units has the unit of each of the benefits in Total
+// and Years
 type Scenario struct {
-	Total map[string]float64
-	Years []map[string]float64
+	Total        map[string]float64
+	Years        []map[string]float64
+	TotalDollars map[string]float64
+	YearDollars  []map[string]float64
+	LivingTrees  []float64
+	Units        map[string]string
+
+	// Problems with GeoJSON features that were left out of
+	// the scenario, by the index of the feature
+	Errors map[string]string `json:",omitempty"`
+}
+
+// Running totals for a scenario
+type scenarioTotals struct {
+	options      *requestOptions
+	years        [][]float64
+	grand        []float64
+	yearDollars  [][]float64
+	grandDollars []float64
+	livingTrees  []float64
+	removedCO2   []float64
+}
+
+func newScenarioTotals(years int, options *requestOptions) *scenarioTotals {
+	nfactors := options.factors.Len()
+	totals := &scenarioTotals{
+		options:      options,
+		years:        make([][]float64, years),
+		grand:        make([]float64, nfactors),
+		yearDollars:  make([][]float64, years),
+		grandDollars: make([]float64, nfactors),
+		livingTrees:  make([]float64, years),
+		removedCO2:   make([]float64, years)}
+
+	for i := range totals.years {
+		totals.years[i] = make([]float64, nfactors)
+		totals.yearDollars[i] = make([]float64, nfactors)
+	}
+
+	return totals
+}
+
+// Add the benefits of a single tree, weighted by the
+// expected number of those trees alive, to a year
+func (totals *scenarioTotals) add(
+	year int, weight float64, factorSum []float64, prices []float64) {
+
+	weighted := make([]float64, len(factorSum))
+	for j, value := range factorSum {
+		weighted[j] = value * weight
+		totals.years[year][j] += weighted[j]
+		totals.grand[j] += weighted[j]
+	}
+
+	factors := totals.options.factors
+	factors.CalcDollars(prices, weighted, totals.yearDollars[year])
+	factors.CalcDollars(prices, weighted, totals.grandDollars)
+}
+
+// Add the CO2 stored in trees removed during a year, which is
+// released as they decompose
+func (totals *scenarioTotals) addRemoved(
+	year int, weight float64, factorSum []float64) {
+
+	if i := totals.options.factors.Index("co2_storage"); i >= 0 {
+		totals.removedCO2[year] += weight * factorSum[i]
+	}
+}
+
+// The factors needed to calculate the net CO2 of a scenario
+var netCO2Factors = []string{"co2_sequestered", "co2_maint", "co2_storage"}
+
+// Add the CO2 released by removed trees to a factor map
+// along with the net CO2 sequestered, which counts that
+// release in place of the average decomposition used
+// by "co2_decomp"
+func addNetCO2(factormap map[string]float64, removedCO2 float64) {
+	factormap["co2_removed"] = removedCO2
+	factormap["net_co2"] = factormap["co2_sequestered"] -
+		factormap["co2_maint"] - removedCO2
+}
+
+// Get the scenario, with its benefits in the request's units
+//
+// The net CO2 is only included if all of netCO2Factors
+// were calculated
+func (totals *scenarioTotals) scenario() *Scenario {
+	options := totals.options
+	netCO2 := true
+
+	for _, factor := range netCO2Factors {
+		if options.factors.Index(factor) < 0 {
+			netCO2 = false
+		}
+	}
+
+	// The removed CO2 is stored CO2, so it has the same unit
+	co2unit, co2scale := options.system.Convert(
+		options.factors.Unit("co2_storage"))
+
+	totalRemovedCO2 := 0.0
+	years := make([]map[string]float64, len(totals.years))
+	for i, a := range totals.years {
+		years[i] = options.benefits(a)
+		if netCO2 {
+			addNetCO2(years[i], totals.removedCO2[i]*co2scale)
+		}
+		totalRemovedCO2 += totals.removedCO2[i]
+	}
+	total := options.benefits(totals.grand)
+	factorunits := options.units()
+	if netCO2 {
+		addNetCO2(total, totalRemovedCO2*co2scale)
+		factorunits["co2_removed"] = co2unit
+		factorunits["net_co2"] = co2unit
+	}
+	dollars := make([]map[string]float64, len(totals.yearDollars))
+	for i, a := range totals.yearDollars {
+		dollars[i] = options.dollars(a)
+	}
+	return &Scenario{
+		Total:        total,
+		Years:        years,
+		TotalDollars: options.dollars(totals.grandDollars),
+		YearDollars:  dollars,
+		LivingTrees:  totals.livingTrees,
+		Units:        factorunits}
+}
+
+// Check that all of the mortality rates are between 0 and 1
+// and sort the size classes by diameter. Diameters are
+// converted to centimeters, with scale centimeters in each
+// of the request's diameter units
+func (mortality *ScenarioMortality) validate(scale float64) error {
+	rates := []float64{mortality.Rate}
+	for _, rate := range mortality.Species {
+		rates = append(rates, rate)
+	}
+	for _, sizeClass := range mortality.Size_classes {
+		rates = append(rates, sizeClass.Rate)
+	}
+
+	for _, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return errors.New(fmt.Sprintf(
+				"Invalid mortality rate %v, rates must be between 0 and 1", rate))
+		}
+	}
+
+	sort.Sort(bySizeClassDiameter(mortality.Size_classes))
+
+	for i := range mortality.Size_classes {
+		mortality.Size_classes[i].Max_diameter *= scale
+	}
+
+	replacement := mortality.Replacement
+	if replacement != nil && replacement.Planting_diameter <= 0 {
+		return errors.New("Replacement trees need a planting_diameter")
+	}
+
+	if replacement != nil {
+		replacement.Planting_diameter *= scale
+	}
+
+	return nil
+}
+
+// Get the mortality rate function for a species
+func (mortality *ScenarioMortality) rateFunc(otmcode string) eco.MortalityRateFunc {
+	if mortality == nil {
+		return func(diameter float64) float64 { return 0 }
+	}
+
+	if rate, found := mortality.Species[otmcode]; found {
+		return func(diameter float64) float64 { return rate }
+	}
+
+	return func(diameter float64) float64 {
+		for _, sizeClass := range mortality.Size_classes {
+			if diameter < sizeClass.Max_diameter {
+				return sizeClass.Rate
+			}
+		}
+
+		return mortality.Rate
+	}
+}
+
+type bySizeClassDiameter []MortalitySizeClass
+
+func (a bySizeClassDiameter) Len() int      { return len(a) }
+func (a bySizeClassDiameter) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySizeClassDiameter) Less(i, j int) bool {
+	return a[i].Max_diameter < a[j].Max_diameter
+}
+
+// Project the diameters of a tree that has a planting
+// diameter or age for each year of the scenario
+func projectDiameters(
+	growth *eco.Datafile, itreecode string,
+	tree ScenarioTree, years int) ([]float64, error) {
+
+	if tree.Planting_diameter > 0 && tree.Age > 0 {
+		return nil, errors.New(
+			"Scenario trees can have a planting_diameter or an age, but not both")
+	}
+
+	age := tree.Age
+
+	if tree.Planting_diameter > 0 {
+		var err error
+		age, err = eco.AgeForDiameter(growth, itreecode, tree.Planting_diameter)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return eco.ProjectDiameters(growth, itreecode, age, years)
 }
 
 // Take an array of prospective trees where each tree contains
@@ -42,9 +303,57 @@ type Scenario struct {
 // Specifying a "region" for an individual tree will override the
 // scenario-level "region" value.
 //
+// Trees can also be given as a GeoJSON FeatureCollection of points
+// in "geojson", with the fields of each tree as the properties of
+// its feature. Features without a "region" property are placed in
+// the i-Tree region that contains their point. Coordinates are in
+// the scenario's "srid" (4326 for longitude and latitude or 3857
+// for web mercator), the "crs" of the GeoJSON or, by default, web
+// mercator. Features that can't be read, or that aren't in an
+// i-Tree region, are left out of the scenario and their problems
+// are in "Errors", by the index of the feature.
+//
+// Instead of encoding deaths in the "diameters" arrays, a scenario
+// can give annual "mortality" rates, by species (otmcode), by size
+// class or as a default. Benefits for each year are then the
+// expected benefits, weighting each tree by the probability that it
+// is still alive. If "mortality" has a "replacement", trees that die
+// are replaced the next year with new trees that grow according to
+// the i-Tree growth data. "LivingTrees" in the response has the
+// expected number of living trees in each year.
+//
+// Each year (and the total) also has "co2_removed", the CO2 stored
+// in trees that die or are removed during that year, all of which
+// is assumed to be released as they decompose, and "net_co2", which
+// is "co2_sequestered" less "co2_maint" and "co2_removed". Unlike
+// "net_co2_sequestered", which uses i-Tree's average decomposition
+// rate, this follows the removals of the scenario.
+//
+// The optional "building_type" (one of "sfr", "mfr", "ci" or "it")
+// selects building type specific energy and avoided emission
+// factors. As with "region", a tree's "building_type" overrides
+// the scenario-level value. Regions without building type data
+// use the blended factors.
+//
 // The "years" parameter must be >= the length of the longest
 // "diameters" array under "scenario_trees".
 //
+// Instead of "diameters" a tree can have a "planting_diameter" or
+// an "age" (in years). The diameters for every year of the scenario
+// are then projected from the i-Tree growth data for the tree's
+// species and region, starting from the given diameter or age.
+//
+// Diameters (including the mortality size classes and planting
+// diameters) are in centimeters unless "diameter_units" is "in".
+// Benefits are in the units of the data files unless "units" is
+// "metric" or "imperial". "Units" in the response has the unit of
+// each of the benefits.
+//
+// "factors" is an optional list of the factors to calculate.
+// "co2_removed" and "net_co2" are only included when the
+// factors include "co2_sequestered", "co2_maint" and
+// "co2_storage".
+//
 // Request (with bogus example parameters):
 //
 // POST /eco_scenario.json
@@ -53,12 +362,27 @@ type Scenario struct {
 //   "region": "NoEastXXX",
 //   "instance_id": 1,
 //   "years": 3
+//   "building_type": "sfr",
+//   "mortality": {
+//     "rate": 0.02,
+//     "species": {"CACO": 0.05},
+//     "size_classes": [
+//       {"max_diameter": 10, "rate": 0.04}
+//     ],
+//     "replacement": {"otmcode": "ACRU", "planting_diameter": 5}
+//   },
 //   "scenario_trees": [
 //     {
 //       "otmcode": "CACO",
 //       "species_id": 1,
 //       "region": "NoEastXXX",
+//       "building_type": "ci",
 //       "diameters": [1, 1.3, 1.7]
+//     },
+//     {
+//       "otmcode": "ACRU",
+//       "species_id": 2,
+//       "planting_diameter": 5
 //     }
 //   ]
 // }
@@ -87,10 +411,29 @@ type Scenario struct {
 //     "aq_nox_avoided": ... ,
 //     "aq_nox_dep": ... ,
 //     "aq_pm10_avoided": ...
-//   }
+//   },
+//   "YearDollars": [
+//     {
+//       "aq_nox_avoided":     0.14234823,
+// 	 "aq_nox_dep":         0.07094680,
+// 	 "aq_pm10_avoided":    0.10018890,
+// 	 "total":              0.31348393
+//     },
+//     ...
+//   ],
+//   "TotalDollars": {
+//     "aq_nox_avoided": ... ,
+//     "aq_nox_dep": ... ,
+//     "aq_pm10_avoided": ... ,
+//     "total": ...
+//   },
+//   "LivingTrees": [1, 0.98, 0.97],
+//   "Units": {"aq_nox_avoided": "kg", ...}
 // }
-func EcoScenarioPOST(cache *cache.Cache) func(*ScenarioPostData) (*Scenario, error) {
+func EcoScenarioPOST(ecoCache *cache.Cache) func(*ScenarioPostData) (*Scenario, error) {
 	return func(data *ScenarioPostData) (*Scenario, error) {
+		cache := ecoCache.Snapshot()
+
 		t := time.Now()
 
 		scenarioTrees := data.Scenario_trees
@@ -102,10 +445,41 @@ func EcoScenarioPOST(cache *cache.Cache) func(*ScenarioPostData) (*Scenario, err
 			return nil, err
 		}
 
+		options, err := parseRequestOptions(cache, data.Factors,
+			data.Units, data.Diameter_units, "cm")
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Problems with GeoJSON features, which are left out
+		var featureErrors map[string]string
+
+		if data.Geojson != nil {
+			srid, err := requestSrid(data.Srid, data.Geojson)
+
+			if err != nil {
+				return nil, err
+			}
+
+			var featureTrees []ScenarioTree
+			featureTrees, featureErrors, err = scenarioTreesFromGeoJSON(
+				cache, data.Geojson, srid)
+
+			if err != nil {
+				return nil, err
+			}
+
+			scenarioTrees = append(scenarioTrees, featureTrees...)
+		}
+
+		if err = checkBuildingType(data.Building_type); err != nil {
+			return nil, err
+		}
+
 		if len(scenarioRegion) == 0 {
 			var regions []eco.Region
-			regions, err = cache.Db.GetRegionsForInstance(
-				cache.RegionGeometry, instanceId)
+			regions, err = cache.RegionsForInstance(instanceId)
 
 			if err != nil {
 				return nil, err
@@ -116,40 +490,146 @@ func EcoScenarioPOST(cache *cache.Cache) func(*ScenarioPostData) (*Scenario, err
 			}
 		}
 
-		yearTotals := make([][]float64, data.Years)
-		grandTotals := make([]float64, len(eco.Factors))
-		for i := range yearTotals {
-			yearTotals[i] = make([]float64, len(eco.Factors))
+		mortality := data.Mortality
+		var replacement *ScenarioReplacement
+
+		if mortality != nil {
+			if err = mortality.validate(options.diameterScale); err != nil {
+				return nil, err
+			}
+
+			replacement = mortality.Replacement
 		}
 
+		totals := newScenarioTotals(data.Years, options)
+
 		for _, tree := range scenarioTrees {
 			effectiveRegion := scenarioRegion
 			if len(tree.Region) != 0 {
 				effectiveRegion = tree.Region
 			}
 
-			factorDataForRegion, found := cache.RegionData[effectiveRegion]
+			effectiveBuildingType := data.Building_type
+			if len(tree.Building_type) != 0 {
+				effectiveBuildingType = tree.Building_type
+			}
+
+			if err = checkBuildingType(effectiveBuildingType); err != nil {
+				return nil, err
+			}
+
+			_, found := cache.RegionData[effectiveRegion]
 			if !found {
 				return nil, errors.New("No data is available for the iTree region with code " + effectiveRegion)
 			}
 
+			factorDataForRegion := eco.FactorDataForBuildingType(
+				cache.RegionData, cache.BuildingData,
+				effectiveRegion, effectiveBuildingType)
+
 			itreecode, err := cache.GetITreeCode(tree.Otmcode,
-				tree.Species_id, effectiveRegion, instanceId)
+				int(tree.Species_id), effectiveRegion, instanceId)
 			if err != nil {
 				return nil, err
 			}
 
+			diameters := make([]float64, len(tree.Diameters))
 			for i, diameter := range tree.Diameters {
-				factorSum := make([]float64, len(eco.Factors))
+				diameters[i] = diameter * options.diameterScale
+			}
+
+			tree.Planting_diameter *= options.diameterScale
+
+			if len(diameters) == 0 && (tree.Planting_diameter > 0 || tree.Age > 0) {
+				diameters, err = projectDiameters(
+					cache.GrowthData[effectiveRegion], itreecode,
+					tree, data.Years)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if len(diameters) > data.Years {
+				return nil, errors.New(fmt.Sprintf(
+					"Scenario trees can have at most %v diameters", data.Years))
+			}
+
+			pricesForRegion := cache.Prices[effectiveRegion]
+
+			// Benefits of a replacement tree by years since
+			// it was planted
+			var replacementDiameters []float64
+			var replacementBenefits [][]float64
+			var replacementRate eco.MortalityRateFunc
+
+			if replacement != nil {
+				replacementOtmcode := tree.Otmcode
+				replacementSpeciesId := int(tree.Species_id)
+				if len(replacement.Otmcode) != 0 {
+					replacementOtmcode = replacement.Otmcode
+					replacementSpeciesId = replacement.Species_id
+				}
+
+				replacementItreecode, err := cache.GetITreeCode(
+					replacementOtmcode, replacementSpeciesId,
+					effectiveRegion, instanceId)
+				if err != nil {
+					return nil, err
+				}
+
+				replacementDiameters, err = projectDiameters(
+					cache.GrowthData[effectiveRegion], replacementItreecode,
+					ScenarioTree{Planting_diameter: replacement.Planting_diameter},
+					data.Years)
+				if err != nil {
+					return nil, err
+				}
+
+				replacementBenefits = make([][]float64, data.Years)
+				for k, diameter := range replacementDiameters {
+					replacementBenefits[k] = make([]float64, options.factors.Len())
+					eco.CalcOneTree(
+						options.factors,
+						factorDataForRegion,
+						replacementItreecode,
+						diameter,
+						replacementBenefits[k])
+				}
+
+				replacementRate = mortality.rateFunc(replacementOtmcode)
+			}
+
+			survival := eco.CalcSurvival(
+				diameters, mortality.rateFunc(tree.Otmcode),
+				replacementDiameters, replacementRate, data.Years)
+
+			for i, diameter := range diameters {
+				if survival.Trees[i] == 0 {
+					continue
+				}
+
+				factorSum := make([]float64, options.factors.Len())
 				eco.CalcOneTree(
+					options.factors,
 					factorDataForRegion,
 					itreecode,
 					diameter,
 					factorSum)
-				for j, value := range factorSum {
-					yearTotals[i][j] += value
-					grandTotals[j] += value
+
+				totals.add(i, survival.Trees[i], factorSum, pricesForRegion)
+				totals.addRemoved(i, survival.Removed[i], factorSum)
+			}
+
+			for i := 0; i < data.Years; i++ {
+				if replacement != nil {
+					for k, weight := range survival.Replacements[i] {
+						totals.add(i, weight, replacementBenefits[k], pricesForRegion)
+						totals.addRemoved(i, survival.ReplacementsRemoved[i][k],
+							replacementBenefits[k])
+					}
 				}
+
+				totals.livingTrees[i] += survival.Living(i)
 			}
 		}
 
@@ -160,12 +640,12 @@ func EcoScenarioPOST(cache *cache.Cache) func(*ScenarioPostData) (*Scenario, err
 		fmt.Println("                   ",
 			int64(time.Since(t)/time.Millisecond), "ms (total)")
 
-		years := make([]map[string]float64, data.Years)
-		for i, a := range yearTotals {
-			years[i] = eco.FactorArrayToMap(a)
+		scenario := totals.scenario()
+
+		if len(featureErrors) != 0 {
+			scenario.Errors = featureErrors
 		}
-		return &Scenario{
-			Total: eco.FactorArrayToMap(grandTotals),
-			Years: years}, nil
+
+		return scenario, nil
 	}
 }
@@ -1,74 +1,794 @@
 package endpoints
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/OpenTreeMap/otm-ecoservice/eco"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
+	"log"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// The trees of a summary are selected by Filter, which is
+// optional and includes every tree in the instance by
+// default. Query is raw SQL that can be used instead if the
+// service is configured to allow it (see config.Config)
+//
+// Building_type is optional and selects the building type
+// specific energy and avoided emission factors (see
+// eco.BuildingTypes) for every tree. Individual trees can
+// use their own building type if the query selects a
+// "building_type" column after the standard columns. Trees
+// with an unknown building type are skipped and counted in
+// the diagnostics
+//
+// Itemize is optional. Setting it to "ndjson" or "csv" returns
+// the results of every tree instead of the totals (see
+// EcoSummaryHandler)
+//
+// Srid is optional and is the SRID of the points returned by
+// Query and of the areas in Filter. It defaults to web mercator
+//
+// Group_by is optional. Setting it to one of the GroupBy keys,
+// or to the name of a tree column, also returns the totals of
+// each group. Filters can group by eco.GroupColumns, and queries
+// by the name of any column they select after the standard
+// columns. Other columns are bad requests
+//
+// Factors, Units and Diameter_units are optional (see
+// requestOptions). Diameters in Filter default to inches
 type SummaryPostData struct {
-	Region      string
-	Query       string
-	Instance_id string
+	Region         string
+	Query          string
+	Filter         *SummaryFilter
+	Instance_id    string
+	Building_type  string
+	Itemize        string
+	Group_by       string
+	Srid           int
+	Factors        []string
+	Units          string
+	Diameter_units string
 }
 
-func EcoSummaryPOST(cache *cache.Cache) func(*SummaryPostData) (*BenefitsWrapper, error) {
-	return func(data *SummaryPostData) (*BenefitsWrapper, error) {
-		query := data.Query
-		region := data.Region
+// Filters for the trees in a summary (see eco.TreeFilter)
+//
+// The area of the summary can be given by Bbox and either
+// Polygon (as WKT) or Geojson (a polygon or multipolygon
+// geometry or feature). Polygons must be in web mercator,
+// Bbox and Geojson are reprojected from the summary's SRID
+//
+// Diameters are in the summary's diameter units and dates
+// are formatted as YYYY-MM-DD
+type SummaryFilter struct {
+	Bbox           []float64
+	Species        []string
+	Species_ids    []int
+	Min_diameter   *float64
+	Max_diameter   *float64
+	Planted_after  string
+	Planted_before string
+	Polygon        string
+	Geojson        json.RawMessage
+}
+
+// Convert a diameter with scale centimeters in each of its
+// units to inches, which eco.TreeFilter uses
+func filterDiameter(diameter *float64, scale float64) *float64 {
+	if diameter == nil {
+		return nil
+	}
+
+	inches := *diameter * scale / eco.CentimetersPerInch
+	return &inches
+}
+
+func parseFilterDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	date, err := time.Parse("2006-01-02", value)
+
+	if err != nil {
+		return nil, badRequest("Invalid date %v, expected YYYY-MM-DD", value)
+	}
+
+	return &date, nil
+}
+
+// Convert the filter into an eco.TreeFilter for the given
+// instance, with its areas in srid and diameterScale
+// centimeters in each of its diameter units. The filter
+// can be nil
+func (f *SummaryFilter) treeFilter(
+	instanceid int, srid int, diameterScale float64) (*eco.TreeFilter, error) {
+	filter := &eco.TreeFilter{InstanceId: instanceid}
+
+	if f == nil {
+		return filter, nil
+	}
+
+	var err error
 
-		instanceid, err := strconv.Atoi(data.Instance_id)
+	if f.Polygon != "" && srid != eco.TreeSRID {
+		return nil, badRequest(
+			"WKT polygons must have an SRID of %v, use GeoJSON for SRID %v",
+			eco.TreeSRID, srid)
+	}
+
+	if f.Bbox != nil && len(f.Bbox) == 4 && srid != eco.TreeSRID {
+		filter.Bbox = make([]float64, 4)
+
+		for i := 0; i < 4; i += 2 {
+			if err = eco.CheckPoint(f.Bbox[i], f.Bbox[i+1], srid); err != nil {
+				return nil, badRequest("Invalid bbox: %v", err)
+			}
+
+			filter.Bbox[i], filter.Bbox[i+1], err = eco.Reproject(
+				f.Bbox[i], f.Bbox[i+1], srid, eco.TreeSRID)
+
+			if err != nil {
+				return nil, badRequest("Invalid bbox: %v", err)
+			}
+		}
+	} else {
+		filter.Bbox = f.Bbox
+	}
+
+	filter.Otmcodes = f.Species
+	filter.SpeciesIds = f.Species_ids
+	filter.MinDiameter = filterDiameter(f.Min_diameter, diameterScale)
+	filter.MaxDiameter = filterDiameter(f.Max_diameter, diameterScale)
+	filter.Polygon = f.Polygon
+
+	if filter.PlantedAfter, err = parseFilterDate(f.Planted_after); err != nil {
+		return nil, err
+	}
+
+	if filter.PlantedBefore, err = parseFilterDate(f.Planted_before); err != nil {
+		return nil, err
+	}
+
+	if f.Geojson != nil {
+		if f.Polygon != "" {
+			return nil, badRequest(
+				"A filter can have a polygon or GeoJSON, not both")
+		}
+
+		geometry, err := eco.ParseGeoJSONGeometry(f.Geojson)
+
+		if err != nil {
+			return nil, badRequest("Invalid GeoJSON: %v", err)
+		}
+
+		if geometry.Type != "Polygon" && geometry.Type != "MultiPolygon" {
+			return nil, badRequest(
+				"Expected a GeoJSON Polygon or MultiPolygon, got %v",
+				geometry.Type)
+		}
+
+		if geometry, err = geometry.Reproject(srid, eco.TreeSRID); err != nil {
+			return nil, badRequest("Invalid GeoJSON: %v", err)
+		}
+
+		if filter.Polygon, err = geometry.WKT(); err != nil {
+			return nil, badRequest("Invalid GeoJSON: %v", err)
+		}
+	}
+
+	return filter, nil
+}
+
+// Get the regions that intersect the area of a filter
+//
+// Regions that don't intersect the area can't contain any
+// of its trees, and if only one does we can avoid finding
+// the region of every tree
+func regionsForArea(regions []eco.Region, filter *eco.TreeFilter) ([]eco.Region, error) {
+	areas := make([]string, 0, 2)
+
+	if filter.Bbox != nil {
+		bbox, err := eco.BboxWKT(filter.Bbox)
+
+		if err != nil {
+			return nil, badRequest("Invalid bbox: %v", err)
+		}
+
+		areas = append(areas, bbox)
+	}
+
+	if filter.Polygon != "" {
+		areas = append(areas, filter.Polygon)
+	}
+
+	for _, wkt := range areas {
+		area, err := eco.ParseGeosGeom(wkt)
+
+		if err != nil {
+			return nil, badRequest("Invalid filter area: %v", err)
+		}
+
+		regions, err = eco.RegionsIntersecting(regions, area)
+		eco.GeosDestroy(area)
 
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return regions, nil
+}
+
+// Keys that summaries can be grouped by. Any other
+// Group_by value is the name of a column
+const (
+	GroupByRegion    = "region"
+	GroupByITreeCode = "itree_code"
+	GroupByOtmcode   = "otmcode"
+	GroupBySpeciesId = "species_id"
+)
+
+// The totals of a summary
+//
+// Groups is only set for grouped summaries and maps
+// each group to the totals of its trees
+//
+// Units has the unit of each of the benefits, in the
+// summary's unit system
+//
+// Diagnostics counts the trees that were skipped and why
+type SummaryBenefits struct {
+	Benefits    map[string]float64
+	Dollars     map[string]float64
+	Groups      map[string]*BenefitsWrapper `json:",omitempty"`
+	Diagnostics *eco.Diagnostics
+	Units       map[string]string
+}
+
+// The result of a single tree in an itemized summary
+//
+// Id is the value of the query's "id" column, if it has one
+type ItemizedTree struct {
+	Id         string
+	Otmcode    string
+	Species_id int
+	Region     string
+	ITreeCode  string
+	Benefits   map[string]float64
+	Dollars    map[string]float64
+}
+
+// Running totals of the trees in each group of a summary
+type groupSums struct {
+	key     string
+	prices  map[string][]float64
+	options *requestOptions
+
+	factors map[string][]float64
+	dollars map[string][]float64
+}
+
+func newGroupSums(
+	key string, prices map[string][]float64, options *requestOptions) *groupSums {
+
+	return &groupSums{key, prices, options,
+		make(map[string][]float64), make(map[string][]float64)}
+}
+
+// Determine if a Group_by value is one of the GroupBy
+// keys rather than a column
+func isGroupByKey(key string) bool {
+	switch key {
+	case GroupByRegion, GroupByITreeCode, GroupByOtmcode, GroupBySpeciesId:
+		return true
+	}
+
+	return false
+}
+
+// Determine if a column can be selected by a filter
+// to group its trees by
+func isGroupColumn(column string) bool {
+	for _, c := range eco.GroupColumns {
+		if c == column {
+			return true
+		}
+	}
 
-		now := time.Now()
+	return false
+}
 
-		// Using a fixed region lets us avoid costly
-		// hash lookups. While we don't yet cache this value, we should
-		// consider it since instance geometries change so rarely
-		var regions []eco.Region
+// The group of a tree. Trees without a value for a
+// column are grouped under an empty string
+//
+// Returns a bad request if the column wasn't selected
+func (g *groupSums) group(rows eco.Fetchable, tree *eco.TreeResult) (string, error) {
+	switch g.key {
+	case GroupByRegion:
+		return tree.Region, nil
+	case GroupByITreeCode:
+		return tree.ITreeCode, nil
+	case GroupByOtmcode:
+		return tree.Otmcode, nil
+	case GroupBySpeciesId:
+		return strconv.Itoa(tree.SpeciesId), nil
+	}
 
-		if len(region) == 0 {
-			regions, err = cache.Db.GetRegionsForInstance(
-				cache.RegionGeometry, instanceid)
+	if !rows.HasColumn(g.key) {
+		return "", badRequest(
+			"Can't group by %v, the query doesn't select it", g.key)
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	value, _ := rows.GetColumn(g.key)
+	return value, nil
+}
+
+// Add a tree to its group. This is an eco.TreeFunc
+func (g *groupSums) add(rows eco.Fetchable, tree *eco.TreeResult) error {
+	// Skipped trees don't have any benefits to add
+	if tree.Factors == nil {
+		return nil
+	}
+
+	group, err := g.group(rows, tree)
+
+	if err != nil {
+		return err
+	}
+
+	factors, found := g.factors[group]
+	if !found {
+		factors = make([]float64, g.options.factors.Len())
+		g.factors[group] = factors
+		g.dollars[group] = make([]float64, g.options.factors.Len())
+	}
+
+	for i, value := range tree.Factors {
+		factors[i] += value
+	}
+
+	g.options.factors.CalcDollars(
+		g.prices[tree.Region], tree.Factors, g.dollars[group])
+
+	return nil
+}
+
+func (g *groupSums) groups() map[string]*BenefitsWrapper {
+	groups := make(map[string]*BenefitsWrapper)
+
+	for group, factors := range g.factors {
+		groups[group] = &BenefitsWrapper{
+			Benefits: g.options.benefits(factors),
+			Dollars:  g.options.dollars(g.dollars[group])}
+	}
+
+	return groups
+}
+
+// Run the summary query and calculate its benefits, passing the
+// result of each tree to onTree (which can be nil)
+//
+// Grouped summaries are calculated in the same pass and
+// can't also have an onTree function
+func summarize(
+	cache *cache.Snapshot,
+	data *SummaryPostData,
+	options *requestOptions,
+	onTree eco.TreeFunc) (*SummaryBenefits, error) {
+
+	plan, err := planSummary(cache, data, options, onTree != nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return plan.run(onTree)
+}
+
+// A summary that has been checked and is ready to run
+type summaryPlan struct {
+	cache      *cache.Snapshot
+	data       *SummaryPostData
+	options    *requestOptions
+	instanceid int
+
+	// The query, its arguments and the SRID of its points
+	query string
+	args  []interface{}
+	srid  int
+
+	// The fixed region of the trees, if there is one, or
+	// the regions to find them in
+	region  string
+	regions []eco.Region
+
+	groups *groupSums
+}
+
+// Check a summary request and find the regions it covers,
+// without running its query. Itemized summaries can't be
+// grouped
+//
+// Problems with the request are requestErrors, so they can
+// be answered before an itemized response starts
+func planSummary(
+	cache *cache.Snapshot,
+	data *SummaryPostData,
+	options *requestOptions,
+	itemized bool) (*summaryPlan, error) {
+
+	if cache.Db == nil {
+		return nil, errors.New(
+			"Summaries can't be run without an OpenTreeMap database")
+	}
+
+	query := data.Query
+	region := data.Region
+
+	instanceid, err := strconv.Atoi(data.Instance_id)
+
+	if err != nil {
+		return nil, badRequest("Invalid instance_id %q", data.Instance_id)
+	}
+
+	if err = checkBuildingType(data.Building_type); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	if query != "" {
+		if !cache.AllowRawSql {
+			return nil, badRequest(
+				"Raw SQL queries are disabled, use a filter instead")
+		}
+
+		if data.Filter != nil {
+			return nil, badRequest(
+				"A summary can have a query or a filter, not both")
+		}
+	}
+
+	srid := data.Srid
+	if srid == 0 {
+		srid = eco.TreeSRID
+	}
+
+	filter, err := data.Filter.treeFilter(
+		instanceid, srid, options.diameterScale)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var groups *groupSums
+
+	if data.Group_by != "" {
+		if itemized {
+			return nil, badRequest("Grouped summaries can't be itemized")
+		}
 
-			if len(regions) == 1 {
-				region = regions[0].Code
+		// Filters only select the columns they're asked for
+		if !isGroupByKey(data.Group_by) && query == "" {
+			if !isGroupColumn(data.Group_by) {
+				return nil, badRequest("Can't group by %v, expected one of %v",
+					data.Group_by, strings.Join(append([]string{
+						GroupByRegion, GroupByITreeCode, GroupByOtmcode,
+						GroupBySpeciesId}, eco.GroupColumns...), ", "))
 			}
+
+			filter.GroupColumn = data.Group_by
 		}
 
-		// Contains the running total of the various factors
-		instanceOverrides := cache.Overrides[instanceid]
+		groups = newGroupSums(data.Group_by, cache.Prices, options)
+	}
+
+	// Using a fixed region lets us avoid costly
+	// hash lookups. While we don't yet cache this value, we should
+	// consider it since instance geometries change so rarely
+	var regions []eco.Region
+
+	if len(region) == 0 {
+		regions, err = cache.RegionsForInstance(instanceid)
 
-		rows, err := cache.Db.ExecSql(query)
+		if err != nil {
+			return nil, err
+		}
 
-		s := time.Since(now)
-		fmt.Println(int64(s/time.Millisecond), "ms (query)")
+		regions, err = regionsForArea(regions, filter)
 
 		if err != nil {
 			return nil, err
 		}
 
-		factorsums, err :=
-			eco.CalcBenefitsWithData(
-				regions, rows, region,
-				cache.SpeciesData, cache.RegionData, instanceOverrides)
+		if len(regions) == 1 {
+			region = regions[0].Code
+		}
+	}
+
+	var args []interface{}
+
+	if query == "" {
+		// Trees only need coordinates if we have to
+		// find their regions
+		query, args, err = filter.Query(len(region) == 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		srid = eco.TreeSRID
+	}
+
+	return &summaryPlan{cache, data, options, instanceid,
+		query, args, srid, region, regions, groups}, nil
+}
+
+// Run the summary's query and calculate its benefits, passing
+// the result of each tree to onTree (which can be nil), or to
+// the groups of a grouped summary
+func (plan *summaryPlan) run(onTree eco.TreeFunc) (*SummaryBenefits, error) {
+	cache := plan.cache
+	options := plan.options
+
+	if plan.groups != nil {
+		onTree = plan.groups.add
+	}
+
+	now := time.Now()
+
+	// Contains the running total of the various factors
+	instanceOverrides := cache.Overrides[plan.instanceid]
+
+	rows, err := cache.Db.ExecSql(plan.query, plan.args...)
+
+	s := time.Since(now)
+	fmt.Println(int64(s/time.Millisecond), "ms (query)")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	diagnostics := eco.NewDiagnostics()
+
+	factorsums, dollarsums, err :=
+		eco.CalcBenefitsWithData(
+			options.factors, plan.regions, rows, plan.srid, plan.region,
+			plan.data.Building_type,
+			cache.SpeciesData, cache.RegionData, cache.BuildingData,
+			instanceOverrides, cache.Prices, onTree, diagnostics)
+
+	s = time.Since(now)
+	fmt.Println(int64(s/time.Millisecond), "ms (total)")
+
+	if err != nil {
+		return nil, err
+	}
+
+	options.system.ConvertFactorMap(options.factors, factorsums)
+
+	result := &SummaryBenefits{Benefits: factorsums, Dollars: dollarsums,
+		Diagnostics: diagnostics, Units: options.units()}
+
+	if plan.groups != nil {
+		result.Groups = plan.groups.groups()
+	}
+
+	return result, nil
+}
+
+// Parse the factors and units of a summary
+func (data *SummaryPostData) options(cache *cache.Snapshot) (*requestOptions, error) {
+	options, err := parseRequestOptions(cache, data.Factors,
+		data.Units, data.Diameter_units, "in")
+
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	return options, nil
+}
 
-		s = time.Since(now)
-		fmt.Println(int64(s/time.Millisecond), "ms (total)")
+func EcoSummaryPOST(ecoCache *cache.Cache) func(*SummaryPostData) (*SummaryBenefits, error) {
+	return func(data *SummaryPostData) (*SummaryBenefits, error) {
+		cache := ecoCache.Snapshot()
+		options, err := data.options(cache)
 
 		if err != nil {
 			return nil, err
 		}
 
-		return &BenefitsWrapper{Benefits: factorsums}, nil
+		return summarize(cache, data, options, nil)
 	}
 }
+
+// Writes the trees of an itemized summary as they are
+// calculated
+type itemizer interface {
+	writeHeader() error
+	writeTree(tree *ItemizedTree) error
+	writeError(err error) error
+}
+
+// One JSON object per line
+type ndjsonItemizer struct {
+	encoder *json.Encoder
+}
+
+func (i *ndjsonItemizer) writeHeader() error {
+	return nil
+}
+
+func (i *ndjsonItemizer) writeTree(tree *ItemizedTree) error {
+	return i.encoder.Encode(tree)
+}
+
+func (i *ndjsonItemizer) writeError(err error) error {
+	return i.encoder.Encode(map[string]string{"Error": err.Error()})
+}
+
+// One row per tree with a column for each of the
+// summary's factors and the total dollar value
+type csvItemizer struct {
+	writer  *csv.Writer
+	factors *eco.FactorSet
+}
+
+func (i *csvItemizer) writeHeader() error {
+	header := []string{"id", "otmcode", "species_id", "region", "itree_code"}
+	header = append(header, i.factors.Names()...)
+	header = append(header, "dollars")
+
+	return i.writer.Write(header)
+}
+
+func (i *csvItemizer) writeTree(tree *ItemizedTree) error {
+	record := []string{tree.Id, tree.Otmcode,
+		strconv.Itoa(tree.Species_id), tree.Region, tree.ITreeCode}
+
+	// Skipped trees have empty benefits
+	for _, factor := range i.factors.Names() {
+		value := ""
+		if tree.Benefits != nil {
+			value = strconv.FormatFloat(tree.Benefits[factor], 'f', -1, 64)
+		}
+		record = append(record, value)
+	}
+
+	dollars := ""
+	if tree.Dollars != nil {
+		dollars = strconv.FormatFloat(tree.Dollars["total"], 'f', -1, 64)
+	}
+	record = append(record, dollars)
+
+	i.writer.Write(record)
+	return i.writer.Error()
+}
+
+func (i *csvItemizer) writeError(err error) error {
+	i.writer.Write([]string{"error", err.Error()})
+	i.writer.Flush()
+	return i.writer.Error()
+}
+
+// Handles POST /eco_summary.json
+//
+// Without "itemize" this responds with the totals from
+// EcoSummaryPOST. With "itemize" set to "ndjson" or "csv" the
+// result of every row of the query is streamed back as it is
+// calculated, one line per tree. The query can select an "id"
+// column (after the standard columns) to identify its trees.
+//
+// Trees that were skipped (because they aren't in a region, their
+// species isn't available or their building type is unknown) have
+// no benefits. Benefits are in the summary's "units", but the units
+// themselves are only included in the totals.
+//
+// Problems with the request are answered with an error status
+// before the response starts. Errors during the calculation,
+// once the response has started, are reported as a final line:
+// an object with an "Error" key for "ndjson" and a row starting
+// with "error" for "csv".
+func EcoSummaryHandler(ecoCache *cache.Cache) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		log.Println(request.Method, request.URL)
+
+		if request.Method != "POST" {
+			http.Error(writer, "405: Method Not Allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		data := &SummaryPostData{}
+
+		if err := decodePostData(request, data); err != nil {
+			writeError(writer, badRequest("%v", err))
+			return
+		}
+
+		cache := ecoCache.Snapshot()
+		options, err := data.options(cache)
+
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+
+		var items itemizer
+
+		switch data.Itemize {
+		case "":
+			result, err := summarize(cache, data, options, nil)
+
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+
+			writeJSON(writer, result)
+			return
+
+		case "ndjson":
+			writer.Header().Set("Content-Type", "application/x-ndjson")
+			items = &ndjsonItemizer{json.NewEncoder(writer)}
+
+		case "csv":
+			writer.Header().Set("Content-Type", "text/csv")
+			csvWriter := csv.NewWriter(writer)
+			defer csvWriter.Flush()
+			items = &csvItemizer{csvWriter, options.factors}
+
+		default:
+			writeError(writer, badRequest(
+				"Invalid itemize value, expected ndjson or csv"))
+			return
+		}
+
+		// Check the request before the response starts, so
+		// its problems can be answered with an error status
+		plan, err := planSummary(cache, data, options, true)
+
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+
+		if err := items.writeHeader(); err != nil {
+			log.Println("ERROR:", err)
+			return
+		}
+
+		item := &ItemizedTree{}
+		onTree := func(rows eco.Fetchable, tree *eco.TreeResult) error {
+			id, _ := rows.GetColumn(eco.IdColumn)
+
+			*item = ItemizedTree{Id: id,
+				Otmcode:    tree.Otmcode,
+				Species_id: tree.SpeciesId,
+				Region:     tree.Region,
+				ITreeCode:  tree.ITreeCode}
+
+			if tree.Factors != nil {
+				dollars := make([]float64, options.factors.Len())
+				options.factors.CalcDollars(
+					cache.Prices[tree.Region], tree.Factors, dollars)
+
+				item.Benefits = options.benefits(tree.Factors)
+				item.Dollars = options.dollars(dollars)
+			}
+
+			return items.writeTree(item)
+		}
+
+		if _, err := plan.run(onTree); err != nil {
+			log.Println("ERROR:", err)
+			items.writeError(err)
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package endpoints
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var summaryColumns = []string{"diameter", "species_id", "otmcode", "id"}
+
+// Two trees, one without a diameter (which is calculated
+// anyway) and one with an unknown species
+func summaryTable() *mockTable {
+	return &mockTable{summaryColumns, [][]driver.Value{
+		{12.0, int64(1), "ACRU", "t1"},
+		{8.0, int64(2), "QURU", "t2"},
+		{nil, int64(1), "ACRU", "t3"},
+		{10.0, int64(9), "UNKN", "t4"}}}
+}
+
+func postSummary(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(
+		"POST", "/eco_summary.json", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestEcoSummaryTotals(t *testing.T) {
+	handler := EcoSummaryHandler(mockCache(t, summaryTable()))
+
+	response := postSummary(t, handler,
+		`{"instance_id": "1", "region": "NoEastXXX"}`)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	result := &SummaryBenefits{}
+
+	if err := json.Unmarshal(response.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Benefits["co2_storage"] <= 0 {
+		t.Fatalf("Expected co2_storage benefits, got %v", result.Benefits)
+	}
+
+	if result.Benefits["n_trees"] != 3 {
+		t.Fatalf("Expected 3 trees, got %v", result.Benefits["n_trees"])
+	}
+
+	if result.Diagnostics.MissingDiameter != 1 {
+		t.Fatalf("Expected 1 tree without a diameter, got %v",
+			result.Diagnostics.MissingDiameter)
+	}
+
+	if result.Diagnostics.UnknownSpecies["NoEastXXX"] != 1 {
+		t.Fatalf("Expected 1 tree with an unknown species, got %v",
+			result.Diagnostics.UnknownSpecies)
+	}
+
+	if result.Groups != nil {
+		t.Fatalf("Expected no groups, got %v", result.Groups)
+	}
+}
+
+func TestEcoSummaryItemized(t *testing.T) {
+	handler := EcoSummaryHandler(mockCache(t, summaryTable()))
+
+	response := postSummary(t, handler,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "ndjson"}`)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	if ct := response.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Expected application/x-ndjson, got %v", ct)
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	trees := []*ItemizedTree{}
+
+	for decoder.More() {
+		tree := &ItemizedTree{}
+
+		if err := decoder.Decode(tree); err != nil {
+			t.Fatal(err)
+		}
+
+		trees = append(trees, tree)
+	}
+
+	if len(trees) != 4 {
+		t.Fatalf("Expected 4 trees, got %v", len(trees))
+	}
+
+	for i, id := range []string{"t1", "t2", "t3", "t4"} {
+		if trees[i].Id != id || trees[i].Region != "NoEastXXX" {
+			t.Fatalf("Expected tree %v in NoEastXXX, got %+v", id, trees[i])
+		}
+	}
+
+	if trees[0].Benefits["co2_storage"] <= 0 || trees[0].ITreeCode != "ACRU" {
+		t.Fatalf("Expected benefits for t1, got %+v", trees[0])
+	}
+
+	if trees[2].Benefits == nil {
+		t.Fatalf("Expected benefits for t3, got %+v", trees[2])
+	}
+
+	if trees[3].Benefits != nil || trees[3].Dollars != nil || trees[3].ITreeCode != "" {
+		t.Fatalf("Expected no benefits for t4, got %+v", trees[3])
+	}
+}
+
+func TestEcoSummaryItemizedCsv(t *testing.T) {
+	handler := EcoSummaryHandler(mockCache(t, summaryTable()))
+
+	response := postSummary(t, handler, `{"instance_id": "1",
+		"region": "NoEastXXX", "itemize": "csv", "factors": ["co2_storage"]}`)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	records, err := csv.NewReader(response.Body).ReadAll()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"id", "otmcode", "species_id", "region", "itree_code",
+			"co2_storage", "dollars"},
+		{"t1", "ACRU"},
+		{"t2", "QURU"},
+		{"t3", "ACRU", "1", "NoEastXXX", "ACRU"},
+		{"t4", "UNKN", "9", "NoEastXXX", "", "", ""}}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v rows, got %v", len(expected), records)
+	}
+
+	for i, record := range expected {
+		for j, value := range record {
+			if records[i][j] != value {
+				t.Fatalf("Expected %q in row %v column %v, got %q",
+					value, i, j, records[i][j])
+			}
+		}
+	}
+}
+
+// Problems with the request are answered before the
+// response starts, with a 400
+func TestEcoSummaryItemizedRequestErrors(t *testing.T) {
+	handler := EcoSummaryHandler(mockCache(t, summaryTable()))
+
+	bodies := []string{
+		`{"instance_id": "x", "region": "NoEastXXX", "itemize": "ndjson"}`,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "json"}`,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "csv",
+		  "group_by": "otmcode"}`,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "ndjson",
+		  "query": "select 1"}`,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "csv",
+		  "filter": {"planted_after": "May 1"}}`,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "ndjson",
+		  "building_type": "castle"}`,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "csv",
+		  "units": "furlongs"}`,
+		`{"instance_id": 1}`}
+
+	for _, body := range bodies {
+		response := postSummary(t, handler, body)
+
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("Expected a 400 for %v, got %v: %v",
+				body, response.Code, response.Body)
+		}
+
+		if ct := response.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatalf("Expected an error message for %v, got %v", body, ct)
+		}
+	}
+}
+
+// Without a database summaries can't be run, which isn't
+// a problem with the request
+func TestEcoSummaryItemizedWithoutDatabase(t *testing.T) {
+	handler := EcoSummaryHandler(mockCache(t, nil))
+
+	response := postSummary(t, handler,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "ndjson"}`)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected a 500, got %v: %v", response.Code, response.Body)
+	}
+}
+
+// Errors once the response has started are written
+// after the trees that were calculated
+func TestEcoSummaryItemizedStreamError(t *testing.T) {
+	table := summaryTable()
+	table.rows[1][0] = "twelve"
+
+	handler := EcoSummaryHandler(mockCache(t, table))
+
+	response := postSummary(t, handler,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "ndjson"}`)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("Expected a tree and an error, got %v", lines)
+	}
+
+	tree := &ItemizedTree{}
+
+	if err := json.Unmarshal([]byte(lines[0]), tree); err != nil || tree.Id != "t1" {
+		t.Fatalf("Expected t1, got %v", lines[0])
+	}
+
+	trailer := map[string]string{}
+
+	if err := json.Unmarshal([]byte(lines[1]), &trailer); err != nil || trailer["Error"] == "" {
+		t.Fatalf("Expected an error, got %v", lines[1])
+	}
+
+	response = postSummary(t, handler,
+		`{"instance_id": "1", "region": "NoEastXXX", "itemize": "csv"}`)
+
+	// The error row is shorter than the others
+	reader := csv.NewReader(response.Body)
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The header, t1 and the error
+	if len(records) != 3 || records[1][0] != "t1" || records[2][0] != "error" {
+		t.Fatalf("Expected t1 and an error, got %v", records)
+	}
+}
+
+func TestEcoSummaryGroupBy(t *testing.T) {
+	handler := EcoSummaryHandler(mockCache(t, summaryTable()))
+
+	response := postSummary(t, handler,
+		`{"instance_id": "1", "region": "NoEastXXX", "group_by": "otmcode"}`)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	result := &SummaryBenefits{}
+
+	if err := json.Unmarshal(response.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Groups) != 2 ||
+		result.Groups["ACRU"] == nil || result.Groups["QURU"] == nil {
+		t.Fatalf("Expected groups for ACRU and QURU, got %v", result.Groups)
+	}
+
+	// The groups add up to the totals. Only the totals
+	// count the trees
+	for factor, total := range result.Benefits {
+		if factor == "n_trees" {
+			continue
+		}
+
+		sum := result.Groups["ACRU"].Benefits[factor] +
+			result.Groups["QURU"].Benefits[factor]
+
+		if math.Abs(sum-total) > 1e-6*math.Max(1, math.Abs(total)) {
+			t.Fatalf("Expected the groups of %v to add up to %v, got %v",
+				factor, total, sum)
+		}
+	}
+}
+
+func TestEcoSummaryGroupByColumn(t *testing.T) {
+	table := &mockTable{append(summaryColumns, "date_planted"),
+		[][]driver.Value{
+			{12.0, int64(1), "ACRU", "t1", "2010-04-01"},
+			{8.0, int64(2), "QURU", "t2", nil},
+			{10.0, int64(2), "QURU", "t3", "2010-04-01"}}}
+
+	handler := EcoSummaryHandler(mockCache(t, table))
+
+	response := postSummary(t, handler, `{"instance_id": "1",
+		"region": "NoEastXXX", "filter": {}, "group_by": "date_planted"}`)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %v: %v", response.Code, response.Body)
+	}
+
+	result := &SummaryBenefits{}
+
+	if err := json.Unmarshal(response.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Trees without a value are grouped under ""
+	if len(result.Groups) != 2 ||
+		result.Groups["2010-04-01"] == nil || result.Groups[""] == nil {
+		t.Fatalf("Expected groups for 2010-04-01 and \"\", got %v",
+			result.Groups)
+	}
+
+	response = postSummary(t, handler, `{"instance_id": "1",
+		"region": "NoEastXXX", "filter": {}, "group_by": "password"}`)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a 400, got %v: %v", response.Code, response.Body)
+	}
+}
@@ -0,0 +1,140 @@
+package endpoints
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/OpenTreeMap/otm-ecoservice/data"
+	"github.com/OpenTreeMap/otm-ecoservice/eco"
+	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
+	"io"
+	"testing"
+)
+
+// A database/sql driver that answers every query with a fixed
+// table, so summaries can be run without a database. The data
+// source name is the name of the table in mockTables
+type mockDriver struct{}
+
+type mockTable struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+var mockTables = make(map[string]*mockTable)
+
+func init() {
+	sql.Register("ecomock", mockDriver{})
+}
+
+func (mockDriver) Open(name string) (driver.Conn, error) {
+	table, found := mockTables[name]
+
+	if !found {
+		return nil, errors.New("No mock table " + name)
+	}
+
+	return &mockConn{table}, nil
+}
+
+type mockConn struct {
+	table *mockTable
+}
+
+func (c *mockConn) Prepare(query string) (driver.Stmt, error) {
+	return &mockStmt{c.table}, nil
+}
+
+func (c *mockConn) Close() error {
+	return nil
+}
+
+func (c *mockConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("Transactions aren't supported")
+}
+
+type mockStmt struct {
+	table *mockTable
+}
+
+func (s *mockStmt) Close() error {
+	return nil
+}
+
+func (s *mockStmt) NumInput() int {
+	return -1
+}
+
+func (s *mockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("Exec isn't supported")
+}
+
+func (s *mockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &mockRows{table: s.table}, nil
+}
+
+type mockRows struct {
+	table *mockTable
+	i     int
+}
+
+func (r *mockRows) Columns() []string {
+	return r.table.columns
+}
+
+func (r *mockRows) Close() error {
+	return nil
+}
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.table.rows) {
+		return io.EOF
+	}
+
+	copy(dest, r.table.rows[r.i])
+	r.i++
+
+	return nil
+}
+
+// Load the embedded data into a cache. If table isn't nil
+// the cache has a database that returns it for every query
+func mockCache(t *testing.T, table *mockTable) *cache.Cache {
+	factordata, _, err := eco.ReadFactorDataFS(data.Files, "data")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	speciesdata, err := eco.LoadSpeciesMapFS(data.Files, "species.json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := &cache.Snapshot{
+		Factors:      factordata.Factors,
+		RegionData:   factordata.Regions,
+		BuildingData: factordata.BuildingTypes,
+		SpeciesData:  speciesdata,
+		GetITreeCode: func(otmcode string, speciesid int, region string, instanceid int) (string, error) {
+			return speciesdata[region][otmcode], nil
+		}}
+
+	if table != nil {
+		mockTables[t.Name()] = table
+
+		db, err := sql.Open("ecomock", t.Name())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		snapshot.Db = (*eco.DBContext)(db)
+	}
+
+	ecoCache := &cache.Cache{}
+	ecoCache.Store(snapshot)
+
+	return ecoCache
+}
@@ -0,0 +1,273 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OpenTreeMap/otm-ecoservice/eco"
+	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
+	"strconv"
+)
+
+// Scenarios and batches can be given their trees as a GeoJSON
+// FeatureCollection of points. The properties of each feature
+// have the same names as the fields of the trees they describe
+
+// Get the SRID of the points in a request. This is the request's
+// SRID, if it has one, or the SRID of the "crs" of its GeoJSON,
+// if it has one, or web mercator. When both are given they must
+// be the same
+func requestSrid(srid int, collection *eco.GeoJSONFeatureCollection) (int, error) {
+	if collection != nil && collection.Crs != nil {
+		crsSrid, err := collection.Crs.Srid()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if srid != 0 && srid != crsSrid {
+			return 0, errors.New(
+				fmt.Sprintf("The srid %v doesn't match the GeoJSON crs (%v)",
+					srid, crsSrid))
+		}
+
+		srid = crsSrid
+	}
+
+	if srid == 0 {
+		srid = eco.SRIDWebMercator
+	}
+
+	return srid, nil
+}
+
+func checkFeatureCollection(collection *eco.GeoJSONFeatureCollection) error {
+	if collection.Type != "FeatureCollection" {
+		return errors.New(
+			fmt.Sprintf("Expected a GeoJSON FeatureCollection, got %v",
+				collection.Type))
+	}
+
+	return nil
+}
+
+// A string that can also be given as a JSON number, like the
+// id of a GeoJSON feature, which can be either (RFC 7946)
+type looseString string
+
+func (s *looseString) UnmarshalJSON(data []byte) error {
+	var str string
+
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = looseString(str)
+		return nil
+	}
+
+	var number json.Number
+
+	if err := json.Unmarshal(data, &number); err != nil {
+		return errors.New(
+			fmt.Sprintf("Expected a string or a number, got %v", string(data)))
+	}
+
+	*s = looseString(number.String())
+	return nil
+}
+
+// An integer that can also be given as a JSON string, since
+// GeoJSON properties often have ids as strings
+type looseInt int
+
+func (i *looseInt) UnmarshalJSON(data []byte) error {
+	var n int
+
+	if err := json.Unmarshal(data, &n); err == nil {
+		*i = looseInt(n)
+		return nil
+	}
+
+	var str string
+
+	if err := json.Unmarshal(data, &str); err == nil {
+		if n, err = strconv.Atoi(str); err == nil {
+			*i = looseInt(n)
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Expected an integer, got %v", string(data)))
+}
+
+// Decode the properties of the ith feature of a
+// collection into tree
+func decodeFeature(
+	collection *eco.GeoJSONFeatureCollection,
+	i int, tree interface{}) (*eco.GeoJSONFeature, error) {
+
+	feature := collection.Features[i]
+
+	if feature == nil || feature.Type != "Feature" {
+		return nil, errors.New(
+			fmt.Sprintf("GeoJSON feature %v is not a Feature", i))
+	}
+
+	if feature.Properties != nil {
+		if err := json.Unmarshal(feature.Properties, tree); err != nil {
+			return feature, errors.New(
+				fmt.Sprintf("Invalid properties for GeoJSON feature %v: %v",
+					i, err))
+		}
+	}
+
+	return feature, nil
+}
+
+// Get the location of a point feature. Returns false if
+// the feature doesn't have a geometry
+func featurePoint(feature *eco.GeoJSONFeature, i int) (float64, float64, bool, error) {
+	if feature.Geometry == nil {
+		return 0, 0, false, nil
+	}
+
+	x, y, err := feature.Geometry.Point()
+
+	if err != nil {
+		return 0, 0, false, errors.New(
+			fmt.Sprintf("Invalid geometry for GeoJSON feature %v: %v",
+				i, err))
+	}
+
+	return x, y, true, nil
+}
+
+// Convert the features of a collection into scenario trees
+//
+// Features without a "region" property are placed in the
+// i-Tree region that contains their point, which is in srid
+//
+// Features that can't be converted are left out. Their
+// problems are returned by the index of the feature
+func scenarioTreesFromGeoJSON(
+	cache *cache.Snapshot,
+	collection *eco.GeoJSONFeatureCollection,
+	srid int) ([]ScenarioTree, map[string]string, error) {
+
+	if err := checkFeatureCollection(collection); err != nil {
+		return nil, nil, err
+	}
+
+	trees := make([]ScenarioTree, 0, len(collection.Features))
+	problems := make(map[string]string)
+
+	for i := range collection.Features {
+		tree := ScenarioTree{}
+		err := scenarioTreeFromFeature(cache, collection, i, srid, &tree)
+
+		if _, bad := err.(*requestError); bad {
+			problems[strconv.Itoa(i)] = err.Error()
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		trees = append(trees, tree)
+	}
+
+	return trees, problems, nil
+}
+
+// Convert the ith feature of a collection into a scenario tree
+//
+// Returns a requestError if the feature is invalid or isn't
+// in an i-Tree region, or any other error if its region
+// couldn't be found
+func scenarioTreeFromFeature(
+	cache *cache.Snapshot,
+	collection *eco.GeoJSONFeatureCollection,
+	i int, srid int, tree *ScenarioTree) error {
+
+	feature, err := decodeFeature(collection, i, tree)
+
+	if err != nil {
+		return badRequest("%v", err)
+	}
+
+	if len(tree.Region) != 0 {
+		return nil
+	}
+
+	x, y, found, err := featurePoint(feature, i)
+
+	if err != nil {
+		return badRequest("%v", err)
+	}
+
+	if !found {
+		return badRequest("GeoJSON feature %v needs a point or a region", i)
+	}
+
+	x, y, err = eco.ToRegionSRID(x, y, srid)
+
+	if err != nil {
+		return badRequest("Invalid point for GeoJSON feature %v: %v", i, err)
+	}
+
+	tree.Region, err = cache.RegionIndex.RegionCodeForPoint(x, y)
+
+	if err != nil {
+		return err
+	}
+
+	if len(tree.Region) == 0 {
+		return badRequest("No i-Tree region contains GeoJSON feature %v", i)
+	}
+
+	return nil
+}
+
+// Convert the features of a collection into batch trees
+//
+// The id of a tree is its "id" property or, if it doesn't
+// have one, the id of its feature. Regions are found from
+// the points of the features by EcoBatchPOST
+//
+// Trees for features that can't be converted have the
+// problem with the feature, which EcoBatchPOST reports
+// as the tree's error
+func batchTreesFromGeoJSON(
+	collection *eco.GeoJSONFeatureCollection) ([]BatchTree, error) {
+
+	if err := checkFeatureCollection(collection); err != nil {
+		return nil, err
+	}
+
+	trees := make([]BatchTree, len(collection.Features))
+
+	for i := range collection.Features {
+		tree := &trees[i]
+		feature, err := decodeFeature(collection, i, tree)
+
+		if feature != nil && len(tree.Id) == 0 {
+			tree.Id = looseString(feature.IdString())
+		}
+
+		if err != nil {
+			tree.problem = err.Error()
+			continue
+		}
+
+		x, y, found, err := featurePoint(feature, i)
+
+		if err != nil {
+			tree.problem = err.Error()
+			continue
+		}
+
+		if found {
+			tree.X = &x
+			tree.Y = &y
+		}
+	}
+
+	return trees, nil
+}
@@ -0,0 +1,103 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+)
+
+// Most endpoints are plain functions that go-rest turns into
+// handlers. Endpoints that need to write their own responses
+// (to stream them, for instance) are http.Handlers that use
+// these helpers to behave like go-rest for everything else
+
+// Decode the body of a POST request into data, which must
+// be a struct pointer
+//
+// Like go-rest, JSON bodies are unmarshalled directly and forms
+// can either have a single "JSON" value or values with the same
+// names as data's string fields
+func decodePostData(request *http.Request, data interface{}) error {
+	ct := request.Header.Get("Content-Type")
+	mediatype := ""
+
+	if ct != "" {
+		var err error
+		mediatype, _, err = mime.ParseMediaType(ct)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	switch mediatype {
+	case "", "application/x-www-form-urlencoded":
+		if err := request.ParseForm(); err != nil {
+			return err
+		}
+
+		if len(request.Form) == 1 && request.Form.Get("JSON") != "" {
+			return json.Unmarshal([]byte(request.Form.Get("JSON")), data)
+		}
+
+		v := reflect.ValueOf(data).Elem()
+		for key, value := range request.Form {
+			f := v.FieldByName(key)
+			if f.IsValid() && f.CanSet() && f.Kind() == reflect.String {
+				f.SetString(value[0])
+			}
+		}
+
+		return nil
+
+	case "application/json":
+		defer request.Body.Close()
+		return json.NewDecoder(request.Body).Decode(data)
+	}
+
+	return errors.New("Unsupported POST Content-Type: " + ct)
+}
+
+// A problem with a request, which is written with a 400
+// status instead of go-rest's 500 (see writeError)
+type requestError struct {
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{fmt.Sprintf(format, args...)}
+}
+
+// Write an error the same way go-rest does, except for
+// requestErrors, which are bad requests
+func writeError(writer http.ResponseWriter, err error) {
+	log.Println("ERROR:", err)
+
+	status := http.StatusInternalServerError
+	if _, ok := err.(*requestError); ok {
+		status = http.StatusBadRequest
+	}
+
+	http.Error(writer, err.Error(), status)
+}
+
+// Write a JSON response the same way go-rest does
+func writeJSON(writer http.ResponseWriter, result interface{}) {
+	j, err := json.Marshal(result)
+
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(j)
+}
@@ -9,9 +9,9 @@ type ITreeCodes struct {
 	Codes map[string][]string
 }
 
-func ITreeCodesGET(cache *cache.Cache) func() *ITreeCodes {
+func ITreeCodesGET(ecoCache *cache.Cache) func() *ITreeCodes {
 	return func() *ITreeCodes {
-		codes := eco.GetITreeCodesByRegion(cache.RegionData)
+		codes := eco.GetITreeCodesByRegion(ecoCache.Snapshot().RegionData)
 		return &ITreeCodes{Codes: codes}
 	}
 }
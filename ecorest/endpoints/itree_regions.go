@@ -0,0 +1,111 @@
+package endpoints
+
+import (
+	"errors"
+	"github.com/OpenTreeMap/otm-ecoservice/eco"
+	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
+	"strconv"
+)
+
+// Either Points or Instance_id must be given
+//
+// Points are x, y pairs in Srid, which can be eco.SRIDWGS84
+// (longitude and latitude) or eco.SRIDWebMercator (the default,
+// as for the other endpoints)
+type RegionsPostData struct {
+	Points      [][]float64
+	Srid        int
+	Instance_id string
+}
+
+// The codes of the i-Tree regions for a lookup
+type RegionCodes struct {
+	Regions []string
+}
+
+// Find the i-Tree regions of points or of an instance
+//
+// For points, Regions has the code of the region that contains
+// each point, in the same order as the points. The code is empty
+// if no region contains the point.
+//
+// For an instance, Regions has the codes of every region that
+// intersects the instance's bounds.
+//
+// Request (with bogus example parameters):
+//
+// POST /itree_regions.json
+//
+// {
+//   "srid": 4326,
+//   "points": [[-75.16, 39.95], [0, 0]]
+// }
+//
+// Response (with bogus example values):
+//
+// {
+//   "Regions": ["NoEastXXX", ""]
+// }
+func ITreeRegionsPOST(ecoCache *cache.Cache) func(*RegionsPostData) (*RegionCodes, error) {
+	return func(data *RegionsPostData) (*RegionCodes, error) {
+		cache := ecoCache.Snapshot()
+		codes := make([]string, 0)
+
+		if len(data.Instance_id) > 0 {
+			if data.Points != nil {
+				return nil, errors.New(
+					"Regions can be found for points or an instance, not both")
+			}
+
+			instanceid, err := strconv.Atoi(data.Instance_id)
+
+			if err != nil {
+				return nil, err
+			}
+
+			regions, err := cache.RegionsForInstance(instanceid)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, region := range regions {
+				codes = append(codes, region.Code)
+			}
+
+			return &RegionCodes{Regions: codes}, nil
+		}
+
+		if data.Points == nil {
+			return nil, errors.New("Missing points or instance_id")
+		}
+
+		srid, err := requestSrid(data.Srid, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, point := range data.Points {
+			if len(point) != 2 {
+				return nil, errors.New("Points must have an x and a y")
+			}
+
+			x, y, err := eco.ToRegionSRID(point[0], point[1], srid)
+
+			if err != nil {
+				return nil, err
+			}
+
+			code, err := cache.RegionIndex.RegionCodeForPoint(x, y)
+
+			if err != nil {
+				return nil, err
+			}
+
+			codes = append(codes, code)
+		}
+
+		return &RegionCodes{Regions: codes}, nil
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/cache"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/config"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/endpoints"
+	"net/http"
 	"net/url"
 )
 
 type restManager struct {
 	ITreeCodesGET      (func() *endpoints.ITreeCodes)
+	ITreeRegionsPOST   (func(*endpoints.RegionsPostData) (*endpoints.RegionCodes, error))
 	EcoGET             (func(url.Values) (*endpoints.BenefitsWrapper, error))
-	EcoSummaryPOST     (func(*endpoints.SummaryPostData) (*endpoints.BenefitsWrapper, error))
+	EcoSummaryHandler  http.Handler
 	EcoScenarioPOST    (func(*endpoints.ScenarioPostData) (*endpoints.Scenario, error))
+	EcoBatchPOST       (func(*endpoints.BatchPostData) (*endpoints.BatchBenefits, error))
 	InvalidateCacheGET (func())
 }
 
@@ -20,8 +23,10 @@ func GetManager(cfg config.Config) *restManager {
 	invalidateCache()
 
 	return &restManager{endpoints.ITreeCodesGET(ecoCache),
+		endpoints.ITreeRegionsPOST(ecoCache),
 		endpoints.EcoGET(ecoCache),
-		endpoints.EcoSummaryPOST(ecoCache),
+		endpoints.EcoSummaryHandler(ecoCache),
 		endpoints.EcoScenarioPOST(ecoCache),
+		endpoints.EcoBatchPOST(ecoCache),
 		invalidateCache}
 }
@@ -3,16 +3,25 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/OpenTreeMap/otm-ecoservice/data"
+	"github.com/OpenTreeMap/otm-ecoservice/eco"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest"
 	"github.com/OpenTreeMap/otm-ecoservice/ecorest/config"
 	"github.com/ungerik/go-rest"
 	"log"
+	"net/http"
 	"os"
 	"runtime/pprof"
+	"strings"
 )
 
 var (
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	validate   = flag.Bool("validate", false,
+		"check the files in the data directory and exit")
+	bundle = flag.String("bundle", "",
+		"convert the CSV files in the data directory to a bundle "+
+			"at this path (.bin, .json or .json.gz) and exit")
 )
 
 func main() {
@@ -29,13 +38,87 @@ func main() {
 
 	cfg := config.LoadConfig()
 
+	if (*validate || *bundle != "") && cfg.DataPath == "" {
+		log.Fatal("Set OTM_ECO_DATA_DIR to the data directory " +
+			"to validate or bundle")
+	}
+
+	if *validate {
+		// The directory overrides the embedded data, so
+		// regions can leave out the factors it has
+		embedded, _, err := eco.ReadFactorDataFS(data.Files, "data")
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		problems, err := eco.ValidateOverrideData(cfg.DataPath, embedded)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+
+		fmt.Println("No problems found in", cfg.DataPath)
+		return
+	}
+
+	if *bundle != "" {
+		writeBundle(cfg.DataPath, *bundle)
+		return
+	}
+
 	endpoints := ecorest.GetManager(cfg)
 
 	rest.HandleGET("/itree_codes.json", endpoints.ITreeCodesGET)
+	rest.HandlePOST("/itree_regions.json", endpoints.ITreeRegionsPOST)
 	rest.HandleGET("/eco.json", endpoints.EcoGET)
-	rest.HandlePOST("/eco_summary.json", endpoints.EcoSummaryPOST)
+	http.Handle("/eco_summary.json", endpoints.EcoSummaryHandler)
 	rest.HandlePOST("/eco_scenario.json", endpoints.EcoScenarioPOST)
+	rest.HandlePOST("/eco_batch.json", endpoints.EcoBatchPOST)
 	rest.HandleGET("/invalidate_cache", endpoints.InvalidateCacheGET)
 
 	rest.RunServer(fmt.Sprintf("%v:%v", cfg.ServerHost, cfg.ServerPort), nil)
 }
+
+// Convert the CSV files in a data directory to a bundle, in
+// the form given by the extension of path
+func writeBundle(dataPath string, path string) {
+	bundle, err := eco.BuildBundle(dataPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(path)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".bin"):
+		err = eco.WriteBinaryBundle(f, bundle)
+	case strings.HasSuffix(path, ".gz"):
+		err = eco.WriteBundle(f, bundle, true)
+	default:
+		err = eco.WriteBundle(f, bundle, false)
+	}
+
+	if err == nil {
+		err = f.Close()
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Wrote %v regions to %v\n", len(bundle.Regions), path)
+}